@@ -0,0 +1,104 @@
+package swan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithCapacityPoll asks every member which is up for its load on the path every interval, the
+// answer being a number from zero for an idle master. The weighted selector divides the weight
+// of a member by one plus its load, so a master twice as loaded gets fewer requests. A member
+// which doesn't answer falls back to its static weight until it does, as do all of them when the
+// poll is off
+func WithCapacityPoll(path string, interval time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.capacityPath = strings.TrimLeft(path, "/")
+		config.capacityInterval = interval
+	}
+}
+
+// hintedWeight returns the weight of the member adjusted by the load it reported, the static
+// weight when it reported none
+func (m *member) hintedWeight() float64 {
+	if !m.loadReported {
+		return float64(m.weight)
+	}
+
+	return float64(m.weight) / (1 + m.load)
+}
+
+// capacityLoop polls the members for their load straight away and then periodically until the
+// cluster is closed
+func (c *cluster) capacityLoop() {
+	for {
+		c.pollCapacity()
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.config.capacityInterval):
+		}
+	}
+}
+
+// pollCapacity asks the members which are up for their load, the members which don't answer
+// lose their load hint
+func (c *cluster) pollCapacity() {
+	c.RLock()
+	var members []*member
+	for _, n := range c.members {
+		if n.status == memberStatusUp {
+			members = append(members, n)
+		}
+	}
+	c.RUnlock()
+
+	for _, n := range members {
+		load, err := c.askLoad(n)
+		if err != nil {
+			c.config.logger.Printf("pollCapacity(): host: %s didn't report its load, error: %s\n", n.endpoint, err)
+		}
+		c.Lock()
+		n.load, n.loadReported = load, err == nil
+		c.Unlock()
+	}
+}
+
+// askLoad returns the load reported by the node
+func (c *cluster) askLoad(node *member) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.capacityInterval)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", joinURL(node.endpoint, c.config.capacityPath), nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.decorate(request); err != nil {
+		return 0, err
+	}
+	res, err := c.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, errors.New(fmt.Sprintf("capacity poll returned status: %d", res.StatusCode))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	load, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if load < 0 {
+		return 0, errors.New(fmt.Sprintf("capacity poll returned a negative load: %v", load))
+	}
+
+	return load, nil
+}
@@ -0,0 +1,48 @@
+package swan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapacityPoll(t *testing.T) {
+	one, first := newJSONServer(t, "/v1/load")
+	two, second := newJSONServer(t, "/v1/load")
+	first.Store("0")
+	second.Store("3\n")
+
+	_, err := newCluster(http.DefaultClient, one.URL, WithCapacityPoll("/v1/load", 0))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, one.URL+","+two.URL, WithSelector(SelectWeighted()),
+		WithCapacityPoll("/v1/load", time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.True(t, waitFor(func() bool {
+		c.RLock()
+		defer c.RUnlock()
+		return c.members[0].loadReported && c.members[1].loadReported
+	}), "should poll straight away")
+	counts := func() map[string]int {
+		selected := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			endpoint, _ := c.getMember()
+			selected[endpoint]++
+		}
+		return selected
+	}
+	selected := counts()
+	assert.True(t, selected[one.URL] > 780 && selected[one.URL] < 820, "should weight inversely to the load: %v", selected)
+
+	// step: a member which doesn't answer falls back to its static weight
+	second.Store("busy")
+	c.pollCapacity()
+	assert.False(t, c.members[1].loadReported, "should drop the hint")
+	first.Store("-1")
+	c.pollCapacity()
+	assert.False(t, c.members[0].loadReported, "should drop the hint")
+	assert.Equal(t, map[string]int{one.URL: 500, two.URL: 500}, counts(), "should use the static weights")
+}
@@ -1,17 +1,26 @@
 package swan
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"regexp"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // Swan is the interface to the Swan API
@@ -39,8 +48,167 @@ var (
 	ErrSwanDown = errors.New("all the Swan hosts are presently down")
 	// ErrTimeoutError is thrown when the operation has timed out
 	ErrTimeoutError = errors.New("the operation has timed out")
+	// ErrInjectedFailure is thrown when a request was failed on purpose by the chaos rates
+	ErrInjectedFailure = errors.New("failure injected by the chaos rates")
+	// ErrProbeUnauthorized is thrown when a health check was refused with a 401 or 403, i.e. the
+	// member is alive but the credentials are wrong or expired
+	ErrProbeUnauthorized = errors.New("health check was not authorized")
+	// ErrTokenRefresh is thrown when the auth token could not be obtained from the token source,
+	// the request is not sent and the member not held responsible
+	ErrTokenRefresh = errors.New("the auth token could not be refreshed")
+	// ErrUnknownMember is thrown when the endpoint is not a member of the cluster
+	ErrUnknownMember = errors.New("the endpoint is not a member of the cluster")
+	// ErrObserverMode is thrown when a member is selected from a cluster which only observes
+	ErrObserverMode = errors.New("the cluster only observes its members")
+	// ErrAllNodesDown is the category of the request failures as all the members are down
+	ErrAllNodesDown = ErrSwanDown
+	// ErrTimeout is the category of the request failures timing out, the same as ErrTimeoutError
+	ErrTimeout = ErrTimeoutError
+	// ErrNodeUnreachable is the category of the request failures which didn't get an answer
+	ErrNodeUnreachable = errors.New("the Swan host could not be reached")
+	// ErrBodyTooLarge is thrown when the body of a request is over the retry limit and the policy
+	// rejects it, see WithRetryBodyLimit
+	ErrBodyTooLarge = errors.New("the request body is over the retry limit")
+	// ErrServerError is the category of the request failures answered with a 5xx status
+	ErrServerError = errors.New("the Swan host answered with a server error")
+	// ErrClusterPartitioned is thrown when a write is refused as the members disagree about the
+	// leader, see WithLeaderPoll
+	ErrClusterPartitioned = errors.New("the Swan masters disagree about the leader")
+	// ErrShuttingDown is thrown when a member is selected once the cluster is shutting down
+	ErrShuttingDown = errors.New("the cluster is shutting down")
+	// ErrSaturated is thrown when all the members which are up have the maximum in-flight requests
+	ErrSaturated = errors.New("all the Swan hosts are at their maximum in-flight requests")
+	// ErrIncompatibleVersion is thrown when the version of a member doesn't satisfy the constraint
+	// of the version check
+	ErrIncompatibleVersion = errors.New("the version of the Swan host is incompatible")
 )
 
+// MemberError is the failure of a single member of the cluster
+type MemberError struct {
+	// the endpoint of the member
+	Endpoint string
+	// the reason it failed
+	Err error
+}
+
+func (e *MemberError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Endpoint, e.Err)
+}
+
+func (e *MemberError) Unwrap() error {
+	return e.Err
+}
+
+// ProbeError is the failure of a health check along with its kind, which prefixes its message
+type ProbeError struct {
+	// whether the member couldn't be reached or answered as unhealthy
+	Failure ProbeFailure
+	// the reason it failed
+	Err error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("%s failure: %s", e.Failure, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// FailoverError is returned when a request failed after failing over from other members, with
+// the members tried before in order. errors.Is matches the final error as well as the ones of
+// the members tried
+type FailoverError struct {
+	// the members the request failed on before, at most as many as the members of the cluster
+	Attempts []*MemberError
+	// the reason the request finally failed
+	Err error
+}
+
+func (e *FailoverError) Error() string {
+	var attempts []string
+	for _, attempt := range e.Attempts {
+		attempts = append(attempts, fmt.Sprintf("%s (%s)", attempt.Endpoint, attempt.Err))
+	}
+
+	return fmt.Sprintf("tried %s -> gave up: %s", strings.Join(attempts, " -> "), e.Err)
+}
+
+// Unwrap returns the final error along with the failures of the members tried before
+func (e *FailoverError) Unwrap() []error {
+	errs := []error{e.Err}
+	for _, attempt := range e.Attempts {
+		errs = append(errs, attempt)
+	}
+
+	return errs
+}
+
+// PingError is returned when some of the members failed a health check, errors.Is matches
+// ErrSwanDown when none of them passed
+type PingError struct {
+	// the members which failed
+	Failures []*MemberError
+	// the number of members which passed
+	Healthy int
+}
+
+func (e *PingError) Error() string {
+	var failures []string
+	for _, failure := range e.Failures {
+		failures = append(failures, failure.Error())
+	}
+
+	return fmt.Sprintf("%d of %d members failed the health check: %s",
+		len(e.Failures), len(e.Failures)+e.Healthy, strings.Join(failures, "; "))
+}
+
+// Unwrap returns the failures of the members, along with ErrSwanDown when none passed
+func (e *PingError) Unwrap() []error {
+	var errs []error
+	if e.Healthy == 0 {
+		errs = append(errs, ErrSwanDown)
+	}
+	for _, failure := range e.Failures {
+		errs = append(errs, failure)
+	}
+
+	return errs
+}
+
+// Partial checks if some of the members passed the health check
+func (e *PingError) Partial() bool {
+	return e.Healthy > 0
+}
+
+// PingResult is the outcome of Ping, a snapshot of the members taken when the probes started
+type PingResult struct {
+	// the members which were probed
+	Members int
+	// the members which passed the liveness check
+	Reachable int
+	// the members which must pass for the cluster to be healthy, see WithPingQuorum
+	Quorum int
+	// whether the members which passed met the quorum
+	Healthy bool
+	// the outcome of each member, in the order of the members
+	Endpoints []EndpointReachability
+	// when the probes started
+	Time time.Time
+}
+
+// EndpointReachability is the outcome of the liveness check of a member by Ping
+type EndpointReachability struct {
+	// the endpoint of the member
+	Endpoint string
+	// whether the member passed the liveness check
+	Reachable bool
+	// how long the liveness check took
+	Latency time.Duration
+	// why the member failed the liveness check, nil when it passed
+	Err error
+}
+
 type swanClient struct {
 	sync.RWMutex
 	// swanAddr
@@ -50,23 +218,187 @@ type swanClient struct {
 	// a custom logger for debug log messages
 	debugLog *log.Logger
 	hosts    *cluster
+	// retries the writes answered with a 409 conflict, nil fails them
+	conflictRetry *ConflictRetry
+	// the context of the requests, nil uses the background
+	ctx context.Context
+}
+
+// ConflictRetry retries the writes swan answers with a 409 conflict, i.e. while a deployment is
+// already in progress, on the same member until the conflict settles
+type ConflictRetry struct {
+	// the maximum retries of a write
+	Attempts int
+	// the wait before the first retry, doubled for every next one
+	Backoff time.Duration
+	// the maximum time spent waiting over all the retries of a write, zero is unlimited
+	MaxWait time.Duration
+}
+
+// next returns the wait before the retry following the given ones, false when the attempts or
+// the time are used up
+func (p *ConflictRetry) next(retries int, waited time.Duration) (time.Duration, bool) {
+	if retries >= p.Attempts {
+		return 0, false
+	}
+	wait := p.Backoff << uint(retries)
+	if p.MaxWait > 0 && waited+wait > p.MaxWait {
+		if waited >= p.MaxWait {
+			return 0, false
+		}
+		wait = p.MaxWait - waited
+	}
+
+	return wait, true
 }
 
 // NewClient creates a new swan client
-func NewClient(swanURL string) (Swan, error) {
-	debugLogOutput := ioutil.Discard
-	httpClient := http.DefaultClient
-	hosts, err := newCluster(httpClient, swanURL)
+func NewClient(swanURL string, opts ...ClusterOption) (Swan, error) {
+	return newClient(strings.Split(swanURL, ","), opts...)
+}
+
+// NewClientFromReader creates a new swan client of the endpoints read from the reader, i.e. a
+// file listing the members, one per line. The blank lines and the lines starting with a # are
+// ignored, the endpoints are validated as the ones given to NewClient
+func NewClientFromReader(reader io.Reader, opts ...ClusterOption) (Swan, error) {
+	endpoints, err := readEndpoints(reader)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(endpoints, opts...)
+}
+
+// readEndpoints reads the endpoints listed one per line, skipping the blank lines and comments
+func readEndpoints(reader io.Reader) ([]string, error) {
+	var endpoints []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		endpoints = append(endpoints, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read the endpoints, error: %s", err))
+	}
+
+	return endpoints, nil
+}
+
+// newClient creates a new swan client of the endpoints
+func newClient(endpoints []string, opts ...ClusterOption) (Swan, error) {
+	config := newClusterConfig(opts...)
+	httpClient := config.httpClient
+	if httpClient == nil {
+		httpClient = newHTTPClient(config)
+	}
+	hosts, err := newClusterEndpoints(httpClient, endpoints, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return &swanClient{
-		httpClient: http.DefaultClient,
+		httpClient: httpClient,
 		hosts:      hosts,
-		debugLog:   log.New(debugLogOutput, "", 0),
+		debugLog:   config.logger,
 	}, nil
 }
 
+// RetryConflicts returns a client sharing the members and connections of the given one, which
+// retries the writes answered with a 409 conflict following the policy. The conflicts don't fail
+// the member over, the write is retried on the same one. Not every conflict is transient, so
+// it's meant for the calls known to race a deployment, i.e.
+//
+//	swan.RetryConflicts(client, policy).CreateApplication(version)
+//
+// A client not created by NewClient is returned unchanged
+func RetryConflicts(client Swan, policy ConflictRetry) Swan {
+	r, ok := client.(*swanClient)
+	if !ok {
+		return client
+	}
+
+	copied := r.copy()
+	copied.conflictRetry = &policy
+
+	return copied
+}
+
+// ForContext returns a client sharing the members and connections of the given one, whose
+// requests are sent with the context. A deadline of the context replaces the timeout of the
+// http client rather than adding to it, so a call known to be slow can be given longer, i.e.
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+//	defer cancel()
+//	apps, err := swan.ForContext(client, ctx).Applications(nil)
+//
+// The requests cut short by the context fail with its error without marking the member down.
+// Each attempt gets a share of the time left split between the members up, so a member hanging
+// fails over in time, and no member is tried once the deadline is too close. A client not created
+// by NewClient is returned unchanged
+func ForContext(client Swan, ctx context.Context) Swan {
+	r, ok := client.(*swanClient)
+	if !ok {
+		return client
+	}
+	copied := r.copy()
+	copied.ctx = ctx
+	if _, found := ctx.Deadline(); found && r.httpClient.Timeout > 0 {
+		httpClient := *r.httpClient
+		httpClient.Timeout = 0
+		copied.httpClient = &httpClient
+	}
+
+	return copied
+}
+
+// copy returns a client sharing the members and connections, with the same settings
+func (r *swanClient) copy() *swanClient {
+	return &swanClient{
+		swanAddr:      r.swanAddr,
+		httpClient:    r.httpClient,
+		debugLog:      r.debugLog,
+		hosts:         r.hosts,
+		conflictRetry: r.conflictRetry,
+		ctx:           r.ctx,
+	}
+}
+
+// context returns the context of the requests
+func (r *swanClient) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// minAttemptBudget is the least time left before the deadline of a call worth failing over for
+const minAttemptBudget = 20 * time.Millisecond
+
+// attemptContext returns the context of an attempt of the call. When the context of the call has
+// a deadline the attempt gets a share of the time left, split between the members up, so a
+// member hanging doesn't use up the time needed to fail over to the others
+func (r *swanClient) attemptContext() (context.Context, context.CancelFunc) {
+	ctx := r.context()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx, func() {}
+	}
+	up := len(r.hosts.activeMembers())
+	if up <= 1 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(up))
+}
+
+// budgetLeft checks if the deadline of the call, if any, leaves the time to fail over
+func (r *swanClient) budgetLeft() bool {
+	deadline, ok := r.context().Deadline()
+	return !ok || time.Until(deadline) >= minAttemptBudget
+}
+
 func (r *swanClient) apiGet(uri string, post, result interface{}) error {
 	return r.apiCall("GET", uri, post, result)
 }
@@ -84,43 +416,182 @@ func (r *swanClient) apiDelete(uri string, post, result interface{}) error {
 }
 
 func (r *swanClient) apiCall(method, uri string, body, result interface{}) error {
-	for {
-		var url string
-		var err error
+	var attempts []*MemberError
+	err := r.attemptCall(method, uri, body, result, &attempts)
+	if err != nil && len(attempts) > 0 {
+		return &FailoverError{Attempts: attempts, Err: err}
+	}
+
+	return err
+}
 
-		// step: grab a member from the cluster and attempt to perform the request
-		member, err := r.hosts.getMember()
+// attemptCall performs the call like apiCall, recording the members it failed over from
+func (r *swanClient) attemptCall(method, uri string, body, result interface{}, attempts *[]*MemberError) error {
+	// step: keep the trail bounded to the members of the cluster, dropping the oldest
+	r.hosts.RLock()
+	limit := len(r.hosts.members)
+	r.hosts.RUnlock()
+	failedOver := func(member string, err error) {
+		r.hosts.recordFailover(time.Now())
+		if len(*attempts) >= limit && len(*attempts) > 0 {
+			*attempts = (*attempts)[1:]
+		}
+		*attempts = append(*attempts, &MemberError{Endpoint: member, Err: err})
+	}
+	// step: encode the body once, every attempt sends the same bytes
+	var jsonBody []byte
+	if body != nil {
+		var err error
+		jsonBody, err = json.Marshal(body)
 		if err != nil {
-			return ErrSwanDown
+			return err
 		}
+	}
+	// step: a body over the limit is sent once at most, its failures aren't retried
+	retryable := len(jsonBody) <= r.hosts.config.retryBodyLimit
+	if !retryable && r.hosts.config.oversizedBodyPolicy == RejectOversized {
+		return fmt.Errorf("%w: %d bytes, limit: %d", ErrBodyTooLarge, len(jsonBody), r.hosts.config.retryBodyLimit)
+	}
+	// step: the same key goes with every attempt so a write applied twice can be deduplicated
+	idempotencyKey := r.hosts.idempotencyKey(method)
+	stickyKey := r.hosts.stickyKey(method, uri)
+	// step: refuse the writes while the masters disagree about the leader, the reads carry on
+	if isWrite(method) && r.hosts.isPartitioned() {
+		return ErrClusterPartitioned
+	}
+	// the member to retry on keeping the in-flight slot of the attempt, i.e. once on a fresh
+	// connection after a pooled one was found closed, or after a conflict
+	var staleRetry string
+	var staleRetried bool
+	// the retries after a conflict and the time waited for them
+	var conflicts int
+	var conflictWait time.Duration
+	// whether the attempt is a write routed to the leader, see WithLeaderWrites
+	var toLeader bool
 
-		url = fmt.Sprintf("%s/%s", member, uri)
+	for {
+		var url string
+		var err error
 
-		var jsonBody []byte
-		if body != nil {
-			jsonBody, err = json.Marshal(body)
+		// step: grab a member from the cluster and attempt to perform the request, the retry on a
+		// fresh connection keeps the in-flight slot of the attempt which failed
+		member := staleRetry
+		staleRetry = ""
+		// step: the writes go to the leader while it's healthy for them, whatever its status
+		if member == "" {
+			toLeader = false
+			if isWrite(method) {
+				member, toLeader = r.hosts.acquireLeader()
+			}
+		}
+		if member == "" {
+			member, err = r.hosts.acquireMember(r.context(), stickyKey)
 			if err != nil {
 				return err
 			}
 		}
 
-		// step: create an API request
-		request, err := r.apiRequest(method, url, bytes.NewReader(jsonBody))
+		url = joinURL(member, uri)
+
+		// step: create an API request for the member, with a fresh reader over the body and a
+		// share of the time left. The context of the attempt is cancelled as soon as it's over,
+		// along with the body of its response when there's one
+		ctx, cancel := r.attemptContext()
+		request, err := r.apiRequest(ctx, method, url, bytes.NewReader(jsonBody))
 		if err != nil {
+			cancel()
+			r.hosts.release(member)
 			return err
 		}
+		if idempotencyKey != "" {
+			request.Header.Set(r.hosts.config.idempotencyHeader, idempotencyKey)
+		}
 
-		response, err := r.httpClient.Do(request)
-		if err != nil {
+		request = r.hosts.traceConnections(member, request)
+		var reused bool
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}))
+
+		// step: let the decorator sign or trace the request, this is not a failure of the member
+		if err := r.hosts.decorate(request); err != nil {
+			cancel()
+			r.hosts.release(member)
 			return err
-			r.hosts.markDown(member)
-			// step: attempt the request on another member
+		}
+
+		started := time.Now()
+		response, err := r.doRequest(member, request)
+		if err != nil {
+			cancel()
+			// step: a pooled connection the member closed, i.e. after a ping, is not a failure. It's
+			// only sent again when that's safe, as the member may have applied a write anyway
+			resendable := isIdempotent(method) || idempotencyKey != ""
+			if reused && !staleRetried && retryable && resendable && isConnectionClosed(err) {
+				staleRetry, staleRetried = member, true
+				r.debugLog.Printf("apiCall(): pooled connection to host: %s was closed, retrying\n", member)
+				continue
+			}
+			r.hosts.release(member)
+			// step: the call was cut short by its context, which is no failure of the member
+			if r.context().Err() != nil {
+				return classifyError(err)
+			}
+			if !r.hosts.shouldMarkDown(member, err) {
+				return classifyError(err)
+			}
+			// step: a write failing on the leader only makes it unhealthy for the writes
+			if toLeader {
+				r.hosts.markLeaderFailure(member, err.Error())
+			} else {
+				r.hosts.markFailure(member, err.Error())
+			}
+			// step: attempt the request on another member, unless the deadline is too close
+			if !retryable || !r.budgetLeft() {
+				return classifyError(err)
+			}
+			failedOver(member, classifyError(err))
 			r.debugLog.Printf("apiCall(): request failed on host: %s, error: %s, trying another\n", member, err)
 			continue
 		}
-		defer response.Body.Close()
+		response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancel}
+		r.hosts.observeLatency(member, time.Since(started))
+		r.hosts.trackRedirect(member, response.Request.URL)
+
+		// step: skip the member while it is in maintenance
+		if r.hosts.inMaintenance(response) {
+			response.Body.Close()
+			r.hosts.release(member)
+			r.hosts.markDraining(member)
+			err := errors.New(fmt.Sprintf("in maintenance, status: %d", response.StatusCode))
+			if !retryable {
+				return err
+			}
+			failedOver(member, err)
+			r.debugLog.Printf("apiCall(): host: %s is in maintenance, trying another\n", member)
+			continue
+		}
 
-		respBody, err := ioutil.ReadAll(response.Body)
+		respBody, err := readBody(response)
+		response.Body.Close()
+		// step: a conflict is no failure of the member, wait for it to settle and retry there
+		if err == nil && response.StatusCode == http.StatusConflict && isWrite(method) && retryable &&
+			r.conflictRetry != nil {
+			if wait, retry := r.conflictRetry.next(conflicts, conflictWait); retry {
+				conflicts++
+				conflictWait += wait
+				r.debugLog.Printf("apiCall(): host: %s answered with a conflict, retrying in %s\n", member, wait)
+				select {
+				case <-time.After(wait):
+				case <-r.context().Done():
+					r.hosts.release(member)
+					return classifyError(r.context().Err())
+				}
+				staleRetry = member
+				continue
+			}
+		}
+		r.hosts.release(member)
 		if err != nil {
 			return err
 		}
@@ -132,6 +603,7 @@ func (r *swanClient) apiCall(method, uri string, body, result interface{}) error
 		}
 
 		if response.StatusCode >= 200 && response.StatusCode <= 299 {
+			r.hosts.markSuccess(member)
 			if result != nil {
 				if err := json.Unmarshal(respBody, result); err != nil {
 					//r.debugLog.Printf("apiCall(): failed to unmarshall the response from marathon, error: %s\n", err)
@@ -141,6 +613,25 @@ func (r *swanClient) apiCall(method, uri string, body, result interface{}) error
 			}
 			return nil
 		}
+		if response.StatusCode >= 500 {
+			err := fmt.Errorf("%w, status: %d", ErrServerError, response.StatusCode)
+			// step: the statuses telling the member is unhealthy fail it over, the others are
+			// errors of the operation which only fail the request
+			if !r.hosts.marksDown(response.StatusCode) || !r.hosts.shouldMarkDown(member, err) {
+				return err
+			}
+			if toLeader {
+				r.hosts.markLeaderFailure(member, err.Error())
+			} else {
+				r.hosts.markFailure(member, err.Error())
+			}
+			if !retryable || !r.budgetLeft() {
+				return err
+			}
+			failedOver(member, err)
+			r.debugLog.Printf("apiCall(): host: %s answered with status: %d, trying another\n", member, response.StatusCode)
+			continue
+		}
 		if response.StatusCode >= 400 {
 			return errors.New(string(response.StatusCode))
 		}
@@ -150,20 +641,110 @@ func (r *swanClient) apiCall(method, uri string, body, result interface{}) error
 	//return NewAPIError(response.StatusCode, respBody)
 }
 
+// cancelBody is the body of the response to an attempt, cancelling its context once closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the context of the attempt
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// doRequest sends the request to the member, unless the chaos rates fail it on purpose
+func (r *swanClient) doRequest(member string, request *http.Request) (*http.Response, error) {
+	if err := r.hosts.injectFailure(member); err != nil {
+		return nil, err
+	}
+
+	return r.httpClient.Do(request)
+}
+
+// isWrite checks if a request with the method changes the state of swan
+func isWrite(method string) bool {
+	return method != "GET" && method != "HEAD"
+}
+
+// isIdempotent checks if a request with the method can be sent twice with the effect of once,
+// as net/http considers it when retrying over a closed connection
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+
+	return false
+}
+
+// classifyError wraps the error of a request which got no answer with its category, errors.Is
+// matches both. A timeout of the client, the dialer or the context is ErrTimeout, anything else
+// is ErrNodeUnreachable. The other categories are returned by apiCall itself: ErrServerError for
+// a 5xx status and ErrAllNodesDown when no member is up
+func classifyError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrNodeUnreachable, err)
+}
+
+// isConnectionClosed checks if the error is the peer closing or resetting the connection
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
 // apiRequest creates a default API request
-func (r *swanClient) apiRequest(method, url string, reader io.Reader) (*http.Request, error) {
+func (r *swanClient) apiRequest(ctx context.Context, method, url string, reader io.Reader) (*http.Request, error) {
 	// Make the http request to Swan
-	request, err := http.NewRequest(method, url, reader)
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
 		return nil, err
 	}
 
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("Accept", "application/json")
+	if r.hosts.config.compressionDisabled {
+		request.Header.Set("Accept-Encoding", "identity")
+	}
 
 	return request, nil
 }
 
+// readBody reads the body of the response, decompressing it when the transport left it encoded
+// since the request set Accept-Encoding itself
+func readBody(response *http.Response) ([]byte, error) {
+	var reader io.Reader = response.Body
+	switch strings.ToLower(response.Header.Get("Content-Encoding")) {
+	case "gzip":
+		decoder, err := gzip.NewReader(response.Body)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	case "deflate":
+		decoder, err := zlib.NewReader(response.Body)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
 var oneLogLineRegex = regexp.MustCompile(`(?m)^\s*`)
 
 // oneLogLine removes indentation at the beginning of each line and
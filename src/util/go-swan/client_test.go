@@ -0,0 +1,961 @@
+package swan
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiCallMaintenance(t *testing.T) {
+	var maintenance int32 = 1
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&maintenance) == 1 {
+			w.Header().Set("X-Swan-Maintenance", "draining")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer draining.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+
+	client, err := NewClient(draining.URL+","+healthy.URL,
+		WithMaintenanceHeader("X-Swan-Maintenance"), WithHealthCheckInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{healthy.URL}, swan.hosts.activeMembers(), "should be equal")
+	assert.Equal(t, memberStatus(memberStatusDraining), swan.hosts.members[0].status, "should be draining")
+
+	// step: the draining member comes back once it is ready
+	atomic.StoreInt32(&maintenance, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(swan.hosts.activeMembers()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, sortedEndpoints(draining.URL, healthy.URL), swan.hosts.activeMembers(), "should be equal")
+}
+
+func TestApiCallFailoverTrail(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	draining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Swan-Maintenance", "draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer draining.Close()
+
+	client, err := NewClient(down.URL+","+draining.URL,
+		WithMaintenanceHeader("X-Swan-Maintenance"), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	_, err = client.Applications(nil)
+	var failover *FailoverError
+	assert.True(t, errors.As(err, &failover), "should carry the members tried")
+	assert.Len(t, failover.Attempts, 2)
+	assert.Equal(t, down.URL, failover.Attempts[0].Endpoint, "should be in order")
+	assert.Equal(t, draining.URL, failover.Attempts[1].Endpoint, "should be in order")
+	assert.ErrorIs(t, err, ErrNodeUnreachable)
+	assert.True(t, strings.HasPrefix(err.Error(), "tried "+down.URL+" ("), "should tell the story: "+err.Error())
+	assert.Contains(t, err.Error(), draining.URL+" (in maintenance, status: 503) -> gave up: ")
+
+	// step: a call failing without failing over carries no trail
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	client, err = NewClient(broken.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	_, err = client.Applications(nil)
+	assert.ErrorIs(t, err, ErrServerError)
+	assert.False(t, errors.As(err, &failover), "should not carry a trail")
+}
+
+func TestApiCallRequestDecorator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "signed" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	signErr := errors.New("no signing key")
+	var fail int32
+	client, err := NewClient(server.URL, WithRequestDecorator(func(request *http.Request) error {
+		if atomic.LoadInt32(&fail) == 1 {
+			return signErr
+		}
+		request.Header.Set("X-Signature", "signed")
+		return nil
+	}))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, swan.hosts.probeNode(swan.hosts.members[0]), "the health check should be decorated")
+
+	// step: a failing decorator aborts the request without failing over
+	atomic.StoreInt32(&fail, 1)
+	_, err = client.Applications(nil)
+	assert.Equal(t, signErr, err, "should be equal")
+	assert.Equal(t, []string{server.URL}, swan.hosts.activeMembers(), "should still be up")
+}
+
+func TestNewClientHTTP2(t *testing.T) {
+	var proto int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		w.Write([]byte(`[]`))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for enabled, expected := range map[bool]int32{true: 2, false: 1} {
+		client, err := NewClient(server.URL, WithHTTP2(enabled))
+		assert.NoError(t, err)
+		transport := client.(*swanClient).httpClient.Transport.(*http.Transport)
+		transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+		_, err = client.Applications(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, atomic.LoadInt32(&proto), "should be equal")
+	}
+}
+
+func TestNewClientTLSServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	// the certificate of the test server is issued for example.com, not for localhost
+	endpoint := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	roots := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for name, opts := range map[string][]ClusterOption{
+		"none":   {WithHealthCheckInterval(time.Hour)},
+		"all":    {WithHealthCheckInterval(time.Hour), WithTLSServerName("example.com", nil)},
+		"member": {WithHealthCheckInterval(time.Hour), WithTLSServerName("", map[string]string{endpoint + "/": "example.com"})},
+	} {
+		client, err := NewClient(endpoint, opts...)
+		assert.NoError(t, err)
+		transport := client.(*swanClient).httpClient.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = roots
+
+		_, err = client.Applications(nil)
+		if name == "none" {
+			assert.Error(t, err, "should fail to verify the certificate against localhost")
+		} else {
+			assert.NoError(t, err, name)
+		}
+	}
+}
+
+func TestRetryConflicts(t *testing.T) {
+	var requests, others int32
+	conflicting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer conflicting.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&others, 1)
+	}))
+	defer other.Close()
+
+	client, err := NewClient(conflicting.URL+","+other.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	_, err = client.CreateApplication(&Version{})
+	assert.Error(t, err, "should fail without the retries")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "should be equal")
+
+	policy := ConflictRetry{Attempts: 3, Backoff: time.Millisecond}
+	_, err = RetryConflicts(client, policy).CreateApplication(&Version{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "should retry on the same member")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&others), "should not fail over")
+	assert.Equal(t, 2, len(client.(*swanClient).hosts.activeMembers()), "should not be marked down")
+}
+
+func TestConflictRetryNext(t *testing.T) {
+	policy := &ConflictRetry{Attempts: 5, Backoff: 10 * time.Millisecond, MaxWait: 50 * time.Millisecond}
+	var waits []time.Duration
+	var waited time.Duration
+	for retries := 0; ; retries++ {
+		wait, retry := policy.next(retries, waited)
+		if !retry {
+			break
+		}
+		waits = append(waits, wait)
+		waited += wait
+	}
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond}, waits, "should be capped by the max wait")
+
+	policy.MaxWait = 0
+	_, retry := policy.next(5, time.Hour)
+	assert.False(t, retry, "should be capped by the attempts")
+}
+
+func TestNewClientTLSHandshakeTimeout(t *testing.T) {
+	// step: a master accepting the connections but never completing the handshake
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer stalled.Close()
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+
+	client, err := NewClient("https://"+stalled.Addr().String()+","+healthy.URL,
+		WithHealthCheckInterval(time.Hour), WithTLSHandshakeTimeout(100*time.Millisecond))
+	assert.NoError(t, err)
+	client.(*swanClient).httpClient.Timeout = 10 * time.Second
+
+	started := time.Now()
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(started) < 2*time.Second, "should fail over within the handshake timeout")
+	assert.Equal(t, []string{"https://" + stalled.Addr().String()}, client.(*swanClient).hosts.nonActiveMembers(), "should be marked down")
+}
+
+func TestForContext(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer slow.Close()
+
+	client, err := NewClient(slow.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	client.(*swanClient).httpClient.Timeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = ForContext(client, ctx).Applications(nil)
+	assert.NoError(t, err, "should be given longer than the client timeout")
+
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err = ForContext(client, short).Applications(nil)
+	assert.True(t, errors.Is(err, ErrTimeout), "should time out with the context")
+	assert.True(t, time.Since(started) < 250*time.Millisecond, "should cancel the request in flight")
+	assert.Empty(t, client.(*swanClient).hosts.nonActiveMembers(), "should not mark the member down")
+}
+
+func TestForContextFailover(t *testing.T) {
+	hang := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		<-r.Context().Done()
+	})
+	hanging := httptest.NewServer(hang)
+	defer hanging.Close()
+	other := httptest.NewServer(hang)
+	defer other.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+
+	// step: the hanging member leaves time to fail over within the deadline
+	client, err := NewClient(hanging.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err = ForContext(client, ctx).Applications(nil)
+	assert.NoError(t, err, "should fail over to the healthy member")
+	assert.True(t, time.Since(started) < 400*time.Millisecond, "should respect the deadline")
+	assert.Equal(t, []string{hanging.URL}, client.(*swanClient).hosts.nonActiveMembers(), "should be marked down")
+
+	// step: with every member hanging the call fails by the deadline with the last error
+	client, err = NewClient(hanging.URL+","+other.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started = time.Now()
+	_, err = ForContext(client, ctx).Applications(nil)
+	assert.True(t, errors.Is(err, ErrTimeout), "should time out")
+	assert.True(t, time.Since(started) < 300*time.Millisecond, "should respect the deadline")
+}
+
+func TestForContextAttemptsCancelled(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+	other := httptest.NewServer(healthy.Config.Handler)
+	defer other.Close()
+
+	// step: the context of an attempt is cancelled once it failed over, not at the end of the call
+	var attempts []context.Context
+	var cancelledBefore bool
+	var mu sync.Mutex
+	client, err := NewClient(unavailable.URL+","+healthy.URL+","+other.URL, WithHealthCheckInterval(time.Hour),
+		WithRequestDecorator(func(request *http.Request) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if request.URL.Path == "/ping" {
+				return nil
+			}
+			if len(attempts) > 0 {
+				cancelledBefore = attempts[len(attempts)-1].Err() != nil
+			}
+			attempts = append(attempts, request.Context())
+			return nil
+		}))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = ForContext(client, ctx).Applications(nil)
+	assert.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, attempts, 2)
+	assert.True(t, cancelledBefore, "should cancel the failed attempt before the next one")
+	assert.Error(t, attempts[1].Err(), "should cancel the attempt once its response was read")
+}
+
+func TestWaitForMember(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithHealthCheckInterval(10*time.Millisecond), WithWaitForMember(true))
+	assert.NoError(t, err)
+	client.(*swanClient).hosts.markDown(server.URL)
+
+	// step: the call overrides the default of the client
+	_, err = ForContext(client, WaitForMember(context.Background(), false)).Applications(nil)
+	assert.Equal(t, ErrSwanDown, err, "should fail fast")
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := ForContext(client, ctx).Applications(nil)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("should wait for a member")
+	case <-time.After(30 * time.Millisecond):
+	}
+	atomic.StoreInt32(&healthy, 1)
+	assert.NoError(t, <-done)
+
+	// step: the wait is bounded by the context of the call
+	atomic.StoreInt32(&healthy, 0)
+	client, err = NewClient(server.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	client.(*swanClient).hosts.markDown(server.URL)
+	_, err = client.Applications(nil)
+	assert.Equal(t, ErrSwanDown, err, "should fail fast by default")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = ForContext(client, WaitForMember(ctx, true)).Applications(nil)
+	assert.Equal(t, context.DeadlineExceeded, err, "should be equal")
+}
+
+// newTLSClient returns a client trusting the test server, with a transport of its own
+func newTLSClient(server *httptest.Server) *http.Client {
+	return &http.Client{Transport: server.Client().Transport.(*http.Transport).Clone()}
+}
+
+func TestWarmUp(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithHTTPClient(newTLSClient(server)))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	assert.NoError(t, client.(*swanClient).hosts.WarmUp(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "should open a connection")
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns), "should reuse the warm connection")
+}
+
+func benchmarkFirstRequest(b *testing.B, warmup bool) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		httpClient := newTLSClient(server)
+		client, err := NewClient(server.URL, WithHTTPClient(httpClient))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if warmup {
+			client.(*swanClient).hosts.WarmUp(context.Background())
+		}
+		b.StartTimer()
+		client.Applications(nil)
+		b.StopTimer()
+		client.(*swanClient).hosts.Close()
+		httpClient.CloseIdleConnections()
+	}
+}
+
+func BenchmarkFirstRequest(b *testing.B) {
+	benchmarkFirstRequest(b, false)
+}
+
+func BenchmarkFirstRequestWarmUp(b *testing.B) {
+	benchmarkFirstRequest(b, true)
+}
+
+func TestNewClientWithHTTPClient(t *testing.T) {
+	httpClient := &http.Client{}
+	client, err := NewClient("http://127.0.0.1:9999", WithHTTPClient(httpClient))
+	assert.NoError(t, err)
+	assert.True(t, client.(*swanClient).httpClient == httpClient, "should use the supplied client")
+	assert.True(t, client.(*swanClient).hosts.client == httpClient, "should use the supplied client")
+}
+
+func TestNewClientFromReader(t *testing.T) {
+	list := "# the masters\n\nhttp://swan-1:9999  \n\t# the standby\n  swan-2:9999?weight=2\t\n\n"
+	client, err := NewClientFromReader(strings.NewReader(list))
+	assert.NoError(t, err)
+	hosts := client.(*swanClient).hosts
+	defer hosts.Close()
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999"}, hosts.activeMembers(), "should be equal")
+	assert.Equal(t, 2, hosts.HealthReport()[1].Weight, "should keep the annotations")
+
+	// step: the endpoints are validated as the comma separated ones
+	_, err = NewClientFromReader(strings.NewReader("# none\n\n"))
+	assert.Error(t, err)
+	_, err = NewClientFromReader(strings.NewReader("http://swan-1:9999\nhttp://swan 2:9999\n"))
+	assert.Error(t, err)
+}
+
+func TestApiCallFailureFilter(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+
+	// step: by default the failed member is marked down and we fail over
+	client, err := NewClient(down.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{down.URL}, client.(*swanClient).hosts.nonActiveMembers(), "should be marked down")
+
+	// step: the filter can veto the markDown
+	var vetoed string
+	client, err = NewClient(down.URL+","+healthy.URL, WithFailureFilter(func(endpoint string, err error) bool {
+		vetoed = endpoint
+		return false
+	}))
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.Error(t, err)
+	assert.Equal(t, down.URL, vetoed, "should be equal")
+	assert.Empty(t, client.(*swanClient).hosts.nonActiveMembers(), "should still be up")
+}
+
+func TestApiCallMarkDownStatuses(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+
+	// step: a 500 fails the request and leaves the member up
+	client, err := NewClient(failing.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	hosts := client.(*swanClient).hosts
+	defer hosts.Close()
+	_, err = client.Applications(nil)
+	assert.ErrorIs(t, err, ErrServerError)
+	assert.Empty(t, hosts.nonActiveMembers(), "should leave the member up")
+
+	// step: a 503 marks the member down and fails over
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err, "should fail over")
+	assert.Equal(t, []string{failing.URL}, hosts.nonActiveMembers(), "should be marked down")
+
+	// step: the statuses are configurable
+	client, err = NewClient(failing.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour),
+		WithMarkDownStatuses(http.StatusInternalServerError))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	_, err = client.Applications(nil)
+	assert.ErrorIs(t, err, ErrServerError, "should only fail the request")
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err, "should fail over")
+}
+
+func TestApiCallCompression(t *testing.T) {
+	var encodings atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings.Store(r.Header.Get("Accept-Encoding"))
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(`["plain"]`))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		writer.Write([]byte(`["gzipped"]`))
+		writer.Close()
+	}))
+	defer server.Close()
+	get := func(opts ...ClusterOption) []string {
+		client, err := NewClient(server.URL, opts...)
+		assert.NoError(t, err)
+		defer client.(*swanClient).hosts.Close()
+		var result []string
+		assert.NoError(t, client.(*swanClient).apiGet("v_beta/apps", nil, &result))
+		return result
+	}
+
+	// step: the transport negotiates gzip by default
+	assert.Equal(t, []string{"gzipped"}, get(), "should decompress the response")
+	assert.Equal(t, "gzip", encodings.Load(), "should ask for gzip")
+
+	// step: a request setting Accept-Encoding itself is decompressed by the helper
+	assert.Equal(t, []string{"gzipped"}, get(WithRequestDecorator(func(request *http.Request) error {
+		request.Header.Set("Accept-Encoding", "gzip")
+		return nil
+	})), "should decompress the response")
+
+	// step: disabled the responses are asked for uncompressed
+	assert.Equal(t, []string{"plain"}, get(WithCompression(false)), "should not be compressed")
+	assert.Equal(t, "identity", encodings.Load(), "should ask for no compression")
+}
+
+func TestApiCallRetryBodyLimit(t *testing.T) {
+	var failingWrites, healthyWrites int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&failingWrites, 1)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&healthyWrites, 1)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer healthy.Close()
+
+	_, err := newCluster(http.DefaultClient, healthy.URL, WithRetryBodyLimit(0, SendOversizedOnce))
+	assert.Error(t, err)
+
+	// step: a body of the limit, 64 bytes once encoded, is retried on another member
+	client, err := NewClient(failing.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour),
+		WithRetryBodyLimit(64, SendOversizedOnce))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	assert.NoError(t, swan.apiPost("v_beta/apps", strings.Repeat("a", 62), nil), "should fail over")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&healthyWrites), "should retry the write")
+
+	// step: a byte over the limit is sent once
+	assert.NoError(t, swan.hosts.MarkUp(failing.URL))
+	err = swan.apiPost("v_beta/apps", strings.Repeat("a", 63), nil)
+	assert.ErrorIs(t, err, ErrServerError)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&failingWrites), "should send the write")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&healthyWrites), "should not retry the write")
+
+	// step: or rejected without being sent
+	client, err = NewClient(healthy.URL, WithRetryBodyLimit(64, RejectOversized))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	err = client.(*swanClient).apiPost("v_beta/apps", strings.Repeat("a", 63), nil)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&healthyWrites), "should not send the write")
+}
+
+func TestApiCallRetryBody(t *testing.T) {
+	// step: the first member reads the request then drops the connection
+	firstBodies := make(chan string, 1)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		firstBodies <- string(body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer broken.Close()
+	var method, path, contentType, secondBody string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		method, path, contentType, secondBody = r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer healthy.Close()
+
+	client, err := NewClient(broken.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer client.(*swanClient).hosts.Close()
+	err = client.(*swanClient).apiPost("v_beta/apps", map[string]string{"appName": "nginx"}, nil)
+	assert.NoError(t, err, "should fail over")
+	firstBody := <-firstBodies
+	assert.Equal(t, `{"appName":"nginx"}`, firstBody, "should be equal")
+	assert.Equal(t, firstBody, secondBody, "should resend the body")
+	assert.Equal(t, "POST", method, "should be equal")
+	assert.Equal(t, "/v_beta/apps", path, "should be rebuilt for the member")
+	assert.Equal(t, "application/json", contentType, "should keep the headers")
+}
+
+func TestApiCallIdempotencyKey(t *testing.T) {
+	firstKeys := make(chan string, 1)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		firstKeys <- r.Header.Get("Idempotency-Key")
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer broken.Close()
+	var keys []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		w.Write([]byte(`{}`))
+	}))
+	defer healthy.Close()
+
+	client, err := NewClient(broken.URL+","+healthy.URL, WithHealthCheckInterval(time.Hour),
+		WithIdempotencyKey("Idempotency-Key", nil))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	assert.NoError(t, swan.apiPost("v_beta/apps", map[string]string{"appName": "nginx"}, nil))
+	firstKey := <-firstKeys
+	assert.Equal(t, 32, len(firstKey), "should be random")
+	assert.Equal(t, []string{firstKey}, keys, "should be the same on the retry")
+
+	// step: every logical request has its own key and the reads have none
+	assert.NoError(t, swan.apiPut("v_beta/apps/nginx", nil, nil))
+	assert.NoError(t, swan.apiGet("v_beta/apps", nil, nil))
+	assert.Equal(t, 3, len(keys), "should be equal")
+	assert.NotEqual(t, firstKey, keys[1], "should be a new key")
+	assert.Equal(t, "", keys[2], "should not be sent on reads")
+}
+
+func TestApiCallClosedConnection(t *testing.T) {
+	var requests, drop, closedProbes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			if r.Close {
+				atomic.AddInt32(&closedProbes, 1)
+			}
+			return
+		}
+		// step: drop the pooled connection of the request when asked to
+		atomic.AddInt32(&requests, 1)
+		if atomic.CompareAndSwapInt32(&drop, 1, 0) {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithHealthCheckInterval(time.Hour), WithProbeConnectionClose(true))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	assert.NoError(t, swan.apiPut("v_beta/apps/nginx", nil, nil))
+	atomic.StoreInt32(&drop, 1)
+	assert.NoError(t, swan.apiPut("v_beta/apps/nginx", nil, nil), "should retry on a fresh connection")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "should be equal")
+	assert.Equal(t, 1, len(swan.hosts.activeMembers()), "should not be marked down")
+
+	// step: a write which isn't idempotent is not sent again unless it carries a key
+	atomic.StoreInt32(&drop, 1)
+	assert.Error(t, swan.apiPost("v_beta/apps", nil, nil), "should not retry the post")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests), "should be sent once")
+	assert.NoError(t, swan.hosts.MarkUp(server.URL))
+	keyed, err := NewClient(server.URL, WithHealthCheckInterval(time.Hour), WithIdempotencyKey("Idempotency-Key", nil))
+	assert.NoError(t, err)
+	defer keyed.(*swanClient).hosts.Close()
+	assert.NoError(t, keyed.(*swanClient).apiPost("v_beta/apps", nil, nil))
+	atomic.StoreInt32(&drop, 1)
+	assert.NoError(t, keyed.(*swanClient).apiPost("v_beta/apps", nil, nil), "should retry the post with a key")
+	assert.Equal(t, int32(7), atomic.LoadInt32(&requests), "should be equal")
+
+	assert.NoError(t, swan.hosts.probeNode(swan.hosts.members[0]))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&closedProbes), "should close the probe connection")
+}
+
+func TestApiCallRedirectMembers(t *testing.T) {
+	leaders := make([]*httptest.Server, 3)
+	for i := range leaders {
+		leaders[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[]`))
+		}))
+		defer leaders[i].Close()
+	}
+	var leader int32
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, leaders[atomic.LoadInt32(&leader)].URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer follower.Close()
+
+	client, err := NewClient(follower.URL, WithRedirectMembers(time.Hour, 2))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, sortedEndpoints(follower.URL, leaders[0].URL), swan.hosts.activeMembers(), "should add the leader once")
+
+	// step: the redirect members are capped, the one expiring first gives way
+	for i := int32(1); i < 3; i++ {
+		atomic.StoreInt32(&leader, i)
+		_, err = client.Applications(nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, sortedEndpoints(follower.URL, leaders[1].URL, leaders[2].URL), swan.hosts.activeMembers(), "should be capped")
+
+	// step: an expired member is no longer selected
+	swan.hosts.Lock()
+	swan.hosts.members[0].status = memberStatusDown
+	swan.hosts.members[1].expires = time.Now().Add(-time.Second)
+	swan.hosts.Unlock()
+	endpoint, _ := swan.hosts.getMember()
+	assert.Equal(t, leaders[2].URL, endpoint, "should skip the expired member")
+}
+
+func TestClientDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	var dials int32
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	client, err := NewClient(server.URL, WithDialer(dialer), WithProbeKeepAlivesDisabled(true))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, swan.hosts.probeNode(swan.hosts.members[0]))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials), "should dial the request and the probe")
+
+	// step: a given client keeps its own transport
+	client, err = NewClient(server.URL, WithDialer(dialer), WithHTTPClient(&http.Client{}))
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials), "should ignore the dialer")
+}
+
+func TestApiCallErrorCategories(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	keepUp := WithFailureFilter(func(endpoint string, err error) bool { return false })
+	client, err := NewClient(server.URL, keepUp, WithHTTPClient(&http.Client{Timeout: 10 * time.Millisecond}))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	err = swan.apiGet("apps", nil, nil)
+	assert.True(t, errors.Is(err, ErrServerError), "should be a server error")
+	assert.Equal(t, "the Swan host answered with a server error, status: 502", err.Error(), "should be equal")
+	err = swan.apiGet("slow", nil, nil)
+	assert.True(t, errors.Is(err, ErrTimeout), "should be a timeout")
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr), "should wrap the cause")
+
+	server.Close()
+	err = swan.apiGet("apps", nil, nil)
+	assert.True(t, errors.Is(err, ErrNodeUnreachable), "should be unreachable")
+
+	client, err = NewClient(server.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.True(t, errors.Is(err, ErrAllNodesDown), "should be all down")
+}
+
+func TestApiCallStickyHeader(t *testing.T) {
+	servers := make([]*httptest.Server, 3)
+	hits := make([]int32, 3)
+	var endpoints []string
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// step: a member marked down stays down
+			if r.URL.Path == "/ping" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			atomic.AddInt32(&hits[i], 1)
+			w.Write([]byte(`[]`))
+		}))
+		defer servers[i].Close()
+		endpoints = append(endpoints, servers[i].URL)
+	}
+
+	var user atomic.Value
+	user.Store("alice")
+	client, err := NewClient(strings.Join(endpoints, ","), WithStickyHeader("X-User"), WithHealthCheckInterval(time.Hour),
+		WithRequestDecorator(func(r *http.Request) error {
+			r.Header.Set("X-User", user.Load().(string))
+			return nil
+		}))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	sticky := func() int {
+		for i := range hits {
+			atomic.StoreInt32(&hits[i], 0)
+		}
+		for i := 0; i < 5; i++ {
+			_, err := client.Applications(nil)
+			assert.NoError(t, err)
+		}
+		for i := range hits {
+			if atomic.LoadInt32(&hits[i]) == 5 {
+				return i
+			}
+		}
+		return -1
+	}
+	chosen := sticky()
+	assert.NotEqual(t, -1, chosen, "should stick to a member")
+	assert.Equal(t, chosen, sticky(), "should be stable")
+
+	// step: the key moves to another member while its own is down
+	swan.hosts.markDown(endpoints[chosen])
+	moved := sticky()
+	assert.NotEqual(t, -1, moved, "should stick to another member")
+	assert.NotEqual(t, chosen, moved, "should be rehashed")
+
+	// step: no header falls back to the selector
+	user.Store("")
+	swan.hosts.Lock()
+	swan.hosts.setStatus(swan.hosts.members[chosen], memberStatusUp, "")
+	swan.hosts.Unlock()
+	assert.Equal(t, 0, sticky(), "should use the first available")
+}
+
+func TestApiCallChaos(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// step: keep the member down once marked, the health check starts straight away
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer healthy.Close()
+
+	var vetoed error
+	client, err := NewClient(server.URL+","+healthy.URL, WithChaos(server.URL+"/", 1),
+		WithHealthCheckInterval(time.Hour), WithFailureFilter(func(endpoint string, err error) bool {
+			vetoed = err
+			return true
+		}))
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err, "should fail over")
+	assert.Equal(t, ErrInjectedFailure, vetoed, "should be handled like a real failure")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests), "should not reach the member")
+	assert.Equal(t, []string{server.URL}, client.(*swanClient).hosts.nonActiveMembers(), "should be marked down")
+}
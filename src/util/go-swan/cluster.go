@@ -1,165 +1,3565 @@
 package swan
 
 import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	memberStatusUp   = 0
-	memberStatusDown = 1
+	memberStatusUp           = 0
+	memberStatusDown         = 1
+	memberStatusDraining     = 2
+	memberStatusNotReady     = 3
+	memberStatusIncompatible = 4
+)
+
+// the default interval between health checks of a down member
+const defaultHealthCheckInterval = time.Duration(5 * time.Second)
+
+// the default selection weight of a member
+const defaultMemberWeight = 1
+
+// the timeout of the http client given to newCluster when it's nil, NewClient sets none
+const defaultClientTimeout = 30 * time.Second
+
+// the default size of the largest request body retried on another member, 1 MiB
+const defaultRetryBodyLimit = 1 << 20
+
+// OversizedBodyPolicy decides what happens to a request whose body is over the retry body limit
+type OversizedBodyPolicy int
+
+const (
+	// SendOversizedOnce sends the request to a single member, a failure isn't retried
+	SendOversizedOnce OversizedBodyPolicy = iota
+	// RejectOversized fails the request with ErrBodyTooLarge without sending it
+	RejectOversized
 )
 
 // the status of a member node
 type memberStatus int
 
-// cluster is a collection of swan nodes
-type cluster struct {
-	sync.RWMutex
-	// a collection of nodes
-	members []*member
-	// the http client
-	client *http.Client
+// ClusterOption configures an optional behaviour of the cluster
+type ClusterOption func(*clusterConfig)
+
+// clusterConfig holds the optional settings of a cluster
+type clusterConfig struct {
+	// the region of this client, empty disables region affinity
+	region string
+	// the region of each member keyed by endpoint, members not listed are in the local region
+	memberRegions map[string]string
+	// the selection weight of each member keyed by endpoint, members not listed have the default
+	memberWeights map[string]int
+	// the penalty applied to members outside the local region, between 0 (none)
+	// and 1 (only used when no member in the local region is up)
+	regionPenalty float64
+	// how long a member which failed a request but is still up is avoided in the selection, zero
+	// disables the penalty
+	failurePenaltyWindow time.Duration
+	// the status code swan answers with while a master is in maintenance, zero disables it
+	maintenanceStatusCode int
+	// the header swan sets while a master is in maintenance, empty disables it
+	maintenanceHeader string
+	// invoked on every request and health check right before it is sent
+	requestDecorator func(*http.Request) error
+	// obtains the auth token sent with every request and health check, nil sends none
+	tokenSource TokenSource
+	// how long the auth token is cached before it's refreshed
+	tokenTTL time.Duration
+	// the http client supplied by the user, nil when the client builds its own
+	httpClient *http.Client
+	// negotiate HTTP/2 on the transport built by the client
+	enableHTTP2 bool
+	// ask for the responses uncompressed rather than let the transport negotiate gzip
+	compressionDisabled bool
+	// dials the connections of the transport built by the client, nil uses the default dialer
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// the time allowed for the tls handshakes of the transport built by the client, zero keeps
+	// the default of the transport
+	tlsHandshakeTimeout time.Duration
+	// the name the certificates of the masters are verified against, empty uses the host
+	tlsServerName string
+	// the name the certificate of each member is verified against keyed by endpoint
+	memberServerNames map[string]string
+	// the port keyed by protocol schema added to the endpoints without one
+	defaultPorts map[string]int
+	// consulted before a failed member is marked down, returning false keeps it up
+	failureFilter func(endpoint string, err error) bool
+	// record the time spent waiting for the cluster lock
+	sampleLockWaits bool
+	// the interval between health checks of a down member
+	healthCheckInterval time.Duration
+	// how long a member stays down before it's re-admitted despite failing the health checks,
+	// zero keeps it down until it passes them
+	maxDownDuration time.Duration
+	// the http method of the health checks
+	probeMethod string
+	// the liveness check settings of the members keyed by endpoint, overriding the ones above
+	memberProbes map[string]ProbeSettings
+	// the json body of the health checks, nil sends none
+	probeBody []byte
+	// the 5xx statuses marking the member down and failing the request over
+	markDownStatuses []int
+	// the size of the largest request body retried, see WithRetryBodyLimit
+	retryBodyLimit int
+	// what happens to the requests whose body is over the retry limit
+	oversizedBodyPolicy OversizedBodyPolicy
+	// whether RefreshMembers fails on the endpoints not matching a member
+	strictRefresh bool
+	// whether the members drained by DrainAndWait are probed like the down ones
+	probeDrained bool
+	// builds the health check requests, nil builds them from the settings above
+	probeRequestBuilder ProbeRequestBuilder
+	// the path of the liveness check used to recover the down members
+	livenessPath string
+	// the path of the secondary check a member passing the liveness check must pass as well to
+	// recover, empty relies on the liveness check alone
+	recoveryPath string
+	// invoked when a health check is refused with a 401 or 403
+	probeAuthFailure func(endpoint string, statusCode int)
+	// invoked when the cluster goes fully down or recovers
+	availability func(available bool)
+	// how long the availability must hold before the callback is invoked
+	availabilityDebounce time.Duration
+	// the path the members are asked for their version on, empty disables the version check
+	versionPath string
+	// the constraint the versions of the members must satisfy
+	versionConstraint string
+	// the path of the readiness check of the up members, empty disables it
+	readinessPath string
+	// the interval between the readiness checks
+	readinessInterval time.Duration
+	// the consecutive readiness failures before a member is considered not ready
+	readinessThreshold int
+	// the liveness checks in a row a down member must pass to recover
+	recoveryThreshold int
+	// the liveness checks in a row a member which is up must fail to be marked down
+	failureThreshold int
+	// the strategy choosing among the members which are up
+	selector Selector
+	// skip the blank or invalid endpoints rather than failing
+	skipInvalidEndpoints bool
+	// shuffle the configured order of the members
+	shuffleMembers bool
+	// how long the members are probed for at startup when one must be up, zero skips it
+	requireHealthyTimeout time.Duration
+	// the maximum number of members, zero is unlimited
+	maxMembers int
+	// the members which are up a failed request never marks down, zero has no floor
+	minUpMembers int
+	// the members which must pass the liveness checks of Ping, zero requires all of them
+	pingQuorum int
+	// expand the environment variables in the endpoints
+	expandEnv bool
+	// whether several endpoints on a single host fail rather than warn
+	requireDistinctHosts bool
+	// count the new and reused connections of the requests per member
+	traceConnections bool
+	// log every selected member
+	traceSelections bool
+	// the header carrying the idempotency key of the write requests, empty disables it
+	idempotencyHeader string
+	// generates the idempotency key of a write request
+	newIdempotencyKey func() string
+	// how long a leader found by following a redirect stays a member, zero ignores redirects
+	redirectTTL time.Duration
+	// the maximum members found by following redirects
+	maxRedirectMembers int
+	// the path the members are polled on for the leader, empty disables it
+	leaderPath string
+	// the interval between the leader polls
+	leaderInterval time.Duration
+	// whether the writes are routed to the leader agreed on by the leader poll
+	leaderWrites bool
+	// the path the members are polled on for their load, empty disables it
+	capacityPath string
+	// the interval between the capacity polls
+	capacityInterval time.Duration
+	// the request header keying the sticky selection, empty disables it
+	stickyHeader string
+	// the maximum in-flight requests per member, zero is unlimited
+	maxInFlight int
+	// whether a request waits for a member with room rather than fail with ErrSaturated
+	waitWhenSaturated bool
+	// whether a request waits for a member to be up rather than fail with ErrSwanDown
+	waitForMember bool
+	// send the health checks over a transport of their own without keep-alives
+	probeKeepAlivesDisabled bool
+	// close the connection of every health check rather than pool it
+	probeConnectionClose bool
+	// open a pooled connection to every member up once the cluster is created
+	warmup bool
+	// the interval between the probes of an observing cluster, zero routes requests as usual
+	observeInterval time.Duration
+	// the share of failed requests marking a member down, used when the window is set
+	errorRate float64
+	// the number of recent requests the error rate is computed over, zero disables it
+	errorRateWindow int
+	// the status changes within the flap window quarantining a member, zero disables it
+	flapTransitions int
+	// the window the status changes of a member are counted over
+	flapWindow time.Duration
+	// how long a flapping member is kept down
+	flapCooldown time.Duration
+	// the failovers of the cluster within the failover window warning, zero disables it
+	failoverThreshold int
+	// the window the failovers of the cluster are counted over
+	failoverWindow time.Duration
+	// the callback warning about the failovers, nil logs the warning
+	failoverWarning func(failovers int, window time.Duration)
+	// the source of the chaos rates, nil uses one seeded with the time
+	random *rand.Rand
+	// the share of the requests failed on purpose keyed by endpoint
+	chaosRates map[string]float64
+	// the prefix of the names of the metrics
+	metricsPrefix string
+	// the name of the label carrying the endpoint of the member metrics
+	metricsEndpointLabel string
+	// the logger for the debug messages and warnings
+	logger *log.Logger
+}
+
+// defaultClusterConfig returns the default settings of a cluster
+func defaultClusterConfig() clusterConfig {
+	return clusterConfig{
+		regionPenalty:        1,
+		healthCheckInterval:  defaultHealthCheckInterval,
+		probeMethod:          "GET",
+		markDownStatuses:     []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		retryBodyLimit:       defaultRetryBodyLimit,
+		defaultPorts:         map[string]int{"http": 80, "https": 443},
+		recoveryThreshold:    1,
+		failureThreshold:     1,
+		livenessPath:         swanAPIPing,
+		selector:             SelectFirstAvailable(),
+		metricsPrefix:        "swan",
+		metricsEndpointLabel: "endpoint",
+		logger:               log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// newClusterConfig returns the default settings with the options applied
+func newClusterConfig(opts ...ClusterOption) clusterConfig {
+	config := defaultClusterConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return config
+}
+
+// newHTTPClient builds the http client used when the user didn't supply one
+func newHTTPClient(config clusterConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = config.enableHTTP2
+	if config.dialer != nil {
+		transport.DialContext = config.dialer
+	}
+	if config.tlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.tlsHandshakeTimeout
+	}
+	if config.tlsServerName != "" || len(config.memberServerNames) > 0 {
+		transport.TLSClientConfig = &tls.Config{ServerName: config.tlsServerName}
+	}
+	if len(config.memberServerNames) > 0 {
+		transport.DialTLSContext = newTLSDialer(transport, config.memberServerNames, config.defaultPorts)
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// newTLSDialer returns a function dialing the tls connections of the transport, verifying the
+// certificate of each member against its server name, keyed by the address of the endpoint
+func newTLSDialer(transport *http.Transport, memberServerNames map[string]string, ports map[string]int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	names := make(map[string]string)
+	for endpoint, name := range memberServerNames {
+		u, err := normalizeEndpoint(strings.TrimSpace(endpoint), "https", ports)
+		if err != nil {
+			continue
+		}
+		if u.Port() == "" {
+			names[net.JoinHostPort(u.Hostname(), "443")] = name
+		} else {
+			names[u.Host] = name
+		}
+	}
+	dial := transport.DialContext
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// step: the settings of the transport are read on every dial, i.e. the protocols
+		// added when negotiating HTTP/2
+		tlsConfig := transport.TLSClientConfig.Clone()
+		if name, found := names[strings.ToLower(addr)]; found {
+			tlsConfig.ServerName = name
+		} else if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ServerName = host
+		}
+		raw, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(raw, tlsConfig)
+		handshakeCtx := ctx
+		if transport.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			handshakeCtx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		if err := conn.HandshakeContext(handshakeCtx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+// newProbeClient returns a client for the health checks using a transport of its own with the
+// keep-alives disabled, based on the transport of the client when it's a *http.Transport
+func newProbeClient(client *http.Client) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.DisableKeepAlives = true
+
+	return &http.Client{Transport: transport, Timeout: client.Timeout}
+}
+
+// WithHTTPClient uses the given http client rather than building one. The client controls its
+// own transport, so the transport options such as WithHTTP2 don't apply to it
+func WithHTTPClient(client *http.Client) ClusterOption {
+	return func(config *clusterConfig) {
+		config.httpClient = client
+	}
+}
+
+// WithCompression controls the compression of the responses, by default the transport asks for
+// gzip and decompresses them transparently. Disabled the requests ask for the responses as they
+// are, i.e. to save the cpu on a local network. Note the transport leaves the responses alone once
+// a request sets Accept-Encoding itself, i.e. from WithRequestDecorator, the request helper then
+// decompresses the gzip and deflate responses instead
+func WithCompression(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.compressionDisabled = !enabled
+	}
+}
+
+// WithHTTP2 negotiates HTTP/2 with the masters over TLS when enabled, otherwise the built
+// transport sticks to HTTP/1.1 keep-alive connections
+func WithHTTP2(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.enableHTTP2 = enabled
+	}
+}
+
+// WithDialer dials the connections of the requests and health checks with the function, i.e.
+// through a SOCKS proxy or a mesh sidecar. It's ignored along with the other transport settings
+// when a client is given with WithHTTPClient, set the dialer on its transport instead
+func WithDialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) ClusterOption {
+	return func(config *clusterConfig) {
+		config.dialer = dialer
+	}
+}
+
+// WithTLSHandshakeTimeout bounds the tls handshakes with the masters, so a master with a broken
+// tls layer fails over quickly rather than within the timeout of the request. It applies to the
+// transport built by the client only, set TLSHandshakeTimeout on the transport of a client given
+// with WithHTTPClient instead
+func WithTLSHandshakeTimeout(timeout time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.tlsHandshakeTimeout = timeout
+	}
+}
+
+// WithTLSServerName verifies the certificates of the masters against the server name rather
+// than the host of the endpoints, for masters dialed by ip with certificates issued for a dns
+// name. The member names are keyed by endpoint and override the server name for those members.
+// It replaces the default SNI and hostname based verification, and like the other transport
+// settings it's ignored when a client is given with WithHTTPClient
+func WithTLSServerName(serverName string, memberServerNames map[string]string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.tlsServerName = serverName
+		config.memberServerNames = memberServerNames
+	}
+}
+
+// WithDefaultPorts sets the port added to the endpoints without one keyed by their protocol
+// schema, once the default protocol schema is applied, i.e. {"http": 80, "https": 9999} for swan
+// served over tls on its own port. It replaces the default of 80 for http and 443 for https, the
+// endpoints of a protocol schema missing from the ports are left without one
+func WithDefaultPorts(ports map[string]int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.defaultPorts = make(map[string]int)
+		for scheme, port := range ports {
+			config.defaultPorts[strings.ToLower(scheme)] = port
+		}
+	}
+}
+
+// WithRegionAffinity prefers the members in the given region. The regions of the members
+// are keyed by endpoint, members without a region are considered to be local
+func WithRegionAffinity(region string, memberRegions map[string]string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.region = region
+		config.memberRegions = memberRegions
+	}
+}
+
+// WithMemberWeights sets the weights of the members used by the weighted selector, keyed by
+// endpoint. The members not listed have the default weight of 1, see SetMemberWeight
+func WithMemberWeights(weights map[string]int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.memberWeights = weights
+	}
+}
+
+// WithRegionPenalty sets how strongly members outside the local region are avoided. A penalty
+// of 1 (the default) only uses them when no local member is up, lower penalties let them take
+// a share of the traffic relative to a local member of 1 - penalty, i.e. 0.9 sends a remote
+// member a tenth of the requests a local member gets
+func WithRegionPenalty(penalty float64) ClusterOption {
+	return func(config *clusterConfig) {
+		config.regionPenalty = penalty
+	}
+}
+
+// WithFailurePenalty avoids a member which failed a request without being marked down for the
+// window, i.e. below an error rate or kept up by WithMinUpMembers. Right after the failure it's
+// only selected when no other member is, decaying back to its normal share over the window
+func WithFailurePenalty(window time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.failurePenaltyWindow = window
+	}
+}
+
+// WithMaintenanceStatus treats the responses with the given status code as the master
+// being in maintenance, draining it until a health check reports it ready again
+func WithMaintenanceStatus(code int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.maintenanceStatusCode = code
+	}
+}
+
+// WithMaintenanceHeader treats the responses carrying the given header as the master
+// being in maintenance, draining it until a health check reports it ready again
+func WithMaintenanceHeader(name string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.maintenanceHeader = name
+	}
+}
+
+// WithRequestDecorator invokes the decorator on every request and health check right before it
+// is sent, i.e. to sign it or add tracing headers. An error aborts the request without failing over.
+// Setting Accept-Encoding turns off the compression of the transport, see WithCompression
+func WithRequestDecorator(decorator func(*http.Request) error) ClusterOption {
+	return func(config *clusterConfig) {
+		config.requestDecorator = decorator
+	}
+}
+
+// WithFailureFilter consults the filter before marking down a member a request failed on,
+// returning false keeps the member up and returns the error instead of failing over. By
+// default every failure marks the member down
+func WithFailureFilter(filter func(endpoint string, err error) bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.failureFilter = filter
+	}
+}
+
+// WithLockSampling records how long callers wait for the cluster lock, see LockStats. It adds
+// a couple of clock reads to every acquisition so it's meant for diagnosing contention
+func WithLockSampling(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.sampleLockWaits = enabled
+	}
+}
+
+// WithSelector sets the strategy choosing the member among the ones which are up, by default
+// the first one in the configured order
+func WithSelector(selector Selector) ClusterOption {
+	return func(config *clusterConfig) {
+		config.selector = selector
+	}
+}
+
+// WithRequireHealthy probes the members when the cluster is created and fails with the
+// *PingError of the probes, listing why each member failed, when none of them passed within the
+// timeout. It's off by default, a cluster whose members are all down is created degraded
+func WithRequireHealthy(timeout time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.requireHealthyTimeout = timeout
+	}
+}
+
+// WithShuffledMembers shuffles the members when the cluster is created, so the clients sharing
+// a configuration don't all start on its first endpoint. The shuffled order replaces the
+// configured one for the selectors, see WithRandSource to make it reproducible
+func WithShuffledMembers(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.shuffleMembers = enabled
+	}
+}
+
+// WithSkipInvalidEndpoints skips the blank or invalid endpoints with a logged warning rather
+// than failing, as long as one valid endpoint remains. By default any invalid endpoint fails
+func WithSkipInvalidEndpoints(skip bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.skipInvalidEndpoints = skip
+	}
+}
+
+// WithMaxMembers limits the number of members newCluster and SetMembers accept, by default
+// it's unlimited
+func WithMaxMembers(max int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.maxMembers = max
+	}
+}
+
+// WithPingQuorum sets how many members must pass the liveness checks for Ping to succeed, i.e.
+// a majority of the masters, the default of zero requires all of them
+func WithPingQuorum(quorum int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.pingQuorum = quorum
+	}
+}
+
+// WithMinUpMembers keeps at least min members up, a failed request doesn't mark down a member
+// when only min are left up, it's kept as a degraded last resort with a logged warning. This
+// trades correctness for availability, the default of zero has no floor
+func WithMinUpMembers(min int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.minUpMembers = min
+	}
+}
+
+// WithEnvExpansion expands the environment variables in the endpoints, i.e. ${SWAN_MASTER_1},
+// before parsing them. It's off by default so a literal $ in an endpoint is kept
+func WithEnvExpansion(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.expandEnv = enabled
+	}
+}
+
+// WithDistinctHosts fails rather than logs a warning when several endpoints are given but they
+// are all on the same host after normalization, so the cluster has no redundancy
+func WithDistinctHosts(required bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.requireDistinctHosts = required
+	}
+}
+
+// WithConnectionTracing counts per member how many requests got a new connection and how many
+// reused a pooled one, see MemberInfo. It's off by default as it adds a trace to every request
+func WithConnectionTracing(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.traceConnections = enabled
+	}
+}
+
+// WithErrorRate marks a member down once more than the rate, between 0 and 1, of its last
+// window requests failed, rather than on the first failed request. The failed requests are
+// still retried on another member. A member is only judged once window requests were made
+func WithErrorRate(rate float64, window int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.errorRate = rate
+		config.errorRateWindow = window
+	}
+}
+
+// WithFlapQuarantine keeps a member which changed its status more than the given transitions
+// within the window down for the cooldown, whatever its health checks say, rather than letting
+// it rejoin and fail the requests again. Once the cooldown is over it's only admitted again when
+// it passes a health check, with its transitions counted from scratch
+func WithFlapQuarantine(transitions int, window, cooldown time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.flapTransitions = transitions
+		config.flapWindow = window
+		config.flapCooldown = cooldown
+	}
+}
+
+// WithIdempotencyKey sets the header carrying an idempotency key on the write requests, i.e. a
+// POST, PUT or DELETE. The key is generated once per request and sent with every attempt, so
+// a write which failed mid-flight on a member and was retried on another can be deduplicated.
+// Swan, or a gateway in front of it, must honor the header, the client only sends it. The key
+// is random unless newKey is given
+func WithIdempotencyKey(header string, newKey func() string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.idempotencyHeader = header
+		config.newIdempotencyKey = newKey
+	}
+}
+
+// WithObserver makes the cluster only observe its members for tooling reporting their health,
+// they are all probed straight away and then every interval, updating their status and stats.
+// Selecting a member, and so sending a request through the cluster, fails with ErrObserverMode
+func WithObserver(interval time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.observeInterval = interval
+	}
+}
+
+// WithSelectionTracing logs the member chosen by every selection along with the strategy. It's
+// meant for debugging and off by default, when off it costs nothing per selection
+func WithSelectionTracing(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.traceSelections = enabled
+	}
+}
+
+// WithChaos fails the given share, between 0 and 1, of the requests sent to the endpoint with
+// ErrInjectedFailure before they are sent, marking the member down just like a real failure.
+// It's meant to exercise the failover in testing environments and is inert unless given
+func WithChaos(endpoint string, rate float64) ClusterOption {
+	return func(config *clusterConfig) {
+		if config.chaosRates == nil {
+			config.chaosRates = make(map[string]float64)
+		}
+		config.chaosRates[endpoint] = rate
+	}
+}
+
+// WithRandSource sets the source the random draws of the cluster come from, i.e. the chaos rates,
+// the shuffled members, the region affinity and the failure penalty, a seeded one reproducing a
+// test. By default it's seeded with the time. The cluster guards it, so it must not be used
+// elsewhere meanwhile
+func WithRandSource(random *rand.Rand) ClusterOption {
+	return func(config *clusterConfig) {
+		config.random = random
+	}
+}
+
+// WithLogger sets the logger for the debug messages and warnings, by default they are discarded
+func WithLogger(logger *log.Logger) ClusterOption {
+	return func(config *clusterConfig) {
+		config.logger = logger
+	}
+}
+
+// WithMaxDownDuration re-admits a member down for longer than the duration even though it fails
+// the health checks, so the requests validate it, i.e. when the health check is misconfigured
+// while the API is fine. A member failing the requests is marked down again as usual
+func WithMaxDownDuration(duration time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.maxDownDuration = duration
+	}
+}
+
+// WithHealthCheckInterval sets the interval between the health checks of a down member
+func WithHealthCheckInterval(interval time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.healthCheckInterval = interval
+	}
+}
+
+// ProbeSettings overrides the liveness check of a member, i.e. while the masters of a rolling
+// upgrade have different health contracts
+type ProbeSettings struct {
+	// the path of the liveness check, empty keeps the one of the cluster
+	Path string
+	// the status codes passing the check, empty only passes a 200
+	StatusCodes []int
+}
+
+// WithMemberProbe overrides the liveness check of the member with the endpoint, the members
+// without one use the settings of the cluster
+func WithMemberProbe(endpoint string, settings ProbeSettings) ClusterOption {
+	return func(config *clusterConfig) {
+		if config.memberProbes == nil {
+			config.memberProbes = make(map[string]ProbeSettings)
+		}
+		settings.Path = strings.TrimLeft(settings.Path, "/")
+		config.memberProbes[endpoint] = settings
+	}
+}
+
+// WithProbeBody sends the json body with every health check, i.e. for a POST /v1/health
+// along with WithProbeMethod and WithLivenessProbe. The decorator still runs on the health
+// checks and the client timeout applies
+func WithProbeBody(body []byte) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeBody = body
+	}
+}
+
+// WithProbeMethod sets the http method of the health checks, by default GET. HEAD is commonly
+// cheaper to serve, only the status code of the answer is looked at
+func WithProbeMethod(method string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeMethod = strings.ToUpper(method)
+	}
+}
+
+// ProbeRequestBuilder builds the health check request sent to the member on the path, i.e. the
+// liveness, readiness or recovery check. The request must carry the context, which is cancelled
+// when the check is cut short
+type ProbeRequestBuilder func(ctx context.Context, endpoint, path string) (*http.Request, error)
+
+// WithProbeRequestBuilder sets how the health check requests are built, i.e. for masters behind
+// gateways exposing their health differently. The builder replaces the method, body and path of
+// the health checks, as well as WithProbeConnectionClose, though the decorator still runs on the
+// requests it builds and the answers are judged as usual
+func WithProbeRequestBuilder(builder ProbeRequestBuilder) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeRequestBuilder = builder
+	}
+}
+
+// WithMarkDownStatuses sets the 5xx statuses telling the member is unhealthy, which mark it down
+// and fail the request over to another member, by default 502, 503 and 504. The other 5xx are
+// taken as failures of the operation, i.e. a 500 for a bad app, and fail the request with
+// ErrServerError leaving the member up. No status disables it, every 5xx failing the request
+func WithMarkDownStatuses(statuses ...int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.markDownStatuses = statuses
+	}
+}
+
+// WithRetryBodyLimit sets the size in bytes of the largest request body kept to retry the request
+// on another member, by default 1 MiB, i.e. so a huge app manifest isn't held on to through the
+// failovers. The requests over it are handled by the policy: sent once, the write not being
+// retried on any failure, or rejected with ErrBodyTooLarge
+func WithRetryBodyLimit(limit int, policy OversizedBodyPolicy) ClusterOption {
+	return func(config *clusterConfig) {
+		config.retryBodyLimit = limit
+		config.oversizedBodyPolicy = policy
+	}
+}
+
+// WithStrictRefresh makes RefreshMembers fail with ErrUnknownMember when given an endpoint
+// which isn't a member, rather than ignoring it
+func WithStrictRefresh(strict bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.strictRefresh = strict
+	}
+}
+
+// WithDrainedProbing keeps probing the members drained by DrainAndWait, which by default are left
+// alone by the health checks and RefreshNow until Undrain as they don't recover by passing them,
+// i.e. to keep their probe stats going. The members draining for a maintenance are probed either
+// way, passing a health check is how the end of the maintenance is found
+func WithDrainedProbing(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeDrained = enabled
+	}
+}
+
+// WithConnectionWarmup opens a connection to every member which is up in the background once the
+// cluster is created, after WithRequireHealthy when given, and leaves it idle in the pool of the
+// http client so the first requests don't pay for the handshakes. See WarmUp
+func WithConnectionWarmup(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.warmup = enabled
+	}
+}
+
+// WithProbeAuthFailure sets a callback, i.e. to refresh a token, invoked with the endpoint and
+// the status code when a health check is refused with a 401 or 403. The member isn't considered
+// healthy, but its reason shows the auth failure rather than an outage
+func WithProbeAuthFailure(callback func(endpoint string, statusCode int)) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeAuthFailure = callback
+	}
+}
+
+// WithAvailabilityCallback sets a callback invoked with false when no member is up anymore and
+// with true when one recovers, i.e. to trip a circuit breaker on losing Swan entirely. It's
+// invoked once the availability held for the debounce, so flapping members don't spam it, outside
+// of the lock of the cluster and in order
+func WithAvailabilityCallback(callback func(available bool), debounce time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.availability = callback
+		config.availabilityDebounce = debounce
+	}
+}
+
+// WithRedirectMembers adds the host a request was redirected to, i.e. the leader, as a member
+// when it isn't one, so the client can track a leader outside of the configured endpoints. The
+// member expires after the ttl unless redirected to again, and at most max are kept, the one
+// expiring first giving way to a new one
+func WithRedirectMembers(ttl time.Duration, max int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.redirectTTL = ttl
+		config.maxRedirectMembers = max
+	}
+}
+
+// WithStickyHeader selects the member of a request by consistent hashing of the value of the
+// header, so the requests of a user go to the same master and benefit from its warm caches. The
+// header is set by the request decorator, which is invoked once more to read it before the
+// member is selected, requests without it use the selector. The weights are not used. When the
+// member of a key is down the key is rehashed over the others, and moves back once it's up
+func WithStickyHeader(header string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.stickyHeader = header
+	}
+}
+
+// WithWaitForMember makes the requests wait for a member to be up, until the context of the call
+// expires or the cluster is closed, rather than fail straight away with ErrSwanDown. It's the
+// default of the client, a call overrides it with the context given by WaitForMember, and without
+// a deadline from ForContext a request may wait as long as the members are down
+func WithWaitForMember(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.waitForMember = enabled
+	}
+}
+
+// WithMaxInFlight caps the requests in flight to each member, the members at the cap are skipped
+// by the selection. When all the members which are up are at the cap a request fails with
+// ErrSaturated, or when wait is set blocks until one of them completes a request
+func WithMaxInFlight(max int, wait bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.maxInFlight = max
+		config.waitWhenSaturated = wait
+	}
+}
+
+// WithProbeKeepAlivesDisabled sends the health checks over a transport of their own with the
+// keep-alives disabled, so every health check tests a new connection and never shares one with
+// the requests, which keep using the pooled transport. It costs a new connection, and for https
+// a handshake, per health check so it's off by default
+func WithProbeKeepAlivesDisabled(disabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeKeepAlivesDisabled = disabled
+	}
+}
+
+// WithProbeConnectionClose closes the connection of every health check once answered rather
+// than returning it to the pool, so the requests never inherit a connection a master closes
+// right after answering a ping
+func WithProbeConnectionClose(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.probeConnectionClose = enabled
+	}
+}
+
+// WithRecoveryProbe sets a secondary path a down member passing the liveness check must pass as
+// well before it's marked up, i.e. /v_beta/apps when /ping answers while the api is wedged. By
+// default the liveness check alone recovers a member
+func WithRecoveryProbe(path string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.recoveryPath = strings.TrimLeft(path, "/")
+	}
+}
+
+// WithLivenessProbe sets the path checked to recover a down member, by default /ping. A member
+// failing it is dead and is only brought back once it passes again
+func WithLivenessProbe(path string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.livenessPath = strings.TrimLeft(path, "/")
+	}
+}
+
+// WithProbeThresholds sets the liveness checks in a row a down member must pass to be marked up,
+// so a single lucky check doesn't bring back a node which is still failing, and the ones a member
+// which is up must fail to be marked down by the checks of RefreshNow, PingMember or an observing
+// cluster. The failed requests mark the members down as usual. Both default to 1
+func WithProbeThresholds(recover, fail int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.recoveryThreshold = recover
+		config.failureThreshold = fail
+	}
+}
+
+// WithReadinessProbe periodically checks the path on the up members, i.e. /v1/leader. A member
+// failing it threshold times in a row is alive but not ready, it's skipped by getMember until
+// the check passes again without being marked down. A member not reachable at all is marked down
+func WithReadinessProbe(path string, interval time.Duration, threshold int) ClusterOption {
+	return func(config *clusterConfig) {
+		config.readinessPath = strings.TrimLeft(path, "/")
+		config.readinessInterval = interval
+		config.readinessThreshold = threshold
+	}
+}
+
+// cluster is a collection of swan nodes
+type cluster struct {
+	sampledRWMutex
+	// a collection of nodes
+	members []*member
+	// the http client
+	client *http.Client
+	// the http client of the health checks, the same one unless they have their own connections
+	probeClient *http.Client
+	// the optional settings
+	config clusterConfig
+	// the protocol schema of endpoints without one
+	defaultProto string
+	// the regions of the members given by the options keyed by the normalized endpoint
+	regions map[string]string
+	// the share of the requests failed on purpose keyed by the normalized endpoint
+	chaosRates map[string]float64
+	// the source of the chaos rates
+	random *lockedRand
+	// the construction time weights of the members keyed by the normalized endpoint
+	weights map[string]int
+	// the liveness check settings of the members keyed by the normalized endpoint
+	probes map[string]ProbeSettings
+	// the priority tiers of the members keyed by the normalized endpoint
+	tiers map[string]int
+	// the tags of the members keyed by the normalized endpoint
+	tags map[string]map[string]string
+	// the annotations of the latest endpoints keyed by the normalized endpoint, they take
+	// precedence over the weights, regions, tiers and tags above
+	annotations map[string]memberAnnotations
+	// closed and replaced whenever the status of a member changes
+	changed chan struct{}
+	// closed and replaced to wake up the pending checks, see RefreshNow
+	refresh chan struct{}
+	// closed when the cluster is closed
+	done chan struct{}
+	// set once Shutdown began
+	shuttingDown bool
+	// whether the members disagreed about the leader on the latest poll
+	partitioned bool
+	// the leader reported by each member on the latest poll
+	leaders map[string]string
+	// the constraint the versions of the members must satisfy, nil when they're not checked
+	versions versionConstraint
+	// the requests retried on another member after failing on one
+	failovers int64
+	// the recent failovers, oldest first, and the latest failover warning, see WithFailoverWarning
+	failoverTimes  []time.Time
+	failoverWarned time.Time
+	failoverMu     sync.Mutex
+	// the number of selections made, numbering the latest selection of each member
+	selectionSequence uint64
+	// the member all the requests go to while debugging, nil when none is pinned
+	pinned *member
+	// whether the availability callback was last told a member is up
+	available bool
+	// the pending check of the availability, nil when none is
+	availabilityTimer *time.Timer
+	// serializes the invocations of the availability callback
+	availabilityMu sync.Mutex
+	// the channels of the subscribers to the changes, see Subscribe
+	subscribers   map[chan ClusterEvent]bool
+	subscribersMu sync.Mutex
+	// the cached auth token and when it goes stale, see WithTokenSource
+	token        string
+	tokenExpires time.Time
+	tokenMu      sync.Mutex
+	// ensures the cluster is closed once
+	closeOnce sync.Once
+	// the log lines written while holding the write lock, logged once it's released, see logf
+	pendingLogs []string
+}
+
+// member represents an individual endpoint
+type member struct {
+	// the name / ip address of the host
+	endpoint string
+	// the status of the host
+	status memberStatus
+	// why the host isn't up, empty when unknown
+	reason string
+	// when the status last changed, or the member was added
+	since time.Time
+	// the region of the host
+	region string
+	// whether the host is only selected when none of the other members is up
+	fallback bool
+	// the priority tier of the host, the lowest tier with a member up is selected from
+	tier int
+	// the metadata of the host, i.e. its rack, opaque to the selection, nil when it has none
+	tags map[string]string
+	// the share of the requests the weighted selector sends to the host
+	weight int
+	// the load the host reported on the latest capacity poll, when it did
+	load         float64
+	loadReported bool
+	// closed when the member is removed from the cluster
+	removed chan struct{}
+	// the consecutive failed readiness checks
+	readinessFailures int
+	// the liveness checks in a row the host passed or failed since its status changed
+	probePasses, probeFailures int
+	// when the host went up or out of rotation, oldest first, see UptimePercent
+	uptime []statusSpan
+	// the last time the member answered a request or health check successfully
+	lastSuccess time.Time
+	// whether the host ever answered a request or health check successfully, never cleared
+	everSucceeded bool
+	// the moving average of the response latency of the requests, zero until one answered
+	latency time.Duration
+	// the health checks performed
+	probes int64
+	// the failed health checks which never got an answer, and the ones which did
+	connectionFailures int64
+	responseFailures   int64
+	// the times the host was selected since the counters were reset
+	selections int64
+	// the sequence number of the latest selection of the host, zero until selected
+	lastSelection uint64
+	// the liveness check settings of the host, nil uses the ones of the cluster
+	probe *ProbeSettings
+	// whether the health check of the host is running
+	checking bool
+	// the outcome of the latest health check, nil until one was performed
+	lastProbe *ProbeResult
+	// the requests in flight to the host
+	inFlight int64
+	// when a member added by a redirect expires, zero for the configured members
+	expires time.Time
+	// whether each of the recent requests failed, a ring holding up to the error rate window
+	outcomes []bool
+	// the position of the oldest outcome once the ring is full
+	nextOutcome int
+	// the failed requests among the outcomes
+	failures int
+	// when the status changed within the flap window, only tracked with a flap quarantine
+	transitions []time.Time
+	// the end of the quarantine of the flapping host, zero when not quarantined
+	quarantinedUntil time.Time
+	// when the latest request to the host failed, only tracked with a failure penalty
+	lastFailure time.Time
+	// the end of the expiry of the host going away, zero when it's not expired, see ExpireMember
+	expiredUntil time.Time
+	// whether the host was drained by DrainAndWait, it's kept out until Undrain
+	drained bool
+	// whether the members agreed on the host as the leader on the latest leader poll
+	leader bool
+	// whether the leader is healthy for the writes, whatever its status for the reads
+	leaderHealthy bool
+	// the connections requests got, only counted when tracing connections
+	newConns    int64
+	reusedConns int64
+	idleConns   int64
+}
+
+// newCluster returns a new swan cluster, all the members start up. When a readiness probe is
+// configured the members are probed in the background, the cluster is usable meanwhile. The
+// endpoints may be annotated with the settings of their member in the query, see
+// parseAnnotations, i.e. https://swan-1:9999?weight=3&region=us-east. A nil client is replaced by
+// a client with the transport NewClient builds, timing out the requests after 30s. Only a nil
+// client given here gets the timeout, NewClient always passes a client without one, as the event
+// subscriptions stream over it
+func newCluster(client *http.Client, swanURL string, opts ...ClusterOption) (*cluster, error) {
+	return newClusterEndpoints(client, strings.Split(swanURL, ","), opts...)
+}
+
+// ValidateSwanURL validates the comma separated endpoints and the options as NewClient does,
+// without creating a client, i.e. when loading the configuration. It returns the normalized
+// endpoints of the members, without their annotations and duplicates
+func ValidateSwanURL(swanURL string, opts ...ClusterOption) ([]string, error) {
+	config := newClusterConfig(opts...)
+	if _, err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	endpoints, _, _, err := parseEndpoints(config, strings.Split(swanURL, ","), "")
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// newClusterEndpoints creates a new cluster of the endpoints, see newCluster
+func newClusterEndpoints(client *http.Client, list []string, opts ...ClusterOption) (*cluster, error) {
+	config := newClusterConfig(opts...)
+	versions, err := validateConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: extract and basic validate the endpoints
+	endpoints, annotations, defaultProto, err := parseEndpoints(config, list, "")
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = newHTTPClient(config)
+		client.Timeout = defaultClientTimeout
+	}
+
+	c := &cluster{
+		sampledRWMutex: sampledRWMutex{sampled: config.sampleLockWaits},
+		client:         client,
+		probeClient:    client,
+		config:         config,
+		defaultProto:   defaultProto,
+		regions:        make(map[string]string),
+		chaosRates:     make(map[string]float64),
+		random:         newLockedRand(config.random),
+		weights:        make(map[string]int),
+		probes:         make(map[string]ProbeSettings),
+		tiers:          make(map[string]int),
+		tags:           make(map[string]map[string]string),
+		changed:        make(chan struct{}),
+		refresh:        make(chan struct{}),
+		done:           make(chan struct{}),
+		versions:       versions,
+	}
+	if config.probeKeepAlivesDisabled {
+		c.probeClient = newProbeClient(client)
+	}
+	// step: key the regions by the normalized endpoints
+	for endpoint, region := range config.memberRegions {
+		if u, err := normalizeEndpoint(endpoint, defaultProto, config.defaultPorts); err == nil {
+			c.regions[u.String()] = region
+		}
+	}
+	for endpoint, rate := range config.chaosRates {
+		if u, err := normalizeEndpoint(endpoint, defaultProto, config.defaultPorts); err == nil {
+			c.chaosRates[u.String()] = rate
+		}
+	}
+	for endpoint, weight := range config.memberWeights {
+		if u, err := normalizeEndpoint(endpoint, defaultProto, config.defaultPorts); err == nil {
+			c.weights[u.String()] = weight
+		}
+	}
+	for endpoint, settings := range config.memberProbes {
+		if u, err := normalizeEndpoint(endpoint, defaultProto, config.defaultPorts); err == nil {
+			c.probes[u.String()] = settings
+		}
+	}
+	// step: the annotations of the endpoints take precedence over the options
+	c.annotate(annotations)
+	// step: create a new node for each endpoint
+	for _, endpoint := range endpoints {
+		c.members = append(c.members, c.newMember(endpoint))
+	}
+	if config.shuffleMembers {
+		c.random.Shuffle(len(c.members), func(i, j int) {
+			c.members[i], c.members[j] = c.members[j], c.members[i]
+		})
+	}
+	c.available = c.anyUp()
+	if config.readinessPath != "" {
+		go c.readinessLoop()
+	}
+	if versions != nil {
+		go c.checkVersions()
+	}
+	if config.observeInterval > 0 {
+		go c.observeLoop()
+	}
+	if config.leaderPath != "" {
+		go c.leaderLoop()
+	}
+	if config.capacityPath != "" {
+		go c.capacityLoop()
+	}
+	// step: fail fast when no member answers, i.e. a misconfigured url
+	if config.requireHealthyTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), config.requireHealthyTimeout)
+		defer cancel()
+		if err := c.RefreshNow(ctx); errors.Is(err, ErrSwanDown) {
+			c.Close()
+			return nil, err
+		}
+	}
+	if config.warmup {
+		go c.WarmUp(context.Background())
+	}
+
+	return c, nil
+}
+
+// WarmUp opens a connection to every member which is up in parallel with a request on the
+// liveness path, leaving it idle in the pool of the http client for the requests to reuse, i.e.
+// after swapping the transport. The answers don't change the status of the members, it returns
+// the failures like RefreshNow
+func (c *cluster) WarmUp(ctx context.Context) error {
+	c.RLock()
+	var members []*member
+	for _, n := range c.members {
+		if n.status == memberStatusUp {
+			members = append(members, n)
+		}
+	}
+	c.RUnlock()
+
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, n := range members {
+		wg.Add(1)
+		go func(i int, n *member) {
+			defer wg.Done()
+			errs[i] = c.warmUp(ctx, n)
+		}(i, n)
+	}
+	wg.Wait()
+
+	return newPingError(members, errs)
+}
+
+// warmUp sends a request to the node with the http client of the requests, reading the answer
+// through so the connection goes back to the pool
+func (c *cluster) warmUp(ctx context.Context, node *member) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", joinURL(node.endpoint, c.livenessPath(node)), nil)
+	if err != nil {
+		return err
+	}
+	if err := c.decorate(request); err != nil {
+		return err
+	}
+	res, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(ioutil.Discard, res.Body)
+
+	return err
+}
+
+// validateConfig validates the settings of a cluster, returning the constraint of the version
+// check when enabled
+func validateConfig(config clusterConfig) (versionConstraint, error) {
+	for scheme, port := range config.defaultPorts {
+		if port < 1 || port > 65535 {
+			return nil, errors.New(fmt.Sprintf("default port: %d of %s is invalid", port, scheme))
+		}
+	}
+	if config.regionPenalty < 0 || config.regionPenalty > 1 {
+		return nil, errors.New(fmt.Sprintf("region penalty: %v must be between 0 and 1", config.regionPenalty))
+	}
+	if config.failurePenaltyWindow < 0 {
+		return nil, errors.New(fmt.Sprintf("failure penalty: %s cannot be negative", config.failurePenaltyWindow))
+	}
+	if config.errorRateWindow < 0 || config.errorRate < 0 || config.errorRate > 1 {
+		return nil, errors.New(fmt.Sprintf("error rate: %v over %d requests is invalid", config.errorRate, config.errorRateWindow))
+	}
+	if config.flapTransitions < 0 || (config.flapTransitions > 0 && (config.flapWindow <= 0 || config.flapCooldown <= 0)) {
+		return nil, errors.New(fmt.Sprintf("flap quarantine: %d transitions in %s for %s is invalid",
+			config.flapTransitions, config.flapWindow, config.flapCooldown))
+	}
+	if config.failoverThreshold < 0 || (config.failoverThreshold > 0 && config.failoverWindow <= 0) {
+		return nil, errors.New(fmt.Sprintf("failover warning: %d failovers in %s is invalid",
+			config.failoverThreshold, config.failoverWindow))
+	}
+	if config.availabilityDebounce < 0 {
+		return nil, errors.New(fmt.Sprintf("availability: debounce %s is invalid", config.availabilityDebounce))
+	}
+	if config.capacityPath != "" && config.capacityInterval <= 0 {
+		return nil, errors.New("capacity poll needs a positive interval")
+	}
+	if !metricNamePattern.MatchString(config.metricsPrefix) || !labelNamePattern.MatchString(config.metricsEndpointLabel) {
+		return nil, errors.New(fmt.Sprintf("metrics: prefix %q or label %q is not a valid name",
+			config.metricsPrefix, config.metricsEndpointLabel))
+	}
+	if config.retryBodyLimit <= 0 {
+		return nil, errors.New(fmt.Sprintf("retry body limit: %d must be positive", config.retryBodyLimit))
+	}
+	if config.pingQuorum < 0 {
+		return nil, errors.New(fmt.Sprintf("ping quorum: %d cannot be negative", config.pingQuorum))
+	}
+	if config.tokenSource != nil && config.tokenTTL <= 0 {
+		return nil, errors.New("token source needs a positive ttl")
+	}
+	if config.leaderWrites && config.leaderPath == "" {
+		return nil, errors.New("leader writes need the leader poll")
+	}
+	if config.leaderPath != "" && config.leaderInterval <= 0 {
+		return nil, errors.New("leader poll needs a positive interval")
+	}
+	if config.recoveryThreshold < 1 || config.failureThreshold < 1 {
+		return nil, errors.New(fmt.Sprintf("probe thresholds: %d to recover and %d to fail must be at least 1",
+			config.recoveryThreshold, config.failureThreshold))
+	}
+	if config.readinessPath != "" && (config.readinessInterval <= 0 || config.readinessThreshold < 1) {
+		return nil, errors.New("readiness probe needs a positive interval and threshold")
+	}
+
+	var versions versionConstraint
+	if config.versionPath != "" {
+		var err error
+		if versions, err = parseVersionConstraint(config.versionConstraint); err != nil {
+			return nil, err
+		}
+	}
+
+	return versions, nil
+}
+
+// DrainAndWait takes the member out of rotation for a restart and waits for its requests in
+// flight to complete, once it returns nil the member is no longer selected and idle. It fails
+// when draining the member would leave fewer members up than WithMinUpMembers, and with the
+// error of the context when it expires first, the member staying drained. The health checks
+// don't bring a drained member back nor probe it, see Undrain and WithDrainedProbing
+func (c *cluster) DrainAndWait(ctx context.Context, endpoint string) error {
+	c.Lock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		c.Unlock()
+		return ErrUnknownMember
+	}
+	if n.status == memberStatusUp && c.config.minUpMembers > 0 {
+		up := 0
+		for _, m := range c.members {
+			if m.status == memberStatusUp {
+				up++
+			}
+		}
+		if up <= c.config.minUpMembers {
+			c.Unlock()
+			return errors.New(fmt.Sprintf("draining: %s would leave %d members up, below the minimum of %d",
+				n.endpoint, up-1, c.config.minUpMembers))
+		}
+	}
+	n.drained = true
+	if n.status == memberStatusUp || n.status == memberStatusNotReady {
+		c.setStatus(n, memberStatusDraining, "drained")
+	}
+	c.Unlock()
+
+	for {
+		c.RLock()
+		inFlight := atomic.LoadInt64(&n.inFlight)
+		changed := c.changed
+		c.RUnlock()
+		if inFlight == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Undrain returns a member drained by DrainAndWait to rotation, once it passes a health check
+func (c *cluster) Undrain(endpoint string) error {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return ErrUnknownMember
+	}
+	if !n.drained {
+		return nil
+	}
+	n.drained = false
+	c.resetPenalties(n)
+	if n.status == memberStatusDraining {
+		c.setStatus(n, memberStatusDown, "undrained")
+	}
+	c.startHealthCheck(n)
+
+	return nil
+}
+
+// ExpireMember marks the member down straight away from an external signal rather than a failed
+// request, i.e. the events of swan telling a master is going away. It isn't brought back up until
+// the delay is over, its health check waiting for it to probe the member and recover it once it
+// passes. The manual recovery actions cut the expiry short, see resetPenalties. It's a no-op for
+// an endpoint which isn't a member
+func (c *cluster) ExpireMember(endpoint string, recoverAfter time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return
+	}
+	n.expiredUntil = time.Now().Add(recoverAfter)
+	if n.status == memberStatusUp || n.status == memberStatusNotReady {
+		c.setStatus(n, memberStatusDown, "expired")
+	}
+	c.startHealthCheck(n)
+}
+
+// MarkUp brings the member back into rotation straight away, i.e. once an operator restarted it,
+// rather than waiting for its health check. It resets the penalties of the member so a hiccup
+// following the manual recovery isn't held against it, see resetPenalties. A drained member
+// stays out until Undrain, and the health checks and requests mark the member down as usual
+func (c *cluster) MarkUp(endpoint string) error {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return ErrUnknownMember
+	}
+	c.resetPenalties(n)
+	if n.status != memberStatusUp && !n.drained {
+		c.setStatus(n, memberStatusUp, "")
+	}
+
+	return nil
+}
+
+// resetPenalties clears the state a member accumulated by failing, on the manual recovery
+// actions MarkUp, Undrain and a PingMember it passes: the status changes counted by the flap
+// quarantine and the quarantine itself, the expiry, the latest failure of the failure penalty,
+// the outcomes of the error rate window and the failures of the readiness check. The counters of
+// the stats are left alone. The caller must hold the write lock
+func (c *cluster) resetPenalties(n *member) {
+	n.transitions = nil
+	n.quarantinedUntil = time.Time{}
+	n.lastFailure = time.Time{}
+	n.expiredUntil = time.Time{}
+	n.outcomes = nil
+	n.nextOutcome = 0
+	n.failures = 0
+	n.readinessFailures = 0
+}
+
+// Shutdown stops selecting members, getMember fails with ErrShuttingDown from now on, waits for
+// the requests in flight to complete and then closes the cluster. When the context expires
+// first the cluster is closed anyway and the error of the context returned
+func (c *cluster) Shutdown(ctx context.Context) error {
+	c.Lock()
+	c.shuttingDown = true
+	c.notifyChanged()
+	c.Unlock()
+	defer c.Close()
+
+	for {
+		c.RLock()
+		var inFlight int64
+		for _, n := range c.members {
+			inFlight += atomic.LoadInt64(&n.inFlight)
+		}
+		changed := c.changed
+		c.RUnlock()
+		if inFlight == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops the background checks of the cluster
+func (c *cluster) Close() {
+	c.closeOnce.Do(func() {
+		c.subscribersMu.Lock()
+		close(c.done)
+		c.subscribersMu.Unlock()
+		c.closeSubscriptions()
+	})
+}
+
+// parseEndpoints validates and normalizes the endpoints, dropping the duplicates. When no default
+// protocol schema is given the one of the first endpoint is used for the endpoints without one.
+// Invalid endpoints fail the whole list unless the config skips them
+func parseEndpoints(config clusterConfig, endpoints []string, defaultProto string) ([]string, map[string]memberAnnotations, string, error) {
+	var list []string
+	annotations := make(map[string]memberAnnotations)
+	seen := make(map[string]bool)
+	hosts := make(map[string]bool)
+	valid := 0
+
+	for _, endpoint := range endpoints {
+		u, err := parseConfigEndpoint(config, endpoint, defaultProto)
+		var annotation memberAnnotations
+		if err == nil {
+			annotation, err = parseAnnotations(u)
+		}
+		if err != nil {
+			if !config.skipInvalidEndpoints {
+				return nil, nil, "", err
+			}
+			config.logger.Printf("newCluster(): skipping invalid endpoint, error: %s\n", err)
+			continue
+		}
+		defaultProto = u.Scheme
+		valid++
+		hosts[u.Host] = true
+		if !seen[u.String()] {
+			seen[u.String()] = true
+			list = append(list, u.String())
+		}
+		if annotation.weighted || annotation.region != "" || annotation.fallback || annotation.tier != 0 || annotation.tags != nil {
+			annotations[u.String()] = annotation
+		}
+	}
+	if len(list) == 0 {
+		return nil, nil, "", errors.New("no valid endpoints specified")
+	}
+	if config.maxMembers > 0 && len(list) > config.maxMembers {
+		return nil, nil, "", errors.New(fmt.Sprintf("%d endpoints exceed the maximum of %d members", len(list), config.maxMembers))
+	}
+	// step: several endpoints on the same host offer no redundancy, i.e. a VIP given many times
+	if valid > 1 && len(hosts) == 1 {
+		if config.requireDistinctHosts {
+			return nil, nil, "", errors.New(fmt.Sprintf("all the %d endpoints are on the single host: %s", valid, list[0]))
+		}
+		config.logger.Printf("newCluster(): all the %d endpoints are on the single host: %s\n", valid, list[0])
+	}
+
+	return list, annotations, defaultProto, nil
+}
+
+// memberAnnotations are the settings of a member given in the query of its endpoint
+type memberAnnotations struct {
+	// the selection weight of the member, when weighted
+	weight   int
+	weighted bool
+	// the region of the member, empty when not given
+	region string
+	// whether the member is a fallback
+	fallback bool
+	// the priority tier of the member, zero when not given
+	tier int
+	// the tags of the member, nil when not given
+	tags map[string]string
+}
+
+// parseAnnotations removes the annotations from the query of the endpoint and returns them.
+// The annotations are weight, a selection weight which can't be negative, region or its alias
+// zone, the region of the member, and fallback, a boolean which is true when it has no value,
+// making the member a last resort selected only when none of the others is up, and tier, the
+// priority tier of the member which can't be negative, the members without one being in tier 0.
+// The keys prefixed with tag. are the tags of the member, i.e. tag.rack=r1 is the rack tag, they
+// are opaque to the selection. Each may be given once, any other key is invalid as the members
+// don't take a query
+func parseAnnotations(u *url.URL) (memberAnnotations, error) {
+	var annotation memberAnnotations
+	if u.RawQuery == "" && !u.ForceQuery {
+		return annotation, nil
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	u.RawQuery = ""
+	u.ForceQuery = false
+	if err != nil {
+		return annotation, errors.New(fmt.Sprintf("endpoint: %s has invalid annotations reason: %s", u, err))
+	}
+	for key, values := range query {
+		if len(values) > 1 {
+			return annotation, errors.New(fmt.Sprintf("endpoint: %s has the annotation: %s more than once", u, key))
+		}
+		switch key {
+		case "weight":
+			weight, err := strconv.Atoi(values[0])
+			if err != nil || weight < 0 {
+				return annotation, errors.New(fmt.Sprintf("endpoint: %s has an invalid weight: %q", u, values[0]))
+			}
+			annotation.weight, annotation.weighted = weight, true
+		case "region", "zone":
+			if _, found := query["region"]; found && key == "zone" {
+				return annotation, errors.New(fmt.Sprintf("endpoint: %s has both a region and a zone", u))
+			}
+			if values[0] == "" {
+				return annotation, errors.New(fmt.Sprintf("endpoint: %s has an empty %s", u, key))
+			}
+			annotation.region = values[0]
+		case "fallback":
+			fallback, err := strconv.ParseBool(values[0])
+			if values[0] == "" {
+				fallback, err = true, nil
+			}
+			if err != nil {
+				return annotation, errors.New(fmt.Sprintf("endpoint: %s has an invalid fallback: %q", u, values[0]))
+			}
+			annotation.fallback = fallback
+		case "tier":
+			tier, err := strconv.Atoi(values[0])
+			if err != nil || tier < 0 {
+				return annotation, errors.New(fmt.Sprintf("endpoint: %s has an invalid tier: %q", u, values[0]))
+			}
+			annotation.tier = tier
+		default:
+			if !strings.HasPrefix(key, "tag.") || key == "tag." {
+				return annotation, errors.New(fmt.Sprintf("endpoint: %s has an unknown annotation: %s", u, key))
+			}
+			if annotation.tags == nil {
+				annotation.tags = make(map[string]string)
+			}
+			annotation.tags[strings.TrimPrefix(key, "tag.")] = values[0]
+		}
+	}
+
+	return annotation, nil
+}
+
+// annotate applies the annotations of the endpoints to the members created for them, replacing
+// the annotations of the previous endpoints. The caller must hold the lock when the cluster is
+// in use
+func (c *cluster) annotate(annotations map[string]memberAnnotations) {
+	c.annotations = annotations
+}
+
+// reannotate applies the annotations of its endpoint to a member kept across a change of the
+// members, the settings it was annotated with before but no longer are return to the ones of the
+// options. The caller must hold the write lock
+func (c *cluster) reannotate(n *member, previous memberAnnotations) {
+	annotation := c.annotations[n.endpoint]
+	switch {
+	case annotation.weighted:
+		n.weight = annotation.weight
+	case previous.weighted:
+		n.weight = defaultMemberWeight
+		if weight, found := c.weights[n.endpoint]; found {
+			n.weight = weight
+		}
+	}
+	switch {
+	case annotation.region != "":
+		n.region = annotation.region
+	case previous.region != "":
+		n.region = c.regions[n.endpoint]
+	}
+	switch {
+	case annotation.tier != 0:
+		n.tier = annotation.tier
+	case previous.tier != 0:
+		n.tier = c.tiers[n.endpoint]
+	}
+	switch {
+	case annotation.tags != nil:
+		n.tags = annotation.tags
+	case previous.tags != nil:
+		n.tags = c.tags[n.endpoint]
+	}
+	n.fallback = annotation.fallback
+}
+
+// parseConfigEndpoint parses an endpoint of the configuration, expanding the environment
+// variables in it first when enabled. The errors about an expanded endpoint name the entry of
+// the configuration it was expanded from
+func parseConfigEndpoint(config clusterConfig, endpoint, defaultProto string) (*url.URL, error) {
+	expanded := endpoint
+	if config.expandEnv {
+		expanded = os.ExpandEnv(endpoint)
+		if expanded == "" && endpoint != "" {
+			return nil, errors.New(fmt.Sprintf("endpoint: %s expands to nothing", endpoint))
+		}
+	}
+	// step: check for an entry left with its annotations alone, i.e. ${UNSET}?weight=2
+	if strings.HasPrefix(expanded, "?") {
+		if expanded != endpoint {
+			return nil, errors.New(fmt.Sprintf("endpoint: %s has no address once expanded, only the annotations: %s", endpoint, expanded))
+		}
+		return nil, errors.New(fmt.Sprintf("endpoint: %s has no address, only annotations", endpoint))
+	}
+	u, err := parseEndpoint(expanded, defaultProto, config.defaultPorts)
+	if err != nil && expanded != endpoint {
+		return nil, errors.New(fmt.Sprintf("%s, expanded from: %s", err, endpoint))
+	}
+
+	return u, err
+}
+
+// parseEndpoint validates and normalizes a single endpoint. When no default protocol
+// schema is given the endpoint must have one
+func parseEndpoint(endpoint, defaultProto string, ports map[string]int) (*url.URL, error) {
+	// step: check for nothing
+	if endpoint == "" {
+		return nil, errors.New("endpoint is blank")
+	}
+	// step: check for a doubled protocol schema i.e. https://https://host
+	if hasDuplicateScheme(endpoint) {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s has a duplicated protocol schema", endpoint))
+	}
+	// step: parse the url
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s is invalid reason: %s", endpoint, err))
+	}
+	// step: check the protocol schema which will be the default
+	if defaultProto == "" && u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s protocol must be (http|https)", endpoint))
+	}
+	// step: does the url have a protocol schema? if not, use the default
+	if u, err = normalizeEndpoint(endpoint, defaultProto, ports); err != nil {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s is invalid reason: %s", endpoint, err))
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s protocol must be (http|https)", endpoint))
+	}
+
+	// step: check for empty hosts
+	if u.Host == "" || u.Hostname() == "" {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s must have a host", endpoint))
+	}
+	// step: check for a dangling port separator i.e. http://host:
+	if strings.HasSuffix(u.Host, ":") {
+		return nil, errors.New(fmt.Sprintf("endpoint: %s has an empty port", endpoint))
+	}
+
+	return u, nil
+}
+
+// newMember creates a member for a normalized endpoint
+func (c *cluster) newMember(endpoint string) *member {
+	weight, found := c.weights[endpoint]
+	if !found {
+		weight = defaultMemberWeight
+	}
+
+	n := &member{
+		endpoint: endpoint,
+		region:   c.regions[endpoint],
+		tier:     c.tiers[endpoint],
+		tags:     c.tags[endpoint],
+		weight:   weight,
+		since:    time.Now(),
+		removed:  make(chan struct{}),
+	}
+	c.reannotate(n, memberAnnotations{})
+	n.uptime = []statusSpan{{since: n.since, up: true}}
+	if settings, found := c.probes[endpoint]; found {
+		n.probe = &settings
+	}
+
+	return n
+}
+
+// DurationInCurrentState returns for how long the member has had its current status, i.e. how
+// long it has been down, or ErrUnknownMember when the endpoint isn't one
+func (c *cluster) DurationInCurrentState(endpoint string) (time.Duration, error) {
+	c.RLock()
+	defer c.RUnlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return 0, ErrUnknownMember
+	}
+
+	return time.Since(n.since), nil
+}
+
+// trackRedirect adds the host the request to the endpoint was redirected to as a member, see
+// WithRedirectMembers. The expired members added by redirects are removed meanwhile
+func (c *cluster) trackRedirect(endpoint string, redirected *url.URL) {
+	if c.config.redirectTTL <= 0 || c.config.maxRedirectMembers <= 0 || redirected == nil {
+		return
+	}
+	u, err := parseEndpoint(redirected.Scheme+"://"+redirected.Host, c.defaultProto, c.config.defaultPorts)
+	if err != nil || u.String() == endpoint {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if n := c.findMember(u.String()); n != nil {
+		if !n.expires.IsZero() {
+			n.expires = now.Add(c.config.redirectTTL)
+		}
+		return
+	}
+	// step: remove the expired members and make room for the new one
+	var members, redirects []*member
+	for _, n := range c.members {
+		if !n.expires.IsZero() && now.After(n.expires) {
+			close(n.removed)
+			continue
+		}
+		members = append(members, n)
+		if !n.expires.IsZero() {
+			redirects = append(redirects, n)
+		}
+	}
+	if len(redirects) >= c.config.maxRedirectMembers {
+		oldest := redirects[0]
+		for _, n := range redirects[1:] {
+			if n.expires.Before(oldest.expires) {
+				oldest = n
+			}
+		}
+		close(oldest.removed)
+		for i, n := range members {
+			if n == oldest {
+				members = append(members[:i], members[i+1:]...)
+				break
+			}
+		}
+	}
+	n := c.newMember(u.String())
+	n.expires = now.Add(c.config.redirectTTL)
+	c.members = append(members, n)
+	c.logf("cluster: added member %s redirected to from %s\n", n.endpoint, endpoint)
+	c.notifyChanged()
+}
+
+// SetMemberWeight changes the weight of the member used by the weighted selector, the change
+// applies to the next selection. Setting it back to the default of 1 restores an equal share
+func (c *cluster) SetMemberWeight(endpoint string, weight int) error {
+	if weight < 0 {
+		return errors.New(fmt.Sprintf("weight: %d can not be negative", weight))
+	}
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return errors.New(fmt.Sprintf("endpoint: %s is not a member", endpoint))
+	}
+	n.weight = weight
+	c.notifyChanged()
+
+	return nil
+}
+
+// TestEndpoint validates the endpoint like SetMembers does and performs a liveness check on it
+// with the client and health check settings of the cluster, without adding it as a member, i.e.
+// to pre-flight a discovered master. An endpoint passing it can be given to SetMembers, short
+// of exceeding WithMaxMembers along with the others. The members aren't changed
+func (c *cluster) TestEndpoint(ctx context.Context, endpoint string) error {
+	c.RLock()
+	list, _, _, err := parseEndpoints(c.config, []string{endpoint}, c.defaultProto)
+	if err != nil {
+		c.RUnlock()
+		return err
+	}
+	candidate := c.newMember(list[0])
+	c.RUnlock()
+	_, err = c.probe(ctx, candidate, c.livenessPath(candidate))
+
+	return err
+}
+
+// SetMembers replaces the members of the cluster with the endpoints, keeping the status of the
+// members which remain, adding the new ones as up and stopping the health checks of the removed
+// ones. A member which remains takes the annotations of its endpoint, the settings it's no longer
+// annotated with return to the options. The change is applied at once, concurrent callers see
+// either the old or the new members
+func (c *cluster) SetMembers(endpoints []string) error {
+	if len(endpoints) == 0 {
+		return errors.New("no endpoints specified")
+	}
+	c.Lock()
+	defer c.Unlock()
+	list, annotations, _, err := parseEndpoints(c.config, endpoints, c.defaultProto)
+	if err != nil {
+		return err
+	}
+	c.replaceMembers(list, annotations)
+
+	return nil
+}
+
+// replaceMembers replaces the members with the endpoints, keeping the state of the ones already
+// members. The caller must hold the write lock
+func (c *cluster) replaceMembers(list []string, annotations map[string]memberAnnotations) {
+	previous := c.annotations
+	c.annotate(annotations)
+
+	current := make(map[string]*member)
+	for _, n := range c.members {
+		current[n.endpoint] = n
+	}
+	var members []*member
+	for _, endpoint := range list {
+		if n, found := current[endpoint]; found {
+			c.reannotate(n, previous[endpoint])
+			members = append(members, n)
+			delete(current, endpoint)
+			continue
+		}
+		members = append(members, c.newMember(endpoint))
+	}
+	// step: stop the health checks of the members which are gone
+	for _, n := range current {
+		close(n.removed)
+	}
+	c.members = members
+	c.notifyChanged()
+}
+
+// normalizeEndpoint returns the canonical form of the endpoint which identifies a member, the
+// protocol schema and host are lower cased, trailing slashes removed and the default protocol
+// schema and the default port of the protocol schema applied when it has none
+func normalizeEndpoint(endpoint, defaultProto string, ports map[string]int) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// step: a protocol-relative endpoint i.e. //host:port only lacks the protocol schema
+	if u.Scheme == "" && u.Host != "" {
+		u.Scheme = defaultProto
+	} else if u.Scheme == "" || u.Opaque != "" {
+		if u, err = url.Parse(fmt.Sprintf("%s://%s", defaultProto, u.String())); err != nil {
+			return nil, err
+		}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	// step: add the default port of the scheme when there's none, a dangling separator is kept
+	if port, found := ports[u.Scheme]; found && u.Port() == "" && u.Hostname() != "" && !strings.HasSuffix(u.Host, ":") {
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+
+	return u, nil
+}
+
+// joinURL returns the url of the path on the normalized endpoint, the single place the urls of
+// the requests are built
+func joinURL(endpoint, path string) string {
+	return endpoint + "/" + strings.TrimLeft(path, "/")
+}
+
+// ResolveURL returns the url a request for the path would be sent to, i.e. on the member
+// getMember currently chooses, or ErrSwanDown when no member is up
+func (c *cluster) ResolveURL(path string) (string, error) {
+	endpoint, err := c.getMember()
+	if err != nil {
+		return "", err
+	}
+
+	return joinURL(endpoint, path), nil
+}
+
+// PrepareRequest returns a clone of the request targeted at the member getMember currently
+// chooses, i.e. for a request built against a placeholder base url and sent by the caller. The
+// scheme and host of the url are the ones of the member and its base path is prepended to the
+// path, the method, headers and body are left as they are. A body which can't be rewound is read
+// into memory, so both the request and the clone can be sent. It returns ErrSwanDown when no
+// member is up
+func (c *cluster) PrepareRequest(request *http.Request) (*http.Request, error) {
+	endpoint, err := c.getMember()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// step: make the body rewindable, the clone gets a reader of its own
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		content, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		request.Body, _ = request.GetBody()
+	}
+	clone := request.Clone(request.Context())
+	if request.GetBody != nil {
+		if clone.Body, err = request.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	// step: rewrite the url to the member, the host header follows it
+	clone.URL.Scheme = u.Scheme
+	clone.URL.Host = u.Host
+	clone.URL.Path = joinURL(u.Path, request.URL.Path)
+	if request.URL.RawPath != "" {
+		clone.URL.RawPath = joinURL(u.EscapedPath(), request.URL.RawPath)
+	}
+	clone.Host = ""
+
+	return clone, nil
+}
+
+// findMember returns the member for a loosely formatted endpoint, the caller must hold the lock
+func (c *cluster) findMember(endpoint string) *member {
+	u, err := normalizeEndpoint(strings.TrimSpace(endpoint), c.defaultProto, c.config.defaultPorts)
+	if err != nil {
+		return nil
+	}
+	for _, n := range c.members {
+		if n.endpoint == u.String() {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// FindMember returns the endpoint of the member matching a loosely formatted endpoint, i.e.
+// with a different case, a trailing slash or without the protocol schema
+func (c *cluster) FindMember(endpoint string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if n := c.findMember(endpoint); n != nil {
+		return n.endpoint, true
+	}
+
+	return "", false
+}
+
+// hasDuplicateScheme checks if the endpoint repeats the protocol schema after the first one
+func hasDuplicateScheme(endpoint string) bool {
+	i := strings.Index(endpoint, "://")
+	if i < 0 {
+		return false
+	}
+	rest := strings.ToLower(endpoint[i+len("://"):])
+	for _, scheme := range []string{"http:", "https:"} {
+		if strings.HasPrefix(rest, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retrieve the current member, i.e. the current endpoint in use. It fails fast
+// with ErrSwanDown when no member is up, see getMemberBlocking for waiting instead
+func (c *cluster) getMember() (string, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.selectMember()
+}
+
+// getMemberBlocking retrieves the current member like getMember, but when all the members
+// are down it waits for one of them to be recovered by the health checks rather than
+// returning ErrSwanDown. It returns the context error if the context is done first
+func (c *cluster) getMemberBlocking(ctx context.Context) (string, error) {
+	for {
+		c.RLock()
+		endpoint, err := c.selectMember()
+		changed := c.changed
+		c.RUnlock()
+		if err == nil {
+			return endpoint, nil
+		}
+		if err == ErrObserverMode || err == ErrShuttingDown {
+			return "", err
+		}
+		// step: wait for a status change and try again
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// WaitForQuorum blocks until the members up reach the ping quorum, all of them unless one is set
+// with WithPingQuorum, i.e. before the leader operations of a bootstrap. Unlike the requests,
+// which wait for a single member to be up, it needs the whole quorum. It wakes up on the status
+// changes of the members rather than polling, returns the context error if the context is done
+// first and ErrShuttingDown once the cluster is closed
+func (c *cluster) WaitForQuorum(ctx context.Context) error {
+	for {
+		c.RLock()
+		quorum := c.config.pingQuorum
+		if quorum == 0 {
+			quorum = len(c.members)
+		}
+		up := 0
+		for _, n := range c.members {
+			if n.status == memberStatusUp {
+				up++
+			}
+		}
+		changed := c.changed
+		c.RUnlock()
+		if up >= quorum {
+			return nil
+		}
+		// step: wait for a status change and count again
+		select {
+		case <-changed:
+		case <-c.done:
+			return ErrShuttingDown
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// selectMember returns the member chosen by the selector among the ones which are up, honouring
+// the region affinity when configured. The caller must hold the lock
+func (c *cluster) selectMember() (string, error) {
+	n, err := c.selectNode("")
+	if err != nil {
+		return "", err
+	}
+
+	return n.endpoint, nil
+}
+
+// selectNode chooses the member with the selector among the ones which are up and not at the
+// maximum in-flight requests, or by hashing the sticky key when given. It must be called with
+// the lock held
+func (c *cluster) selectNode(stickyKey string) (*member, error) {
+	if c.shuttingDown {
+		return nil, ErrShuttingDown
+	}
+	if c.config.observeInterval > 0 {
+		return nil, ErrObserverMode
+	}
+	if c.pinned != nil {
+		return c.selectPinned()
+	}
+	var candidates []*member
+	saturated := false
+	now := time.Now()
+	// step: the fallback members are left out while any other member is up
+	primaryUp := false
+	for _, n := range c.members {
+		if n.status == memberStatusUp && !n.fallback && (n.expires.IsZero() || !now.After(n.expires)) {
+			primaryUp = true
+			break
+		}
+	}
+	// step: then the members of the higher tiers while any of a lower one is up
+	tier := -1
+	for _, n := range c.members {
+		if n.status == memberStatusUp && (n.expires.IsZero() || !now.After(n.expires)) && !(n.fallback && primaryUp) &&
+			(tier < 0 || n.tier < tier) {
+			tier = n.tier
+		}
+	}
+	for _, n := range c.members {
+		if n.status != memberStatusUp || (!n.expires.IsZero() && now.After(n.expires)) || (n.fallback && primaryUp) ||
+			n.tier != tier {
+			continue
+		}
+		if c.config.maxInFlight > 0 && atomic.LoadInt64(&n.inFlight) >= int64(c.config.maxInFlight) {
+			saturated = true
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	if len(candidates) == 0 {
+		if saturated {
+			return nil, ErrSaturated
+		}
+		return nil, ErrSwanDown
+	}
+	if c.config.region != "" {
+		candidates = c.regionCandidates(candidates)
+	}
+	if c.config.failurePenaltyWindow > 0 {
+		candidates = c.penaltyCandidates(candidates, now)
+	}
+
+	var chosen *member
+	strategy := c.config.selector.Name()
+	if stickyKey != "" {
+		chosen, strategy = stickyCandidate(candidates, stickyKey), "sticky"
+	} else {
+		chosen = c.config.selector.Select(candidates)
+	}
+
+	return c.recordSelection(chosen, strategy), nil
+}
+
+// selectPinned returns the pinned member whatever its health, unless it's down or was removed
+func (c *cluster) selectPinned() (*member, error) {
+	select {
+	case <-c.pinned.removed:
+		return nil, ErrUnknownMember
+	default:
+	}
+	if c.pinned.status == memberStatusDown {
+		return nil, ErrSwanDown
+	}
+
+	return c.recordSelection(c.pinned, "pinned"), nil
+}
+
+// recordSelection counts the selection of the member with the strategy
+func (c *cluster) recordSelection(chosen *member, strategy string) *member {
+	atomic.AddInt64(&chosen.selections, 1)
+	atomic.StoreUint64(&chosen.lastSelection, atomic.AddUint64(&c.selectionSequence, 1))
+	if c.config.traceSelections {
+		c.config.logger.Printf("cluster: selected member %s, strategy: %s\n", chosen.endpoint, strategy)
+	}
+
+	return chosen
+}
+
+// PinEndpoint sends every request to the member, bypassing the selector, the health of the member
+// and the other strategies until Unpin, i.e. to reproduce a bug tied to a master. It's a debugging
+// aid not meant for production, a warning is logged and Members reports the member as pinned.
+// The requests only fail while the member is down, or once it's removed. It fails with
+// ErrUnknownMember when the endpoint isn't a member
+func (c *cluster) PinEndpoint(endpoint string) error {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return ErrUnknownMember
+	}
+	c.pinned = n
+	c.logf("cluster: warning, every request is pinned to member %s for debugging, see Unpin\n", n.endpoint)
+
+	return nil
+}
+
+// SetMemberTags replaces the tags of the member, i.e. its rack or build version, reported in the
+// snapshots and the events of the member for correlating them with the infrastructure. The tags
+// are opaque to the selection, nil or empty tags remove them. It returns ErrUnknownMember when
+// the endpoint isn't a member
+func (c *cluster) SetMemberTags(endpoint string, tags map[string]string) error {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return ErrUnknownMember
+	}
+	n.tags = copyTags(tags)
+	if n.tags == nil {
+		delete(c.tags, n.endpoint)
+	} else {
+		c.tags[n.endpoint] = n.tags
+	}
+
+	return nil
+}
+
+// copyTags returns a copy of the tags, nil when there are none
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+// Unpin returns to the usual selection of the members after PinEndpoint
+func (c *cluster) Unpin() {
+	c.Lock()
+	defer c.Unlock()
+	if c.pinned != nil {
+		c.logf("cluster: member %s is no longer pinned\n", c.pinned.endpoint)
+	}
+	c.pinned = nil
+}
+
+// SelectionState returns the state of the selector, i.e. the selections the weighted one made so
+// far, false when the selector keeps none
+func (c *cluster) SelectionState() (uint64, bool) {
+	selector, ok := c.config.selector.(StatefulSelector)
+	if !ok {
+		return 0, false
+	}
+
+	return selector.State(), true
+}
+
+// ResetSelection sets the state of the selector, i.e. zero makes the weighted one start over from
+// the first member. It's an advanced knob for deterministic tests or to re-baseline the traffic
+// after a topology change, the concurrent selections carry on from the new state. It fails when
+// the selector keeps no state
+func (c *cluster) ResetSelection(state uint64) error {
+	selector, ok := c.config.selector.(StatefulSelector)
+	if !ok {
+		return errors.New(fmt.Sprintf("selector: %s keeps no state", c.config.selector.Name()))
+	}
+	selector.Reset(state)
+
+	return nil
+}
+
+// acquireMember selects a member like getMember, or by the sticky key when given, and counts a
+// request in flight to it, which must be released once completed. Depending on WithMaxInFlight
+// it waits when saturated, and depending on WithWaitForMember or the context when no member is
+// up, until the context expires
+func (c *cluster) acquireMember(ctx context.Context, stickyKey string) (string, error) {
+	for {
+		c.RLock()
+		n, err := c.selectNode(stickyKey)
+		changed := c.changed
+		c.RUnlock()
+		if (err == ErrSaturated && c.config.waitWhenSaturated) || (err == ErrSwanDown && c.waitsForMember(ctx)) {
+			select {
+			case <-changed:
+			case <-c.done:
+				return "", err
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// step: another request may have taken the last slot since the selection
+		if c.acquire(n) {
+			return n.endpoint, nil
+		}
+	}
+}
+
+// waitForMemberKey is the key of the context value overriding WithWaitForMember
+type waitForMemberKey struct{}
+
+// WaitForMember returns a context whose requests wait for a member to be up, or fail straight
+// away with ErrSwanDown when wait is false, whatever WithWaitForMember says. It's given to the
+// calls with ForContext, the override of the call taking precedence over the default of the client
+func WaitForMember(ctx context.Context, wait bool) context.Context {
+	return context.WithValue(ctx, waitForMemberKey{}, wait)
+}
+
+// waitsForMember checks if a request with the context waits for a member to be up
+func (c *cluster) waitsForMember(ctx context.Context) bool {
+	if wait, found := ctx.Value(waitForMemberKey{}).(bool); found {
+		return wait
+	}
+
+	return c.config.waitForMember
+}
+
+// acquire counts a request in flight to the node unless it's at the maximum
+func (c *cluster) acquire(n *member) bool {
+	for {
+		current := atomic.LoadInt64(&n.inFlight)
+		if c.config.maxInFlight > 0 && current >= int64(c.config.maxInFlight) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&n.inFlight, current, current+1) {
+			return true
+		}
+	}
+}
+
+// release counts a request to the endpoint as completed, waking the requests waiting for room
+// when the member was at the maximum, or Shutdown
+func (c *cluster) release(endpoint string) {
+	c.RLock()
+	n := c.findMember(endpoint)
+	shuttingDown := c.shuttingDown
+	var drained bool
+	if n != nil {
+		drained = n.drained
+	}
+	c.RUnlock()
+	if n == nil {
+		return
+	}
+	remaining := atomic.AddInt64(&n.inFlight, -1)
+	if shuttingDown || drained || (c.config.maxInFlight > 0 && remaining+1 >= int64(c.config.maxInFlight)) {
+		c.Lock()
+		c.notifyChanged()
+		c.Unlock()
+	}
+}
+
+// PrimaryEndpoint returns the endpoint getMember currently chooses, i.e. for an external proxy
+// which needs a single one. Note a strategy spreading the requests, like the weighted one,
+// counts this as a selection
+func (c *cluster) PrimaryEndpoint() (string, error) {
+	return c.getMember()
+}
+
+// WatchPrimary returns a channel receiving the primary endpoint whenever it changes, an empty
+// one when no member is up. Only the latest recommendation is kept for a slow receiver and the
+// channel is closed along with the cluster
+func (c *cluster) WatchPrimary() <-chan string {
+	ch := make(chan string, 1)
+	c.RLock()
+	last, _ := c.selectMember()
+	changed := c.changed
+	c.RUnlock()
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-changed:
+			}
+			c.RLock()
+			primary, _ := c.selectMember()
+			changed = c.changed
+			c.RUnlock()
+			if primary == last {
+				continue
+			}
+			last = primary
+			// step: replace a recommendation which wasn't received yet
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- primary
+		}
+	}()
+
+	return ch
+}
+
+// stickyCandidate chooses the candidate of the key by rendezvous hashing, the key always maps
+// to the same member as long as it's a candidate, and the keys of a member which is no longer
+// one are spread over the others
+func stickyCandidate(candidates []*member, key string) *member {
+	var chosen *member
+	var highest uint64
+	for _, n := range candidates {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte(n.endpoint))
+		if sum := hash.Sum64(); chosen == nil || sum > highest {
+			chosen, highest = n, sum
+		}
+	}
+
+	return chosen
+}
+
+// stickyKey returns the value of the sticky header for a request with the method to the uri,
+// as added by the request decorator, empty when sticky selection is disabled
+func (c *cluster) stickyKey(method, uri string) string {
+	if c.config.stickyHeader == "" {
+		return ""
+	}
+	request, err := http.NewRequest(method, "http://sticky/"+uri, nil)
+	if err != nil || c.decorate(request) != nil {
+		return ""
+	}
+
+	return request.Header.Get(c.config.stickyHeader)
+}
+
+// regionCandidates narrows the candidates down to either the local or the remote region,
+// picking the remote one with a share of the traffic reduced by the region penalty
+func (c *cluster) regionCandidates(candidates []*member) []*member {
+	var local, remote []*member
+	for _, n := range candidates {
+		if n.region == "" || n.region == c.config.region {
+			local = append(local, n)
+		} else {
+			remote = append(remote, n)
+		}
+	}
+	if len(local) == 0 {
+		return remote
+	}
+	// step: weigh the remote members down against the local ones
+	remoteWeight := float64(len(remote)) * (1 - c.config.regionPenalty)
+	if remoteWeight > 0 && c.random.Float64()*(float64(len(local))+remoteWeight) >= float64(len(local)) {
+		return remote
+	}
+
+	return local
+}
+
+// penaltyCandidates leaves out the members which failed a request within the penalty window, each
+// one is kept with a chance growing from none right after the failure to certain at the end of
+// the window. When all of them would be left out the candidates are returned as they are
+func (c *cluster) penaltyCandidates(candidates []*member, now time.Time) []*member {
+	var kept []*member
+	for _, n := range candidates {
+		elapsed := now.Sub(n.lastFailure)
+		if n.lastFailure.IsZero() || elapsed >= c.config.failurePenaltyWindow ||
+			c.random.Float64() < float64(elapsed)/float64(c.config.failurePenaltyWindow) {
+			kept = append(kept, n)
+		}
+	}
+	if len(kept) == 0 {
+		return candidates
+	}
+
+	return kept
+}
+
+// notifyChanged wakes up anyone waiting on a status change, the caller must hold the write lock
+func (c *cluster) notifyChanged() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.watchAvailability()
+}
+
+// watchAvailability schedules a check of the availability once a member came up in a cluster
+// fully down or the last one went down, the caller must hold the write lock
+func (c *cluster) watchAvailability() {
+	if c.config.availability == nil || c.availabilityTimer != nil {
+		return
+	}
+	if c.anyUp() == c.available {
+		return
+	}
+	c.availabilityTimer = time.AfterFunc(c.config.availabilityDebounce, c.reportAvailability)
+}
+
+// anyUp checks if any member is up, the caller must hold the lock
+func (c *cluster) anyUp() bool {
+	for _, m := range c.members {
+		if m.status == memberStatusUp {
+			return true
+		}
+	}
+	return false
+}
+
+// reportAvailability invokes the availability callback when the availability still differs from
+// the one reported last, a change reverted within the debounce isn't reported
+func (c *cluster) reportAvailability() {
+	c.availabilityMu.Lock()
+	defer c.availabilityMu.Unlock()
+	c.Lock()
+	c.availabilityTimer = nil
+	available := c.anyUp()
+	changed := available != c.available
+	c.available = available
+	c.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if changed {
+		c.config.availability(available)
+	}
+}
+
+// setStatus changes the status of the member, recording why unless it's up, and wakes up anyone
+// waiting on a status change. The caller must hold the write lock
+func (c *cluster) setStatus(n *member, status memberStatus, reason string) {
+	now := time.Now()
+	if status == memberStatusUp {
+		// step: a quarantined member stays down until the cooldown is over, an expired one until
+		// the delay is, a drained one until it's undrained
+		if now.Before(n.quarantinedUntil) || now.Before(n.expiredUntil) || n.drained {
+			return
+		}
+		n.quarantinedUntil = time.Time{}
+		reason = ""
+		// step: a member back up starts over with a clean error rate
+		n.outcomes = nil
+		n.nextOutcome = 0
+		n.failures = 0
+	}
+	changed, quarantined, wasUp := n.status != status, false, c.anyUp()
+	if changed {
+		n.since = now
+		n.probePasses, n.probeFailures = 0, 0
+		recordUptime(n, status == memberStatusUp, now)
+		if c.flapping(n, now) && status != memberStatusUp {
+			quarantined = true
+			n.quarantinedUntil = now.Add(c.config.flapCooldown)
+			n.transitions = nil
+			if reason != "" {
+				reason = fmt.Sprintf("quarantined for %s after flapping: %s", c.config.flapCooldown, reason)
+			} else {
+				reason = fmt.Sprintf("quarantined for %s after flapping", c.config.flapCooldown)
+			}
+		}
+	}
+	n.status = status
+	n.reason = reason
+	if reason != "" {
+		c.logf("cluster: member %s is %s, reason: %s\n", n.endpoint, status, reason)
+	} else {
+		c.logf("cluster: member %s is %s\n", n.endpoint, status)
+	}
+	c.notifyChanged()
+	if changed {
+		c.publish(ClusterEvent{Type: statusEvent(status, quarantined), Endpoint: n.endpoint, Tags: copyTags(n.tags),
+			Reason: reason, Time: now})
+		if up := c.anyUp(); up != wasUp {
+			event := ClusterEventClusterRecovered
+			if !up {
+				event = ClusterEventClusterDown
+			}
+			c.publish(ClusterEvent{Type: event, Time: now})
+		}
+	}
+}
+
+// flapping records a status change of the member and checks if it changed more than the
+// transitions allowed within the flap window, it must be called with the lock held
+func (c *cluster) flapping(n *member, now time.Time) bool {
+	if c.config.flapTransitions == 0 {
+		return false
+	}
+	transitions := n.transitions[:0]
+	for _, t := range n.transitions {
+		if now.Sub(t) < c.config.flapWindow {
+			transitions = append(transitions, t)
+		}
+	}
+	n.transitions = append(transitions, now)
+
+	return len(n.transitions) > c.config.flapTransitions
+}
+
+// markDown marks down the current endpoint
+func (c *cluster) markDown(endpoint string) {
+	c.markDownReason(endpoint, "")
+}
+
+// markDownReason marks down the current endpoint, recording why for the snapshots until it
+// recovers, i.e. "dial timeout", "503 from gateway" or "manual"
+func (c *cluster) markDownReason(endpoint, reason string) {
+	c.Lock()
+	defer c.Unlock()
+	// step: check if this is the node and it's marked as up - The double  checking on the
+	// nodes status ensures the multiple calls don't create multiple checks
+	if n := c.findMember(endpoint); n != nil && n.status == memberStatusUp && !c.keepUp(n, reason) {
+		c.setStatus(n, memberStatusDown, reason)
+		c.startHealthCheck(n)
+	}
+}
+
+// keepUp checks if the node must stay up rather than be marked down for the reason, as one of
+// the minimum members which are up. It must be called with the write lock held
+func (c *cluster) keepUp(n *member, reason string) bool {
+	if c.config.minUpMembers <= 0 {
+		return false
+	}
+	up := 0
+	for _, m := range c.members {
+		if m.status == memberStatusUp {
+			up++
+		}
+	}
+	if up > c.config.minUpMembers {
+		return false
+	}
+	c.logf("cluster: keeping member %s up as one of the last %d, reason: %s\n", n.endpoint, up, reason)
+
+	return true
+}
+
+// marksDown checks if an answer with the 5xx status marks the member down
+func (c *cluster) marksDown(statusCode int) bool {
+	for _, status := range c.config.markDownStatuses {
+		if status == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markFailure records a failed request to the endpoint, marking it down straight away or, when
+// an error rate is configured, once the recent requests failed too often
+func (c *cluster) markFailure(endpoint, reason string) {
+	if c.config.errorRateWindow == 0 {
+		c.recordFailure(endpoint)
+		c.markDownReason(endpoint, reason)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil || n.status != memberStatusUp {
+		return
+	}
+	if c.config.failurePenaltyWindow > 0 {
+		n.lastFailure = time.Now()
+	}
+	c.recordOutcome(n, true)
+	if len(n.outcomes) == c.config.errorRateWindow &&
+		float64(n.failures)/float64(len(n.outcomes)) > c.config.errorRate {
+		reason = fmt.Sprintf("%d of the last %d requests failed, last error: %s", n.failures, len(n.outcomes), reason)
+		if !c.keepUp(n, reason) {
+			c.setStatus(n, memberStatusDown, reason)
+			c.startHealthCheck(n)
+		}
+	}
+}
+
+// recordFailure notes the time of the failed request to the endpoint for the failure penalty
+func (c *cluster) recordFailure(endpoint string) {
+	if c.config.failurePenaltyWindow == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if n := c.findMember(endpoint); n != nil {
+		n.lastFailure = time.Now()
+	}
+}
+
+// recordOutcome adds the outcome of a request to the window of the node, evicting the oldest
+// once full. It's a no-op without an error rate and must be called with the lock held
+func (c *cluster) recordOutcome(n *member, failed bool) {
+	if c.config.errorRateWindow == 0 {
+		return
+	}
+	if len(n.outcomes) < c.config.errorRateWindow {
+		n.outcomes = append(n.outcomes, failed)
+	} else {
+		if n.outcomes[n.nextOutcome] {
+			n.failures--
+		}
+		n.outcomes[n.nextOutcome] = failed
+		n.nextOutcome = (n.nextOutcome + 1) % len(n.outcomes)
+	}
+	if failed {
+		n.failures++
+	}
 }
 
-// member represents an individual endpoint
-type member struct {
-	// the name / ip address of the host
-	endpoint string
-	// the status of the host
-	status memberStatus
+// idempotencyKey returns a new idempotency key for a request with the method, empty when the
+// header isn't configured or the method is a read
+func (c *cluster) idempotencyKey(method string) string {
+	if c.config.idempotencyHeader == "" || !isWrite(method) {
+		return ""
+	}
+	if c.config.newIdempotencyKey != nil {
+		return c.config.newIdempotencyKey()
+	}
+	key := make([]byte, 16)
+	if _, err := crand.Read(key); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(key)
 }
 
-// newCluster returns a new swan cluster
-func newCluster(client *http.Client, swanURL string) (*cluster, error) {
-	// step: extract and basic validate the endpoints
-	var members []*member
-	var defaultProto string
+// shouldMarkDown checks with the failure filter if a request failure should mark the member down
+func (c *cluster) shouldMarkDown(endpoint string, err error) bool {
+	if c.config.failureFilter == nil {
+		return true
+	}
+
+	return c.config.failureFilter(endpoint, err)
+}
+
+// injectFailure fails the request to the endpoint on purpose according to the chaos rates
+func (c *cluster) injectFailure(endpoint string) error {
+	if len(c.chaosRates) == 0 {
+		return nil
+	}
+	if rate, found := c.chaosRates[endpoint]; found && c.random.Float64() < rate {
+		return ErrInjectedFailure
+	}
+
+	return nil
+}
 
-	for _, endpoint := range strings.Split(swanURL, ",") {
-		// step: check for nothing
-		if endpoint == "" {
-			return nil, errors.New("endpoint is blank")
+// markDraining takes the endpoint out of rotation while it is in maintenance, unlike markDown
+// this is an expected state and the node is brought back by the next healthy check
+func (c *cluster) markDraining(endpoint string) {
+	c.Lock()
+	defer c.Unlock()
+	if n := c.findMember(endpoint); n != nil && n.status == memberStatusUp {
+		c.setStatus(n, memberStatusDraining, "maintenance")
+		c.startHealthCheck(n)
+	}
+}
+
+// inMaintenance checks if the response signals the master is in maintenance
+func (c *cluster) inMaintenance(res *http.Response) bool {
+	if c.config.maintenanceStatusCode != 0 && res.StatusCode == c.config.maintenanceStatusCode {
+		return true
+	}
+
+	return c.config.maintenanceHeader != "" && res.Header.Get(c.config.maintenanceHeader) != ""
+}
+
+// decorate sets the auth token and applies the request decorator if they're configured
+func (c *cluster) decorate(request *http.Request) error {
+	if err := c.authorize(request); err != nil {
+		return err
+	}
+	if c.config.requestDecorator == nil {
+		return nil
+	}
+
+	return c.config.requestDecorator(request)
+}
+
+// confirmRecovery performs the checks a node passing the liveness check must pass as well to be
+// marked up, the secondary recovery check and the version check when they're configured
+func (c *cluster) confirmRecovery(ctx context.Context, node *member) error {
+	if c.config.recoveryPath != "" {
+		if _, err := c.probe(ctx, node, c.config.recoveryPath); err != nil {
+			return err
 		}
-		// step: parse the url
-		u, err := url.Parse(endpoint)
-		if err != nil {
-			return nil, errors.New(fmt.Sprintf("endpoint: %s is invalid reason: %s", endpoint, err))
+	}
+
+	return c.checkVersion(node)
+}
+
+// livenessPath returns the path of the liveness check of the node
+func (c *cluster) livenessPath(node *member) string {
+	if node.probe != nil && node.probe.Path != "" {
+		return node.probe.Path
+	}
+
+	return c.config.livenessPath
+}
+
+// passes checks if the status code answered to a liveness check of the member passes
+func (m *member) passes(statusCode int) bool {
+	if m.probe == nil || len(m.probe.StatusCodes) == 0 {
+		return statusCode == 200
+	}
+	for _, code := range m.probe.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeNode performs a single liveness check on the node, we are assuming a /ping is enough here.
+// It's aborted once the cluster is closed or the node removed
+func (c *cluster) probeNode(node *member) error {
+	ctx, cancel := c.checkContext(node, nil)
+	defer cancel()
+	_, err := c.probe(ctx, node, c.livenessPath(node))
+
+	return err
+}
+
+// countProbe records the outcome of a liveness check of the node, returning the checks in a row
+// with the same outcome since its status changed. The caller must hold the write lock
+func (n *member) countProbe(passed bool) int {
+	if passed {
+		n.probePasses, n.probeFailures = n.probePasses+1, 0
+		return n.probePasses
+	}
+	n.probeFailures, n.probePasses = n.probeFailures+1, 0
+
+	return n.probeFailures
+}
+
+// probePassed records a passed liveness check of the node, checking if it passed enough of them
+// in a row to recover
+func (c *cluster) probePassed(n *member) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return n.countProbe(true) >= c.config.recoveryThreshold
+}
+
+// probeFailed records a failed liveness check of the node, checking if it failed enough of them
+// in a row to be marked down
+func (c *cluster) probeFailed(n *member) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return n.countProbe(false) >= c.config.failureThreshold
+}
+
+// checkContext returns the context of a background check of the node, cancelled once the cluster
+// is closed, the node removed or the refresh channel closed, so the check in flight against a
+// hung node is aborted rather than waiting for the timeout of the client. The channel may be nil
+func (c *cluster) checkContext(node *member, refresh chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.done:
+		case <-node.removed:
+		case <-refresh:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+// probe performs a single health check of the path on the node, returning whether the node
+// answered at all along with the reason it isn't healthy
+func (c *cluster) probe(ctx context.Context, node *member, path string) (bool, error) {
+	build := c.config.probeRequestBuilder
+	if build == nil {
+		build = c.probeRequest
+	}
+	request, err := build(ctx, node.endpoint, path)
+	if err != nil {
+		return false, err
+	}
+	if err := c.decorate(request); err != nil {
+		// step: a token which can't be refreshed is an auth failure rather than one of the node
+		if errors.Is(err, ErrTokenRefresh) {
+			return false, fmt.Errorf("%w: %w", ErrProbeUnauthorized, err)
+		}
+		return false, err
+	}
+	atomic.AddInt64(&node.probes, 1)
+	started := time.Now()
+	statusCode, err := c.sendProbe(node, request)
+
+	c.Lock()
+	defer c.Unlock()
+	node.lastProbe = &ProbeResult{Time: time.Now(), StatusCode: statusCode}
+	node.lastProbe.Latency = node.lastProbe.Time.Sub(started)
+	if err == nil {
+		node.lastSuccess = node.lastProbe.Time
+		node.everSucceeded = true
+		return true, nil
+	}
+	// step: tell the host not answering apart from the one answering as unhealthy
+	failure := ProbeResponseFailure
+	if statusCode == 0 {
+		failure = ProbeConnectionFailure
+		node.connectionFailures++
+	} else {
+		node.responseFailures++
+	}
+	node.lastProbe.Error = err.Error()
+	node.lastProbe.Failure = failure
+
+	return statusCode != 0, &ProbeError{Failure: failure, Err: err}
+}
+
+// probeRequest builds the health check request of the endpoint from the settings of the cluster,
+// by default a GET on the path
+func (c *cluster) probeRequest(ctx context.Context, endpoint, path string) (*http.Request, error) {
+	var body io.Reader
+	if c.config.probeBody != nil {
+		body = bytes.NewReader(c.config.probeBody)
+	}
+	request, err := http.NewRequestWithContext(ctx, c.config.probeMethod, joinURL(endpoint, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.probeBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Close = c.config.probeConnectionClose
+
+	return request, nil
+}
+
+// sendProbe sends the health check request of the node, returning the status code it answered
+// with, zero when it didn't, along with the reason it isn't healthy
+func (c *cluster) sendProbe(node *member, request *http.Request) (int, error) {
+	res, err := c.probeClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	passes := node.passes(res.StatusCode)
+	if !passes && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+		if c.config.probeAuthFailure != nil {
+			c.config.probeAuthFailure(node.endpoint, res.StatusCode)
+		}
+		return res.StatusCode, fmt.Errorf("%w, status: %d", ErrProbeUnauthorized, res.StatusCode)
+	}
+	if !passes {
+		return res.StatusCode, errors.New(fmt.Sprintf("health check returned status: %d", res.StatusCode))
+	}
+	if c.inMaintenance(res) {
+		return res.StatusCode, errors.New("health check reported maintenance")
+	}
+
+	return res.StatusCode, nil
+}
+
+// latencyWeight is the weight of the latest sample in the moving average of the latency
+const latencyWeight = 0.2
+
+// observeLatency folds the response latency of a request into the moving average of the
+// endpoint, the average is a single value so the memory used doesn't grow with the requests
+func (c *cluster) observeLatency(endpoint string, latency time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return
+	}
+	if n.latency == 0 {
+		n.latency = latency
+		return
+	}
+	n.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(n.latency))
+}
+
+// markSuccess records the endpoint answered a request successfully
+func (c *cluster) markSuccess(endpoint string) {
+	c.Lock()
+	defer c.Unlock()
+	if n := c.findMember(endpoint); n != nil {
+		n.lastSuccess = time.Now()
+		n.everSucceeded = true
+		c.recordOutcome(n, false)
+	}
+}
+
+// Ping performs a liveness check on all the members in parallel without changing their status.
+// It returns the outcome of the checks as a snapshot of the members taken when they started,
+// along with a *PingError with the failure of each member when fewer than the quorum passed,
+// see WithPingQuorum
+func (c *cluster) Ping(ctx context.Context) (PingResult, error) {
+	c.RLock()
+	members := append([]*member(nil), c.members...)
+	c.RUnlock()
+	result := PingResult{Members: len(members), Quorum: c.config.pingQuorum, Time: time.Now()}
+	if result.Quorum == 0 {
+		result.Quorum = len(members)
+	}
+	errs, latencies := c.probeTimed(ctx, members)
+	for i, n := range members {
+		result.Endpoints = append(result.Endpoints, EndpointReachability{
+			Endpoint:  n.endpoint,
+			Reachable: errs[i] == nil,
+			Latency:   latencies[i],
+			Err:       errs[i],
+		})
+		if errs[i] == nil {
+			result.Reachable++
 		}
-		// step: set the default protocol schema
-		if defaultProto == "" {
-			if u.Scheme != "http" && u.Scheme != "https" {
-				return nil, errors.New(fmt.Sprintf("endpoint: %s protocol must be (http|https)", endpoint))
+	}
+	result.Healthy = result.Reachable >= result.Quorum
+	if result.Healthy {
+		return result, nil
+	}
+
+	return result, newPingError(members, errs)
+}
+
+// RefreshNow re-evaluates the status of all the members at once, i.e. after a network event,
+// rather than waiting for the health checks. The pending health, readiness and observer checks
+// are woken up, and every member is probed in parallel: a down or draining member passing is
+// marked up, and a member which is up failing is marked down. The drained members are skipped,
+// see WithDrainedProbing. Once done it returns nil when all of them passed, otherwise a
+// *PingError with the failure of each member
+func (c *cluster) RefreshNow(ctx context.Context) error {
+	c.Lock()
+	close(c.refresh)
+	c.refresh = make(chan struct{})
+	members := append([]*member(nil), c.members...)
+	c.Unlock()
+
+	return c.refreshMembers(ctx, members)
+}
+
+// RefreshMembers re-evaluates the status of the members named at once like RefreshNow does for
+// all of them, i.e. when a topology watch reports a change to a few. The endpoints not matching a
+// member are ignored, unless WithStrictRefresh makes them fail with ErrUnknownMember before any
+// member is probed. It returns like RefreshNow for the members probed
+func (c *cluster) RefreshMembers(ctx context.Context, endpoints ...string) error {
+	var members []*member
+	seen := make(map[*member]bool)
+	c.RLock()
+	for _, endpoint := range endpoints {
+		n := c.findMember(endpoint)
+		if n == nil {
+			if c.config.strictRefresh {
+				c.RUnlock()
+				return fmt.Errorf("%w: %s", ErrUnknownMember, endpoint)
 			}
-			defaultProto = u.Scheme
+			continue
+		}
+		if !seen[n] {
+			seen[n] = true
+			members = append(members, n)
+		}
+	}
+	c.RUnlock()
+
+	return c.refreshMembers(ctx, members)
+}
+
+// refreshMembers probes the members in parallel, marking up the down or draining ones passing
+// and down the ones up failing
+func (c *cluster) refreshMembers(ctx context.Context, members []*member) error {
+	members = c.probedMembers(members)
+	errs := c.probeMembers(ctx, members)
+	for i, n := range members {
+		err := errs[i]
+		if c.config.observeInterval > 0 {
+			c.observed(n, err)
+			continue
 		}
-		// step: does the url have a protocol schema? if not, use the default
-		if u.Scheme == "" || u.Opaque != "" {
-			urlWithScheme := fmt.Sprintf("%s://%s", defaultProto, u.String())
-			if u, err = url.Parse(urlWithScheme); err != nil {
-				panic(fmt.Sprintf("unexpected parsing error for URL '%s' with added default scheme: %s", urlWithScheme, err))
+		switch {
+		case err == nil:
+			c.RLock()
+			recovering := n.status == memberStatusDown || n.status == memberStatusDraining
+			c.RUnlock()
+			if !c.probePassed(n) || !recovering || c.confirmRecovery(ctx, n) != nil {
+				continue
+			}
+			c.Lock()
+			if n.status == memberStatusDown || n.status == memberStatusDraining {
+				c.setStatus(n, memberStatusUp, "")
 			}
+			c.Unlock()
+		case ctx.Err() == nil && !errors.Is(err, ErrTokenRefresh) && c.probeFailed(n):
+			c.markDownReason(n.endpoint, err.Error())
 		}
+	}
+
+	return newPingError(members, errs)
+}
 
-		// step: check for empty hosts
-		if u.Host == "" {
-			return nil, errors.New(fmt.Sprintf("endpoint: %s must have a host", endpoint))
+// probedMembers leaves out the drained members unless they're probed, see WithDrainedProbing
+func (c *cluster) probedMembers(members []*member) []*member {
+	c.RLock()
+	defer c.RUnlock()
+	var probed []*member
+	for _, n := range members {
+		if !c.skipsProbes(n) {
+			probed = append(probed, n)
 		}
+	}
+
+	return probed
+}
+
+// skipsProbes checks if the health checks leave the member alone, the caller must hold the lock
+func (c *cluster) skipsProbes(n *member) bool {
+	return n.drained && !c.config.probeDrained
+}
+
+// probeMembers performs a liveness check on the members in parallel, returning the failure of
+// each one
+func (c *cluster) probeMembers(ctx context.Context, members []*member) []error {
+	errs, _ := c.probeTimed(ctx, members)
+	return errs
+}
 
-		// step: create a new node for this endpoint
-		members = append(members, &member{endpoint: u.String()})
+// probeTimed performs a liveness check on the members in parallel, returning the failure of each
+// one along with how long its check took
+func (c *cluster) probeTimed(ctx context.Context, members []*member) ([]error, []time.Duration) {
+	errs := make([]error, len(members))
+	latencies := make([]time.Duration, len(members))
+	var wg sync.WaitGroup
+	for i, n := range members {
+		wg.Add(1)
+		go func(i int, n *member) {
+			defer wg.Done()
+			started := time.Now()
+			_, errs[i] = c.probe(ctx, n, c.livenessPath(n))
+			latencies[i] = time.Since(started)
+		}(i, n)
 	}
+	wg.Wait()
 
-	return &cluster{
-		client:  client,
-		members: members,
-	}, nil
+	return errs, latencies
 }
 
-// retrieve the current member, i.e. the current endpoint in use
-func (c *cluster) getMember() (string, error) {
+// newPingError returns the failures of the members as a *PingError, nil when there are none
+func newPingError(members []*member, errs []error) error {
+	pingErr := &PingError{}
+	for i, err := range errs {
+		if err != nil {
+			pingErr.Failures = append(pingErr.Failures, &MemberError{Endpoint: members[i].endpoint, Err: err})
+		} else {
+			pingErr.Healthy++
+		}
+	}
+	if len(pingErr.Failures) == 0 {
+		return nil
+	}
+
+	return pingErr
+}
+
+// PingMember performs a liveness check on a single member, returning ErrUnknownMember when the
+// endpoint isn't one. A member failing the check is marked down, a member passing it has its
+// penalties reset, see resetPenalties, a down one being marked up by its health check rather
+// than here
+func (c *cluster) PingMember(ctx context.Context, endpoint string) error {
 	c.RLock()
-	defer c.RUnlock()
-	for _, n := range c.members {
-		if n.status == memberStatusUp {
-			return n.endpoint, nil
+	n := c.findMember(endpoint)
+	c.RUnlock()
+	if n == nil {
+		return ErrUnknownMember
+	}
+	if _, err := c.probe(ctx, n, c.livenessPath(n)); err != nil {
+		// step: the caller giving up or the token failing to refresh is not a failure of the member
+		if ctx.Err() == nil && !errors.Is(err, ErrTokenRefresh) && c.probeFailed(n) {
+			c.markDownReason(n.endpoint, err.Error())
 		}
+		return err
 	}
+	// step: passing a manual check clears the penalties, the health check brings it back up
+	c.probePassed(n)
+	c.Lock()
+	c.resetPenalties(n)
+	c.Unlock()
 
-	return "", ErrSwanDown
+	return nil
 }
 
-// markDown marks down the current endpoint
-func (c *cluster) markDown(endpoint string) {
+// observeLoop probes the members of an observing cluster straight away and then periodically
+// until the cluster is closed, marking them up or down with the outcome. The health checks of
+// the down members aren't used as every member is probed on each round
+func (c *cluster) observeLoop() {
+	for {
+		c.RLock()
+		members := append([]*member(nil), c.members...)
+		refresh := c.refresh
+		c.RUnlock()
+		for _, n := range members {
+			err := c.probeNode(n)
+			// step: a probe aborted by the close is no outcome
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			c.observed(n, err)
+		}
+		select {
+		case <-c.done:
+			return
+		case <-refresh:
+		case <-time.After(c.config.observeInterval):
+		}
+	}
+}
+
+// observed marks the node of an observing cluster up or down with the outcome of a probe, a
+// token which couldn't be refreshed is no outcome as it's not an outage of the member
+func (c *cluster) observed(n *member, err error) {
+	if errors.Is(err, ErrTokenRefresh) {
+		return
+	}
 	c.Lock()
 	defer c.Unlock()
-	for _, n := range c.members {
-		// step: check if this is the node and it's marked as up - The double  checking on the
-		// nodes status ensures the multiple calls don't create multiple checks
-		if n.status == memberStatusUp && n.endpoint == endpoint {
-			n.status = memberStatusDown
-			go c.healthCheckNode(n)
-			break
+	checks := n.countProbe(err == nil)
+	switch {
+	case err == nil && n.status != memberStatusUp && checks >= c.config.recoveryThreshold:
+		c.setStatus(n, memberStatusUp, "")
+	case err != nil && n.status != memberStatusDown && checks >= c.config.failureThreshold:
+		c.setStatus(n, memberStatusDown, err.Error())
+	case err != nil && n.status == memberStatusDown && n.reason != err.Error():
+		c.setStatus(n, memberStatusDown, err.Error())
+	}
+}
+
+// readinessLoop checks the readiness of the members straight away and then periodically until
+// the cluster is closed. The first round runs while the cluster is already in use, the members
+// start up and every status change is made under the write lock, so callers never observe a
+// member half way through probing
+func (c *cluster) readinessLoop() {
+	for {
+		c.RLock()
+		members := append([]*member(nil), c.members...)
+		refresh := c.refresh
+		c.RUnlock()
+		for _, n := range members {
+			c.checkReadiness(n)
+		}
+		select {
+		case <-c.done:
+			return
+		case <-refresh:
+		case <-time.After(c.config.readinessInterval):
+		}
+	}
+}
+
+// checkReadiness performs a readiness check on an up or not ready member and updates its status
+func (c *cluster) checkReadiness(node *member) {
+	c.RLock()
+	status := node.status
+	c.RUnlock()
+	if status != memberStatusUp && status != memberStatusNotReady {
+		return
+	}
+	ctx, cancel := c.checkContext(node, nil)
+	defer cancel()
+	reached, err := c.probe(ctx, node, c.config.readinessPath)
+	// step: a check aborted by the close or the removal of the node is no outcome, neither is a
+	// token which couldn't be refreshed as it says nothing about the node
+	if ctx.Err() != nil || errors.Is(err, ErrTokenRefresh) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	// step: the status may have changed while probing
+	if node.status != memberStatusUp && node.status != memberStatusNotReady {
+		return
+	}
+	switch {
+	case err == nil:
+		node.readinessFailures = 0
+		if node.status == memberStatusNotReady {
+			c.setStatus(node, memberStatusUp, "")
 		}
+	case !reached && !errors.Is(err, ErrProbeUnauthorized):
+		// step: the node is dead rather than not ready
+		node.readinessFailures = 0
+		c.setStatus(node, memberStatusDown, err.Error())
+		c.startHealthCheck(node)
+	default:
+		node.readinessFailures++
+		if node.status == memberStatusUp && node.readinessFailures >= c.config.readinessThreshold {
+			c.setStatus(node, memberStatusNotReady, err.Error())
+		}
+	}
+}
+
+// startHealthCheck starts the health check of the node unless one is running already, it must
+// be called with the lock held
+func (c *cluster) startHealthCheck(node *member) {
+	if node.checking {
+		return
 	}
+	node.checking = true
+	go c.healthCheckNode(node)
 }
 
 // healthCheckNode performs a health check on the node and when active updates the status
 func (c *cluster) healthCheckNode(node *member) {
-	// step: wait for the node to become active ... we are assuming a /ping is enough here
+	// step: wait for the node to become active
 	for {
-		res, err := c.client.Get(fmt.Sprintf("%s/%s", node.endpoint, swanAPIPing))
-		if err == nil && res.StatusCode == 200 {
-			break
+		// step: stop once the node was marked up meanwhile, i.e. by RefreshNow
+		c.Lock()
+		if node.status == memberStatusUp {
+			node.checking = false
+			c.Unlock()
+			return
+		}
+		// step: a drained node isn't probed until it's undrained, which starts a new check
+		if c.skipsProbes(node) {
+			node.checking = false
+			c.Unlock()
+			return
+		}
+		refresh := c.refresh
+		expiry := time.Until(node.expiredUntil)
+		c.Unlock()
+		// step: an expired node isn't probed until the delay is over
+		if expiry > 0 {
+			select {
+			case <-node.removed:
+			case <-c.done:
+			case <-time.After(expiry):
+				continue
+			}
+			c.Lock()
+			node.checking = false
+			c.Unlock()
+			return
+		}
+		// step: the check in flight is aborted by the close, the removal or a refresh
+		ctx, cancel := c.checkContext(node, refresh)
+		_, err := c.probe(ctx, node, c.livenessPath(node))
+		// step: a node recovers once it passed the threshold of checks in a row
+		switch {
+		case err == nil && !c.probePassed(node):
+			err = errors.New(fmt.Sprintf("passed fewer than %d health checks in a row", c.config.recoveryThreshold))
+		case err != nil:
+			c.probeFailed(node)
+		}
+		if err == nil {
+			err = c.confirmRecovery(ctx, node)
+			// step: an incompatible node stays out until it satisfies the constraint
+			if errors.Is(err, ErrIncompatibleVersion) {
+				c.Lock()
+				if node.status != memberStatusIncompatible || node.reason != err.Error() {
+					c.setStatus(node, memberStatusIncompatible, err.Error())
+				}
+				c.Unlock()
+			}
+		}
+		cancel()
+		wait := c.config.healthCheckInterval
+		// step: a node down for too long is re-admitted regardless, in case the health check
+		// itself is broken, though not before its quarantine or expiry is over as it would stay
+		// down without a check running
+		if err != nil && c.config.maxDownDuration > 0 {
+			c.RLock()
+			down := node.status == memberStatusDown
+			remaining := c.config.maxDownDuration - time.Since(node.since)
+			cooldown := time.Until(node.quarantinedUntil)
+			if expiry := time.Until(node.expiredUntil); expiry > cooldown {
+				cooldown = expiry
+			}
+			c.RUnlock()
+			if down && remaining <= 0 && cooldown <= 0 {
+				c.config.logger.Printf("healthCheckNode(): host: %s was down for over %s, re-admitting it despite: %s\n",
+					node.endpoint, c.config.maxDownDuration, err)
+				break
+			}
+			if down && remaining <= 0 {
+				remaining = cooldown
+			}
+			if down && remaining < wait {
+				wait = remaining
+			}
+		}
+		if err == nil {
+			// step: a quarantined node is probed again once the cooldown is over
+			c.RLock()
+			wait = time.Until(node.quarantinedUntil)
+			c.RUnlock()
+			if wait <= 0 {
+				break
+			}
 		}
-		<-time.After(time.Duration(5 * time.Second))
+		// step: an auth failure is not an outage, make it visible rather than the initial reason
+		if errors.Is(err, ErrProbeUnauthorized) {
+			c.Lock()
+			if node.reason != err.Error() {
+				node.reason = err.Error()
+				c.logf("healthCheckNode(): host: %s is alive but %s\n", node.endpoint, err)
+			}
+			c.Unlock()
+		}
+		select {
+		case <-node.removed:
+		case <-c.done:
+		case <-refresh:
+			continue
+		case <-time.After(wait):
+			continue
+		}
+		c.Lock()
+		node.checking = false
+		c.Unlock()
+		return
 	}
-	// step: mark the node as active again
+	// step: mark the node as active again, unless it was removed meanwhile
 	c.Lock()
 	defer c.Unlock()
-	node.status = memberStatusUp
+	node.checking = false
+	select {
+	case <-node.removed:
+		return
+	default:
+	}
+	c.setStatus(node, memberStatusUp, "")
 }
 
-// activeMembers returns a list of active members
+// logf queues the log line until the write lock is released, so a slow logger doesn't hold up
+// the cluster. The caller must hold the write lock
+func (c *cluster) logf(format string, args ...interface{}) {
+	c.pendingLogs = append(c.pendingLogs, fmt.Sprintf(format, args...))
+}
+
+// Unlock releases the write lock, then logs the lines queued by logf while holding it
+func (c *cluster) Unlock() {
+	logs := c.pendingLogs
+	c.pendingLogs = nil
+	c.sampledRWMutex.Unlock()
+	for _, line := range logs {
+		c.config.logger.Print(line)
+	}
+}
+
+// LockStats returns the time spent waiting for the cluster lock when sampling is enabled
+func (c *cluster) LockStats() LockStats {
+	return c.lockStats()
+}
+
+// activeMembers returns a list of active members, sorted by endpoint
 func (c *cluster) activeMembers() []string {
 	return c.membersList(memberStatusUp)
 }
 
-// nonActiveMembers returns a list of non-active members in the cluster
+// ForEachActive invokes the callback with the endpoint of each member which is up, in the
+// configured order, stopping early when it returns false. The callback runs under the cluster
+// read lock, so it must not call the methods changing the cluster such as markDown or SetMembers
+// or it will deadlock
+func (c *cluster) ForEachActive(callback func(endpoint string) bool) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, m := range c.members {
+		if m.status == memberStatusUp && !callback(m.endpoint) {
+			return
+		}
+	}
+}
+
+// nonActiveMembers returns a list of non-active members in the cluster, down, draining, not
+// ready or incompatible, sorted by endpoint
 func (c *cluster) nonActiveMembers() []string {
-	return c.membersList(memberStatusDown)
+	return c.membersList(memberStatusDown, memberStatusDraining, memberStatusNotReady, memberStatusIncompatible)
+}
+
+// memberList returns a list of members of the specified statuses sorted by endpoint, rather than
+// in the configured order, so it's stable as members are added and removed. Use Members or
+// ForEachActive for the configured order
+func (c *cluster) membersList(statuses ...memberStatus) []string {
+	c.RLock()
+	defer c.RUnlock()
+	var list []string
+	for _, m := range c.members {
+		for _, status := range statuses {
+			if m.status == status {
+				list = append(list, m.endpoint)
+				break
+			}
+		}
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// MembersByStatus returns the endpoints of the members keyed by their status, i.e. UP, DOWN,
+// DRAINING or NOT READY, each sorted by endpoint. The down members kept down by a flap quarantine
+// are under QUARANTINED rather than DOWN. The buckets come from a single read of the members, so
+// unlike activeMembers and nonActiveMembers they're consistent with each other
+func (c *cluster) MembersByStatus() map[string][]string {
+	c.RLock()
+	defer c.RUnlock()
+	now := time.Now()
+	buckets := make(map[string][]string)
+	for _, m := range c.members {
+		status := m.status.String()
+		if m.status == memberStatusDown && now.Before(m.quarantinedUntil) {
+			status = "QUARANTINED"
+		}
+		buckets[status] = append(buckets[status], m.endpoint)
+	}
+	for _, list := range buckets {
+		sort.Strings(list)
+	}
+
+	return buckets
 }
 
-// memberList returns a list of members of a specified status
-func (c *cluster) membersList(status memberStatus) []string {
+// NeverReached returns the members which never answered a request or health check successfully
+// since the cluster was created, sorted by endpoint. Unlike a member which failed later, these are
+// likely misconfigured or blocked, i.e. a typo in the endpoint or a firewall rule
+func (c *cluster) NeverReached() []string {
 	c.RLock()
 	defer c.RUnlock()
 	var list []string
 	for _, m := range c.members {
-		if m.status == status {
+		if !m.everSucceeded {
 			list = append(list, m.endpoint)
 		}
 	}
+	sort.Strings(list)
 
 	return list
 }
 
 // size returns the size of the cluster
 func (c *cluster) size() int {
+	c.RLock()
+	defer c.RUnlock()
 	return len(c.members)
 }
 
+// String returns the name of the status
+func (s memberStatus) String() string {
+	switch s {
+	case memberStatusDown:
+		return "DOWN"
+	case memberStatusDraining:
+		return "DRAINING"
+	case memberStatusNotReady:
+		return "NOT READY"
+	case memberStatusIncompatible:
+		return "INCOMPATIBLE"
+	}
+
+	return "UP"
+}
+
 // String returns a string representation
-func (m member) String() string {
-	status := "UP"
-	if m.status == memberStatusDown {
-		status = "DOWN"
+func (m *member) String() string {
+	if m.reason != "" {
+		return fmt.Sprintf("member: %s:%s (%s)", m.endpoint, m.status, m.reason)
 	}
 
-	return fmt.Sprintf("member: %s:%s", m.endpoint, status)
+	return fmt.Sprintf("member: %s:%s", m.endpoint, m.status)
 }
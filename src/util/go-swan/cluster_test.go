@@ -0,0 +1,1618 @@
+package swan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCluster(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://127.0.0.1:9999,swan-2:9999")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, c.size(), "should be equal")
+	assert.Equal(t, []string{"http://127.0.0.1:9999", "http://swan-2:9999"}, c.activeMembers(), "should be equal")
+}
+
+func TestNewClusterNilClient(t *testing.T) {
+	healthy := int32(1)
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(nil, server.URL, WithHealthCheckInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, defaultClientTimeout, c.client.Timeout, "should default the client")
+	assert.NoError(t, c.PingMember(context.Background(), server.URL))
+
+	// step: the health check of a member down probes with the default client
+	c.markDown(server.URL)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should recover")
+}
+
+func TestNewClusterProtocolRelative(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "https://swan-1:9999,//master:9999,//[::1]:9999/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://[::1]:9999", "https://master:9999", "https://swan-1:9999"}, c.activeMembers(), "should be equal")
+
+	_, err = newCluster(http.DefaultClient, "//master:9999")
+	assert.Error(t, err, "should need a default protocol")
+}
+
+func TestNewClusterDefaultPorts(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "https://swan-1,http://swan-2,https://swan-3:9999")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-2:80", "https://swan-1:443", "https://swan-3:9999"}, c.activeMembers(), "should add the ports")
+	found, ok := c.FindMember("https://swan-1")
+	assert.True(t, ok, "should find the member without its port")
+	assert.Equal(t, "https://swan-1:443", found, "should be equal")
+
+	c, err = newCluster(http.DefaultClient, "HTTPS://swan-1,http://swan-2,//[::1]", WithDefaultPorts(map[string]int{"HTTPS": 9999}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://[::1]", "http://swan-2", "https://swan-1:9999"}, c.activeMembers(), "should use the ports given")
+
+	_, err = newCluster(http.DefaultClient, "https://swan-1", WithDefaultPorts(map[string]int{"https": 0}))
+	assert.Error(t, err, "should reject an invalid port")
+	_, err = newCluster(http.DefaultClient, "http://swan-1:")
+	assert.Error(t, err, "should reject an empty port")
+}
+
+func TestNewClusterAnnotations(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "https://swan-1:9999/?weight=3&zone=us-east,https://swan-2:9999?region=us-west,swan-3:9999?weight=0",
+		WithMemberWeights(map[string]int{"https://swan-1:9999": 5, "https://swan-2:9999": 2}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://swan-1:9999", "https://swan-2:9999", "https://swan-3:9999"}, c.activeMembers(), "should strip the annotations")
+	assert.Equal(t, 3, c.members[0].weight, "should take precedence over the options")
+	assert.Equal(t, "us-east", c.members[0].region, "should be equal")
+	assert.Equal(t, 2, c.members[1].weight, "should be equal")
+	assert.Equal(t, "us-west", c.members[1].region, "should be equal")
+	assert.Equal(t, 0, c.members[2].weight, "should be equal")
+
+	assert.NoError(t, c.SetMembers([]string{"https://swan-1:9999?weight=1", "https://swan-4:9999?region=eu"}))
+	assert.Equal(t, 1, c.members[0].weight, "should update the remaining member")
+	assert.Equal(t, "", c.members[0].region, "should drop the region no longer annotated")
+	assert.Equal(t, "eu", c.members[1].region, "should be equal")
+
+	// step: a member listed without its annotations returns to the options and the defaults
+	assert.NoError(t, c.SetMembers([]string{"https://swan-1:9999?weight=2&region=eu&fallback&tier=1&tag.rack=r1", "https://swan-4:9999"}))
+	assert.NoError(t, c.SetMembers([]string{"https://swan-1:9999", "https://swan-4:9999"}))
+	assert.Equal(t, 5, c.members[0].weight, "should return to the option")
+	assert.Equal(t, "", c.members[0].region, "should be reset")
+	assert.False(t, c.members[0].fallback, "should be reset")
+	assert.Equal(t, 0, c.members[0].tier, "should be reset")
+	assert.Nil(t, c.members[0].tags, "should be reset")
+	assert.Equal(t, "", c.members[1].region, "should be reset")
+
+	for swanURL, expected := range map[string]string{
+		"https://swan-1:9999?class=gold":          "endpoint: https://swan-1:9999 has an unknown annotation: class",
+		"https://swan-1:9999?weight=-1":           `endpoint: https://swan-1:9999 has an invalid weight: "-1"`,
+		"https://swan-1:9999?weight=3&weight=4":   "endpoint: https://swan-1:9999 has the annotation: weight more than once",
+		"https://swan-1:9999?region=us&zone=us-1": "endpoint: https://swan-1:9999 has both a region and a zone",
+		"https://swan-1:9999?region=":             "endpoint: https://swan-1:9999 has an empty region",
+	} {
+		_, err := newCluster(http.DefaultClient, swanURL)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestNewClusterRequireHealthy(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	_, err := newCluster(http.DefaultClient, down.URL+","+hung.URL, WithRequireHealthy(100*time.Millisecond))
+	assert.True(t, errors.Is(err, ErrSwanDown), "should fail when none is up")
+	var pingErr *PingError
+	assert.True(t, errors.As(err, &pingErr), "should list the failures")
+	assert.Len(t, pingErr.Failures, 2)
+	assert.Contains(t, err.Error(), down.URL)
+	assert.Contains(t, err.Error(), hung.URL)
+
+	var healthy int32 = 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+	c, err := newCluster(http.DefaultClient, down.URL+","+server.URL, WithRequireHealthy(time.Second))
+	assert.NoError(t, err, "should be degraded rather than fail")
+	defer c.Close()
+	assert.Equal(t, []string{server.URL}, c.activeMembers(), "should be equal")
+}
+
+func TestNewClusterShuffledMembers(t *testing.T) {
+	endpoints := []string{"http://swan-1:9999", "http://swan-2:9999", "http://swan-3:9999", "http://swan-4:9999"}
+	expected := append([]string(nil), endpoints...)
+	rand.New(rand.NewSource(7)).Shuffle(len(expected), func(i, j int) {
+		expected[i], expected[j] = expected[j], expected[i]
+	})
+
+	c, err := newCluster(http.DefaultClient, strings.Join(endpoints, ","),
+		WithShuffledMembers(true), WithRandSource(rand.New(rand.NewSource(7))))
+	assert.NoError(t, err)
+	var order []string
+	for _, member := range c.Members() {
+		order = append(order, member.Endpoint)
+	}
+	assert.NotEqual(t, expected, endpoints, "the seed should change the order")
+	assert.Equal(t, expected, order, "should be shuffled")
+	first, err := c.getMember()
+	assert.NoError(t, err)
+	assert.Equal(t, expected[0], first, "should start on the first shuffled member")
+}
+
+func TestFallbackMembers(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999?fallback=maybe")
+	assert.EqualError(t, err, `endpoint: http://swan-1:9999 has an invalid fallback: "maybe"`)
+
+	for _, selector := range []Selector{SelectFirstAvailable(), SelectWeighted(), SelectLeastLoaded()} {
+		c, err := newCluster(http.DefaultClient, "http://swan-dr:9999?fallback,http://swan-1:9999,http://swan-2:9999?fallback=false",
+			WithSelector(selector), WithHealthCheckInterval(time.Hour))
+		assert.NoError(t, err)
+		assert.True(t, c.Members()[0].Fallback, "should be a fallback")
+		assert.False(t, c.Members()[2].Fallback, "should not be a fallback")
+		for i := 0; i < 10; i++ {
+			endpoint, err := c.getMember()
+			assert.NoError(t, err)
+			assert.NotEqual(t, "http://swan-dr:9999", endpoint, selector.Name())
+		}
+
+		c.markDown("http://swan-1:9999")
+		c.markDown("http://swan-2:9999")
+		endpoint, err := c.getMember()
+		assert.NoError(t, err)
+		assert.Equal(t, "http://swan-dr:9999", endpoint, "should fall back once the others are down")
+		c.Close()
+	}
+}
+
+func TestPriorityTiers(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999?tier=-1")
+	assert.EqualError(t, err, `endpoint: http://swan-1:9999 has an invalid tier: "-1"`)
+
+	c, err := newCluster(http.DefaultClient, "http://swan-dr:9999?tier=3,http://swan-near:9999?tier=2,"+
+		"http://swan-1:9999?tier=1,http://swan-2:9999?tier=1", WithSelector(SelectWeighted()))
+	assert.NoError(t, err)
+	tiers := []int{}
+	for _, info := range c.Members() {
+		tiers = append(tiers, info.Tier)
+	}
+	assert.Equal(t, []int{3, 2, 1, 1}, tiers, "should show the tiers")
+	selected := func() map[string]bool {
+		endpoints := make(map[string]bool)
+		for i := 0; i < 10; i++ {
+			endpoint, err := c.getMember()
+			assert.NoError(t, err)
+			endpoints[endpoint] = true
+		}
+		return endpoints
+	}
+	assert.Equal(t, map[string]bool{"http://swan-1:9999": true, "http://swan-2:9999": true}, selected(),
+		"should select within the lowest tier")
+
+	// step: a tier is only used once the lower ones are down
+	c.members[2].status = memberStatusDown
+	c.members[3].status = memberStatusDown
+	assert.Equal(t, map[string]bool{"http://swan-near:9999": true}, selected(), "should use the next tier")
+	c.members[1].status = memberStatusDown
+	assert.Equal(t, map[string]bool{"http://swan-dr:9999": true}, selected(), "should use the last tier")
+	c.members[3].status = memberStatusUp
+	assert.Equal(t, map[string]bool{"http://swan-2:9999": true}, selected(), "should go back to the lowest tier")
+}
+
+func TestValidateSwanURL(t *testing.T) {
+	endpoints, err := ValidateSwanURL("http://swan-1:9999?weight=2,SWAN-1:9999/,https://swan-2:9999")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-1:9999", "https://swan-2:9999"}, endpoints, "should be normalized")
+
+	_, err = ValidateSwanURL("http://swan-1:9999,ftp://swan-2:9999")
+	assert.Error(t, err)
+	_, err = ValidateSwanURL("http://swan-1:9999", WithRegionPenalty(2))
+	assert.EqualError(t, err, "region penalty: 2 must be between 0 and 1")
+}
+
+func TestNewClusterInvalidEndpoints(t *testing.T) {
+	invalid := []string{
+		"",
+		"http://127.0.0.1:9999,",
+		"ftp://127.0.0.1:9999",
+		"http:///",
+		"http://:9999",
+		"http://127.0.0.1:",
+	}
+	for _, swanURL := range invalid {
+		_, err := newCluster(http.DefaultClient, swanURL)
+		assert.Error(t, err, "endpoint %q should be invalid", swanURL)
+	}
+}
+
+func TestNewClusterSkipInvalidEndpoints(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999,,http://swan-2:9999")
+	assert.EqualError(t, err, "endpoint is blank", "should be strict by default")
+
+	output := &bytes.Buffer{}
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,,ftp://swan-3:9999,http://swan-2:9999",
+		WithSkipInvalidEndpoints(true), WithLogger(log.New(output, "", 0)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999"}, c.activeMembers(), "should be equal")
+	assert.Contains(t, output.String(), "endpoint is blank")
+	assert.Contains(t, output.String(), "ftp://swan-3:9999")
+
+	_, err = newCluster(http.DefaultClient, ",", WithSkipInvalidEndpoints(true))
+	assert.EqualError(t, err, "no valid endpoints specified")
+}
+
+func TestNewClusterMaxMembers(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999", WithMaxMembers(2))
+	assert.EqualError(t, err, "3 endpoints exceed the maximum of 2 members")
+
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-2:9999", WithMaxMembers(2))
+	assert.NoError(t, err, "the duplicates should not count")
+	assert.Error(t, c.SetMembers([]string{"http://swan-1:9999", "http://swan-2:9999", "http://swan-3:9999"}))
+	assert.Equal(t, 2, c.size(), "should be equal")
+}
+
+func TestNewClusterEnvExpansion(t *testing.T) {
+	os.Setenv("SWAN_TEST_MASTER_1", "http://swan-1:9999")
+	defer os.Unsetenv("SWAN_TEST_MASTER_1")
+	c, err := newCluster(http.DefaultClient, "${SWAN_TEST_MASTER_1},http://swan-2:9999", WithEnvExpansion(true))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999"}, c.activeMembers(), "should be expanded")
+
+	_, err = newCluster(http.DefaultClient, "${SWAN_TEST_MASTER_1}")
+	assert.Error(t, err, "should be off by default")
+	_, err = newCluster(http.DefaultClient, "http://swan-1:9999,${SWAN_TEST_MISSING}", WithEnvExpansion(true))
+	assert.EqualError(t, err, "endpoint: ${SWAN_TEST_MISSING} expands to nothing")
+	_, err = newCluster(http.DefaultClient, "http://swan-1:9999,${SWAN_TEST_MISSING}?weight=2", WithEnvExpansion(true))
+	assert.EqualError(t, err, "endpoint: ${SWAN_TEST_MISSING}?weight=2 has no address once expanded, only the annotations: ?weight=2")
+	_, err = newCluster(http.DefaultClient, "http://${SWAN_TEST_MISSING}:9999", WithEnvExpansion(true))
+	assert.EqualError(t, err, "endpoint: http://:9999 must have a host, expanded from: http://${SWAN_TEST_MISSING}:9999")
+	_, err = newCluster(http.DefaultClient, "http://swan-1:9999,?weight=2")
+	assert.EqualError(t, err, "endpoint: ?weight=2 has no address, only annotations")
+}
+
+func TestNewClusterSingleHost(t *testing.T) {
+	buf := &bytes.Buffer{}
+	_, err := newCluster(http.DefaultClient, "http://vip:9999,http://vip:9999/,http://VIP:9999", WithLogger(log.New(buf, "", 0)))
+	assert.NoError(t, err, "should only warn by default")
+	assert.Contains(t, buf.String(), "all the 3 endpoints are on the single host: http://vip:9999")
+
+	_, err = newCluster(http.DefaultClient, "http://vip:9999,http://vip:9999", WithDistinctHosts(true))
+	assert.EqualError(t, err, "all the 2 endpoints are on the single host: http://vip:9999")
+
+	buf.Reset()
+	_, err = newCluster(http.DefaultClient, "http://vip:9999", WithDistinctHosts(true), WithLogger(log.New(buf, "", 0)))
+	assert.NoError(t, err, "a single endpoint is not a misconfiguration")
+	assert.Equal(t, "", buf.String(), "should not warn")
+}
+
+func TestNewClusterDuplicateScheme(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "https://https://127.0.0.1:9999")
+	assert.EqualError(t, err, "endpoint: https://https://127.0.0.1:9999 has a duplicated protocol schema")
+
+	_, err = newCluster(http.DefaultClient, "http://127.0.0.1:9999,http://HTTP://127.0.0.2:9999")
+	assert.EqualError(t, err, "endpoint: http://HTTP://127.0.0.2:9999 has a duplicated protocol schema")
+}
+
+func TestNewClusterEmptyHost(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http:///")
+	assert.EqualError(t, err, "endpoint: http:/// must have a host")
+}
+
+// newPingServer returns a server answering the health checks with 200 when healthy is set
+// newJSONServer returns a server answering the path with the body stored in the value, empty
+// until one is stored, and the other paths with an empty list. It's closed once the test is over
+func newJSONServer(t *testing.T, path string) (*httptest.Server, *atomic.Value) {
+	body := new(atomic.Value)
+	body.Store("")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			w.Write([]byte(body.Load().(string)))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, body
+}
+
+func newPingServer(healthy *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(healthy) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+}
+
+func TestWaitForQuorum(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithPingQuorum(2), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.NoError(t, c.WaitForQuorum(context.Background()), "should have the quorum")
+
+	c.markDown("http://swan-1:9999")
+	c.markDown("http://swan-2:9999")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c.WaitForQuorum(ctx), "should time out")
+
+	// step: the second member coming up wakes the waiter
+	done := make(chan error, 1)
+	go func() { done <- c.WaitForQuorum(context.Background()) }()
+	assert.NoError(t, c.MarkUp("http://swan-2:9999"))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("should wake up on the quorum")
+	}
+
+	c.markDown("http://swan-2:9999")
+	go func() { done <- c.WaitForQuorum(context.Background()) }()
+	c.Close()
+	assert.Equal(t, ErrShuttingDown, <-done, "should be equal")
+}
+
+func TestGetMemberBlocking(t *testing.T) {
+	var healthy int32
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	c.markDown(server.URL)
+
+	_, err = c.getMember()
+	assert.Equal(t, ErrSwanDown, err, "should fail fast")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.getMemberBlocking(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "should respect the context")
+
+	result := make(chan string)
+	go func() {
+		endpoint, _ := c.getMemberBlocking(context.Background())
+		result <- endpoint
+	}()
+	atomic.StoreInt32(&healthy, 1)
+	select {
+	case endpoint := <-result:
+		assert.Equal(t, server.URL, endpoint, "should be equal")
+	case <-time.After(5 * time.Second):
+		t.Error("getMemberBlocking did not wake up on recovery")
+	}
+}
+
+func TestMaxInFlightWait(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithMaxInFlight(1, true))
+	assert.NoError(t, err)
+	defer c.Close()
+	endpoint, err := c.acquireMember(context.Background(), "")
+	assert.NoError(t, err)
+
+	acquired := make(chan string)
+	go func() {
+		endpoint, _ := c.acquireMember(context.Background(), "")
+		acquired <- endpoint
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("should wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.release(endpoint)
+	select {
+	case endpoint = <-acquired:
+		assert.Equal(t, "http://swan-1:9999", endpoint, "should be equal")
+	case <-time.After(time.Second):
+		t.Fatal("should wake up on release")
+	}
+}
+
+func TestDrainAndWait(t *testing.T) {
+	var healthy int32 = 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+	c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999",
+		WithMinUpMembers(1), WithHealthCheckInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, ErrUnknownMember, c.DrainAndWait(context.Background(), "http://swan-3:9999"), "should be equal")
+	busy, _ := c.acquireMember(context.Background(), "")
+	assert.Equal(t, server.URL, busy, "should be equal")
+
+	done := make(chan error)
+	go func() {
+		done <- c.DrainAndWait(context.Background(), server.URL)
+	}()
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should stop selecting it")
+	select {
+	case <-done:
+		t.Fatal("should wait for the requests in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.release(busy)
+	assert.NoError(t, <-done)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, []string{"http://swan-2:9999"}, c.activeMembers(), "should not be brought back by the health checks")
+
+	assert.EqualError(t, c.DrainAndWait(context.Background(), "http://swan-2:9999"),
+		"draining: http://swan-2:9999 would leave 0 members up, below the minimum of 1")
+	assert.NoError(t, c.Undrain(server.URL))
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 2 }), "should be back once healthy")
+}
+
+func TestDrainedProbing(t *testing.T) {
+	var healthy int32
+	var probes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	for _, probed := range []bool{false, true} {
+		atomic.StoreInt32(&healthy, 0)
+		c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999",
+			WithHealthCheckInterval(5*time.Millisecond), WithDrainedProbing(probed))
+		assert.NoError(t, err)
+		c.markDown(server.URL)
+		assert.True(t, waitFor(func() bool { return atomic.LoadInt32(&probes) > 0 }), "should probe the down member")
+		assert.NoError(t, c.DrainAndWait(context.Background(), server.URL))
+
+		// step: the drained member is left alone by the health checks and the refreshes
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&probes, 0)
+		time.Sleep(20 * time.Millisecond)
+		c.RefreshMembers(context.Background(), server.URL)
+		info := c.Members()[0]
+		if probed {
+			assert.True(t, atomic.LoadInt32(&probes) > 0, "should keep probing it")
+			assert.Equal(t, "", info.NotProbed, "should be probed")
+		} else {
+			assert.Equal(t, int32(0), atomic.LoadInt32(&probes), "should not probe it")
+			assert.Equal(t, "drained", info.NotProbed, "should show why it's not probed")
+			assert.False(t, info.Probing, "should not be probing")
+		}
+
+		// step: undrained it's probed and recovers as usual
+		atomic.StoreInt32(&healthy, 1)
+		assert.NoError(t, c.Undrain(server.URL))
+		assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 2 }), "should be back once healthy")
+		c.Close()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999")
+	assert.NoError(t, err)
+	first, _ := c.acquireMember(context.Background(), "")
+	second, _ := c.acquireMember(context.Background(), "")
+
+	done := make(chan error)
+	go func() {
+		done <- c.Shutdown(context.Background())
+	}()
+	assert.True(t, waitFor(func() bool {
+		_, err := c.getMember()
+		return err == ErrShuttingDown
+	}), "should stop selecting")
+	c.release(first)
+	select {
+	case <-done:
+		t.Fatal("should wait for the requests in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.release(second)
+	assert.NoError(t, <-done)
+	select {
+	case <-c.done:
+	default:
+		t.Error("should be closed")
+	}
+
+	// step: the deadline closes the cluster anyway
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999")
+	assert.NoError(t, err)
+	c.acquireMember(context.Background(), "")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c.Shutdown(ctx), "should be equal")
+}
+
+func TestWatchPrimary(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	primary, err := c.PrimaryEndpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://swan-1:9999", primary, "should be equal")
+
+	changes := c.WatchPrimary()
+	c.markDown("http://swan-2:9999")
+	c.markDown("http://swan-1:9999")
+	select {
+	case primary = <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("should notify the change")
+	}
+	assert.Equal(t, "", primary, "should only keep the latest")
+
+	c.Lock()
+	c.setStatus(c.members[1], memberStatusUp, "")
+	c.Unlock()
+	assert.Equal(t, "http://swan-2:9999", <-changes, "should be equal")
+
+	c.Close()
+	_, open := <-changes
+	assert.False(t, open, "should be closed with the cluster")
+}
+
+func TestRegionAffinity(t *testing.T) {
+	regions := map[string]string{
+		"http://swan-1:9999": "north",
+		"http://swan-2:9999": "south",
+	}
+	c, err := newCluster(http.DefaultClient, "http://swan-2:9999,http://swan-1:9999", WithRegionAffinity("north", regions))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		endpoint, _ := c.getMember()
+		assert.Equal(t, "http://swan-1:9999", endpoint, "should prefer the local region")
+	}
+
+	// step: fall back to the remote region once the local one is gone
+	c.members[1].status = memberStatusDown
+	endpoint, err := c.getMember()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://swan-2:9999", endpoint, "should fall back to the remote region")
+}
+
+func TestRegionPenalty(t *testing.T) {
+	regions := map[string]string{
+		"http://swan-1:9999": "north",
+		"http://swan-2:9999": "south",
+	}
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithRegionPenalty(2))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithRegionAffinity("north", regions), WithRegionPenalty(0.5))
+	assert.NoError(t, err)
+	remote := 0
+	for i := 0; i < 3000; i++ {
+		if endpoint, _ := c.getMember(); endpoint == "http://swan-2:9999" {
+			remote++
+		}
+	}
+	// step: a remote weight of 0.5 against a local weight of 1 is a third of the traffic
+	assert.True(t, remote > 800 && remote < 1200, "remote member got %d of 3000 requests", remote)
+
+	// step: the draws follow the random source, the same seed repeats the same selections
+	selections := func() []string {
+		c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+			WithRegionAffinity("north", regions), WithRegionPenalty(0.5), WithRandSource(rand.New(rand.NewSource(7))))
+		assert.NoError(t, err)
+		var endpoints []string
+		for i := 0; i < 20; i++ {
+			endpoint, _ := c.getMember()
+			endpoints = append(endpoints, endpoint)
+		}
+		return endpoints
+	}
+	assert.Equal(t, selections(), selections(), "should be deterministic")
+}
+
+func TestResolveURL(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "https://swan-1:9999/base/,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	url, err := c.ResolveURL("/v_beta/apps")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://swan-1:9999/base/v_beta/apps", url, "should keep the base path and scheme")
+
+	c.markDown("https://swan-1:9999/base")
+	c.markDown("http://swan-2:9999")
+	_, err = c.ResolveURL("v_beta/apps")
+	assert.Equal(t, ErrSwanDown, err, "should be equal")
+}
+
+func TestPrepareRequest(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "https://swan-1:9999/base/,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	request, err := http.NewRequest("PUT", "http://placeholder/v_beta/apps?force=true", ioutil.NopCloser(strings.NewReader(`{"id":"nginx"}`)))
+	assert.NoError(t, err)
+	request.Header.Set("X-Request-Id", "42")
+
+	clone, err := c.PrepareRequest(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://swan-1:9999/base/v_beta/apps?force=true", clone.URL.String(), "should target the member")
+	assert.Equal(t, "PUT", clone.Method, "should be equal")
+	assert.Equal(t, "42", clone.Header.Get("X-Request-Id"), "should keep the headers")
+	assert.Equal(t, "placeholder", request.URL.Host, "should leave the request as it is")
+
+	// step: the bodies of both can be read and rewound
+	for _, r := range []*http.Request{clone, request} {
+		content, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"id":"nginx"}`, string(content), "should be equal")
+		body, err := r.GetBody()
+		assert.NoError(t, err)
+		content, _ = ioutil.ReadAll(body)
+		assert.Equal(t, `{"id":"nginx"}`, string(content), "should be rewindable")
+	}
+
+	c.markDown("https://swan-1:9999/base")
+	c.markDown("http://swan-2:9999")
+	_, err = c.PrepareRequest(request)
+	assert.Equal(t, ErrSwanDown, err, "should be equal")
+}
+
+func TestFindMember(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999/,HTTP://Swan-2:9999")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999"}, c.activeMembers(), "should be normalized")
+
+	for _, endpoint := range []string{"http://swan-1:9999", "http://swan-1:9999/", "HTTP://SWAN-1:9999", " swan-1:9999 "} {
+		found, ok := c.FindMember(endpoint)
+		assert.True(t, ok, "%q should be found", endpoint)
+		assert.Equal(t, "http://swan-1:9999", found, "should be equal")
+	}
+	_, ok := c.FindMember("https://swan-1:9999")
+	assert.False(t, ok, "a different protocol is a different member")
+	_, ok = c.FindMember("http://swan-3:9999")
+	assert.False(t, ok, "should not be found")
+}
+
+func TestMarkDownNormalized(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://127.0.0.1:1,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	c.markDown("HTTP://swan-2:9999/")
+	assert.Equal(t, []string{"http://swan-2:9999"}, c.nonActiveMembers(), "should be marked down")
+}
+
+func TestLockSampling(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999")
+	assert.NoError(t, err)
+	c.getMember()
+	assert.Equal(t, LockStats{}, c.LockStats(), "should not sample by default")
+
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999", WithLockSampling(true))
+	assert.NoError(t, err)
+	c.getMember()
+	c.activeMembers()
+	assert.Equal(t, int64(2), c.LockStats().Acquisitions, "should be equal")
+}
+
+func benchmarkGetMember(b *testing.B, opts ...ClusterOption) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999", opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.getMember()
+		}
+	})
+}
+
+func BenchmarkGetMember(b *testing.B) {
+	benchmarkGetMember(b)
+}
+
+func BenchmarkGetMemberLockSampling(b *testing.B) {
+	benchmarkGetMember(b, WithLockSampling(true))
+}
+
+func TestSetMembers(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://127.0.0.1:1,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	c.markDown("http://127.0.0.1:1")
+	removed := c.members[1]
+
+	err = c.SetMembers([]string{"http://127.0.0.1:1/", "swan-3:9999", "swan-3:9999"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-3:9999"}, c.activeMembers(), "should add the new members as up")
+	assert.Equal(t, []string{"http://127.0.0.1:1"}, c.nonActiveMembers(), "should keep the status")
+	select {
+	case <-removed.removed:
+	default:
+		t.Error("the removed member should be stopped")
+	}
+
+	// step: an invalid list leaves the members untouched
+	assert.Error(t, c.SetMembers([]string{"http://swan-4:9999", "ftp://swan-5:9999"}))
+	assert.Error(t, c.SetMembers(nil))
+	assert.Equal(t, 2, c.size(), "should be equal")
+}
+
+// waitFor polls the condition until it holds or a few seconds passed
+// sortedEndpoints returns the endpoints in the order the member lists use
+func sortedEndpoints(endpoints ...string) []string {
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func TestReadinessProbe(t *testing.T) {
+	var ready int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/leader" && atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	_, err := newCluster(http.DefaultClient, server.URL, WithReadinessProbe("/v1/leader", 0, 1))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, server.URL,
+		WithReadinessProbe("/v1/leader", 5*time.Millisecond, 2), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: an alive node failing readiness is skipped but not marked down
+	atomic.StoreInt32(&ready, 0)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 0 }), "should not be ready")
+	c.RLock()
+	assert.Equal(t, memberStatus(memberStatusNotReady), c.members[0].status, "should be not ready")
+	c.RUnlock()
+	_, err = c.getMember()
+	assert.Equal(t, ErrSwanDown, err, "should be equal")
+
+	atomic.StoreInt32(&ready, 1)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should be ready again")
+
+	// step: a dead node is marked down
+	server.Close()
+	assert.True(t, waitFor(func() bool {
+		c.RLock()
+		defer c.RUnlock()
+		return c.members[0].status == memberStatusDown
+	}), "should be marked down")
+}
+
+func TestReadinessProbeConcurrentInit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/leader" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999",
+		WithReadinessProbe("/v1/leader", time.Hour, 1), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: select and inspect the members while the initial probing changes their status
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.getMember()
+				c.Members()
+				c.Dump()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// step: the initial round doesn't wait for the interval
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 0 }), "should be probed")
+	assert.Equal(t, 2, len(c.nonActiveMembers()), "should be equal")
+}
+
+func TestPing(t *testing.T) {
+	var healthy int32 = 1
+	up := newPingServer(&healthy)
+	defer up.Close()
+	var unhealthy int32
+	sick := newPingServer(&unhealthy)
+	defer sick.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	c, err := newCluster(http.DefaultClient, up.URL)
+	assert.NoError(t, err)
+	result, err := c.Ping(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, result.Healthy, "should be healthy")
+
+	// step: a mixed result is a partial success listing each failure
+	c, err = newCluster(http.DefaultClient, up.URL+","+sick.URL+","+dead.URL)
+	assert.NoError(t, err)
+	result, err = c.Ping(context.Background())
+	assert.Equal(t, 3, result.Members, "should be equal")
+	assert.Equal(t, 1, result.Reachable, "should be equal")
+	assert.Equal(t, 3, result.Quorum, "should require all the members")
+	assert.False(t, result.Healthy, "should miss the quorum")
+	pingErr, ok := err.(*PingError)
+	assert.True(t, ok, "should be a PingError")
+	assert.True(t, pingErr.Partial(), "should be a partial success")
+	assert.Len(t, pingErr.Failures, 2)
+	assert.Equal(t, sick.URL, pingErr.Failures[0].Endpoint, "should be equal")
+	assert.Equal(t, dead.URL, pingErr.Failures[1].Endpoint, "should be equal")
+	assert.False(t, errors.Is(err, ErrSwanDown), "some members are reachable")
+	assert.Equal(t, sortedEndpoints(up.URL, sick.URL, dead.URL), c.activeMembers(), "should not change the status")
+
+	// step: all the members failing is ErrSwanDown
+	c, err = newCluster(http.DefaultClient, sick.URL+","+dead.URL)
+	assert.NoError(t, err)
+	_, err = c.Ping(context.Background())
+	assert.True(t, errors.Is(err, ErrSwanDown), "should be ErrSwanDown")
+	assert.False(t, err.(*PingError).Partial(), "should not be a partial success")
+}
+
+func TestPingQuorum(t *testing.T) {
+	var healthy int32 = 1
+	up := newPingServer(&healthy)
+	defer up.Close()
+	var unhealthy int32
+	sick := newPingServer(&unhealthy)
+	defer sick.Close()
+
+	_, err := newCluster(http.DefaultClient, up.URL, WithPingQuorum(-1))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, up.URL+","+sick.URL, WithPingQuorum(1))
+	assert.NoError(t, err)
+	defer c.Close()
+	result, err := c.Ping(context.Background())
+	assert.NoError(t, err, "should meet the quorum")
+	assert.True(t, result.Healthy, "should be healthy")
+	assert.Equal(t, 1, result.Reachable, "should be equal")
+	assert.Len(t, result.Endpoints, 2)
+	for _, endpoint := range result.Endpoints {
+		assert.Equal(t, endpoint.Endpoint == up.URL, endpoint.Reachable, "should be equal")
+		assert.Equal(t, endpoint.Endpoint == sick.URL, endpoint.Err != nil, "should be equal")
+		assert.True(t, endpoint.Latency > 0, "should measure the latency")
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	result, err = c.Ping(context.Background())
+	assert.ErrorIs(t, err, ErrSwanDown)
+	assert.False(t, result.Healthy, "should miss the quorum")
+}
+
+func TestPingMember(t *testing.T) {
+	var healthy int32 = 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.NoError(t, c.PingMember(context.Background(), server.URL+"/"))
+	c.RLock()
+	assert.False(t, c.members[0].lastSuccess.IsZero(), "should record the success")
+	c.RUnlock()
+	assert.Equal(t, ErrUnknownMember, c.PingMember(context.Background(), "http://swan-3:9999"), "should be equal")
+
+	// step: a failed check marks only that member down
+	atomic.StoreInt32(&healthy, 0)
+	assert.Error(t, c.PingMember(context.Background(), server.URL))
+	assert.Equal(t, []string{server.URL}, c.nonActiveMembers(), "should be marked down")
+
+	// step: a cancelled check is not a failure of the member
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, c.PingMember(ctx, "http://swan-2:9999"))
+	assert.Equal(t, []string{server.URL}, c.nonActiveMembers(), "should not be marked down")
+}
+
+func TestProbeMethod(t *testing.T) {
+	var method atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method.Store(r.Method)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL)
+	assert.NoError(t, err)
+	assert.NoError(t, c.probeNode(c.members[0]))
+	assert.Equal(t, "GET", method.Load(), "should be the default")
+
+	c, err = newCluster(http.DefaultClient, server.URL, WithProbeMethod("head"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.probeNode(c.members[0]), "an empty answer should be healthy")
+	assert.Equal(t, "HEAD", method.Load(), "should be equal")
+}
+
+func TestProbeBody(t *testing.T) {
+	var bodies int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.URL.Path != "/v1/health" || string(body) != `{"deep":true}` ||
+			r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&bodies, 1)
+	}))
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithProbeMethod("post"),
+		WithLivenessProbe("/v1/health"), WithProbeBody([]byte(`{"deep":true}`)))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, c.probeNode(c.members[0]), "should send the body every time")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&bodies), "should be equal")
+}
+
+func TestProbeRequestBuilder(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gateway/health" || r.URL.Query().Get("check") != "ping" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	failed := errors.New("no route")
+	c, err := newCluster(http.DefaultClient, gateway.URL+",http://swan-2:9999",
+		WithProbeRequestBuilder(func(ctx context.Context, endpoint, path string) (*http.Request, error) {
+			if endpoint != gateway.URL {
+				return nil, failed
+			}
+			return http.NewRequestWithContext(ctx, "GET", endpoint+"/gateway/health?check="+path, nil)
+		}))
+	assert.NoError(t, err)
+	assert.NoError(t, c.probeNode(c.members[0]))
+	assert.ErrorIs(t, c.probeNode(c.members[1]), failed)
+}
+
+func TestMemberProbe(t *testing.T) {
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/ping" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer legacy.Close()
+	var healthy int32 = 1
+	current := newPingServer(&healthy)
+	defer current.Close()
+
+	c, err := newCluster(http.DefaultClient, legacy.URL+","+current.URL,
+		WithMemberProbe(legacy.URL+"/", ProbeSettings{Path: "/v1/ping", StatusCodes: []int{http.StatusNoContent}}))
+	assert.NoError(t, err)
+	_, err = c.Ping(context.Background())
+	assert.NoError(t, err, "should use the settings of each member")
+}
+
+func TestForEachActive(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999")
+	assert.NoError(t, err)
+	c.members[1].status = memberStatusDown
+
+	var visited []string
+	c.ForEachActive(func(endpoint string) bool {
+		visited = append(visited, endpoint)
+		return true
+	})
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-3:9999"}, visited, "should skip the down members")
+
+	visited = nil
+	c.ForEachActive(func(endpoint string) bool {
+		visited = append(visited, endpoint)
+		return false
+	})
+	assert.Equal(t, []string{"http://swan-1:9999"}, visited, "should stop early")
+}
+
+func TestMembersListOrder(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-3:9999,http://swan-1:9999,http://swan-2:9999")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999", "http://swan-3:9999"}, c.activeMembers(), "should be sorted")
+	assert.Equal(t, "http://swan-3:9999", c.Members()[0].Endpoint, "should keep the configured order")
+}
+
+func TestMembersByStatus(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-4:9999,http://swan-3:9999,http://swan-1:9999,http://swan-2:9999,http://swan-5:9999")
+	assert.NoError(t, err)
+	c.members[0].status = memberStatusDown
+	c.members[1].status = memberStatusDraining
+	c.members[2].status = memberStatusDown
+	c.members[3].status = memberStatusDown
+	c.members[3].quarantinedUntil = time.Now().Add(time.Hour)
+
+	assert.Equal(t, map[string][]string{
+		"UP":          {"http://swan-5:9999"},
+		"DOWN":        {"http://swan-1:9999", "http://swan-4:9999"},
+		"DRAINING":    {"http://swan-3:9999"},
+		"QUARANTINED": {"http://swan-2:9999"},
+	}, c.MembersByStatus(), "should be equal")
+}
+
+func TestNeverReached(t *testing.T) {
+	var healthy int32 = 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,"+server.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, sortedEndpoints("http://swan-1:9999", server.URL), c.NeverReached(), "should be equal")
+
+	assert.NoError(t, c.probeNode(c.members[1]))
+	assert.Equal(t, []string{"http://swan-1:9999"}, c.NeverReached(), "should be set by a probe")
+	atomic.StoreInt32(&healthy, 0)
+	assert.Error(t, c.probeNode(c.members[1]))
+	assert.Equal(t, []string{"http://swan-1:9999"}, c.NeverReached(), "should never be cleared")
+
+	c.markSuccess("http://swan-1:9999")
+	assert.Nil(t, c.NeverReached(), "should be set by a request")
+}
+
+func TestMinUpMembers(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithMinUpMembers(2), WithHealthCheckInterval(time.Hour), WithLogger(log.New(buf, "", 0)))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDownReason("http://swan-1:9999", "timeout")
+	c.markDownReason("http://swan-2:9999", "timeout")
+	c.markFailure("http://swan-3:9999", "timeout")
+	assert.Equal(t, []string{"http://swan-1:9999"}, c.nonActiveMembers(), "should keep the floor")
+	assert.Contains(t, buf.String(), "cluster: keeping member http://swan-2:9999 up as one of the last 2, reason: timeout")
+}
+
+func TestFlapQuarantine(t *testing.T) {
+	healthy := int32(1)
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	_, err := newCluster(http.DefaultClient, server.URL, WithFlapQuarantine(2, 0, time.Second))
+	assert.Error(t, err, "should need a window")
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(10*time.Millisecond),
+		WithFlapQuarantine(2, time.Minute, 200*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDownReason(server.URL, "timeout")
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should recover before flapping")
+	assert.True(t, c.Members()[0].QuarantinedUntil.IsZero(), "should not be quarantined")
+
+	c.markDownReason(server.URL, "timeout")
+	info := c.Members()[0]
+	assert.False(t, info.QuarantinedUntil.IsZero(), "should be quarantined")
+	assert.Equal(t, "quarantined for 200ms after flapping: timeout", info.Reason, "should be equal")
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, c.activeMembers(), "should stay down while quarantined")
+	assert.NoError(t, c.RefreshNow(context.Background()))
+	assert.Empty(t, c.activeMembers(), "should stay down while quarantined")
+
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should be admitted after the cooldown")
+	assert.True(t, c.Members()[0].QuarantinedUntil.IsZero(), "should not be quarantined")
+}
+
+func TestMarkUpResetsPenalties(t *testing.T) {
+	healthy := int32(1)
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(time.Hour),
+		WithFlapQuarantine(2, time.Minute, time.Hour), WithErrorRate(0.5, 2))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, ErrUnknownMember, c.MarkUp("http://swan-9:9999"), "should be equal")
+
+	// step: the manual recovery lifts the quarantine and forgets the transitions
+	for i := 0; i < 2; i++ {
+		c.markDownReason(server.URL, "timeout")
+		c.Lock()
+		c.setStatus(c.members[0], memberStatusUp, "")
+		c.Unlock()
+	}
+	assert.False(t, c.Members()[0].QuarantinedUntil.IsZero(), "should be quarantined")
+	assert.NoError(t, c.MarkUp(server.URL))
+	info := c.Members()[0]
+	assert.Equal(t, "UP", info.Status, "should be marked up")
+	assert.True(t, info.QuarantinedUntil.IsZero(), "should not be quarantined")
+	c.markDownReason(server.URL, "timeout")
+	assert.True(t, c.Members()[0].QuarantinedUntil.IsZero(), "should count the transitions from scratch")
+
+	// step: passing a manual check clears the error rate window
+	c.MarkUp(server.URL)
+	c.markFailure(server.URL, "timeout")
+	assert.NoError(t, c.PingMember(context.Background(), server.URL))
+	c.markFailure(server.URL, "timeout")
+	assert.Equal(t, "UP", c.Members()[0].Status, "should forget the failure before the check")
+}
+
+func TestRecoveryProbe(t *testing.T) {
+	var wedged int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v_beta/apps" && atomic.LoadInt32(&wedged) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(10*time.Millisecond),
+		WithRecoveryProbe("/v_beta/apps"))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDown(server.URL)
+	time.Sleep(30 * time.Millisecond)
+	assert.Empty(t, c.activeMembers(), "should stay down while the secondary check fails")
+	assert.NoError(t, c.RefreshNow(context.Background()))
+	assert.Empty(t, c.activeMembers(), "should not be marked up by a refresh either")
+
+	atomic.StoreInt32(&wedged, 0)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should recover once both pass")
+}
+
+func TestMarkDownReason(t *testing.T) {
+	var healthy int32
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(5*time.Millisecond))
+	assert.NoError(t, err)
+	c.markDownReason(server.URL, "dial timeout")
+	c.RLock()
+	assert.Equal(t, "member: "+server.URL+":DOWN (dial timeout)", c.members[0].String(), "should be equal")
+	c.RUnlock()
+	assert.Equal(t, "dial timeout", c.Members()[0].Reason, "should be equal")
+	assert.Contains(t, c.Dump(), `reason="dial timeout"`)
+
+	// step: the reason is cleared once the node recovers
+	atomic.StoreInt32(&healthy, 1)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should recover")
+	assert.Equal(t, "", c.Members()[0].Reason, "should be cleared")
+}
+
+func TestStalledLogger(t *testing.T) {
+	w := &stalledWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithHealthCheckInterval(time.Hour),
+		WithLogger(log.New(w, "", 0)))
+	assert.NoError(t, err)
+	defer c.Close()
+	go c.markDownReason("http://swan-1:9999", "dial timeout")
+	<-w.writing
+
+	// step: the cluster carries on while the logger is stuck
+	listed := make(chan []string)
+	go func() { listed <- c.activeMembers() }()
+	select {
+	case members := <-listed:
+		assert.Equal(t, []string{"http://swan-2:9999"}, members, "should be equal")
+	case <-time.After(time.Second):
+		t.Fatal("should not hold the lock while logging")
+	}
+	close(w.release)
+}
+
+func TestDurationInCurrentState(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	_, err = c.DurationInCurrentState("http://swan-2:9999")
+	assert.Equal(t, ErrUnknownMember, err, "should be equal")
+
+	time.Sleep(20 * time.Millisecond)
+	up, err := c.DurationInCurrentState("http://swan-1:9999")
+	assert.NoError(t, err)
+	assert.True(t, up >= 20*time.Millisecond, "should be up since it was added")
+
+	c.markDown("http://swan-1:9999")
+	down, _ := c.DurationInCurrentState("http://swan-1:9999")
+	assert.True(t, down < up, "should restart on the status change")
+
+	// step: a new reason alone is not a state change
+	c.Lock()
+	c.setStatus(c.members[0], memberStatusDown, "still down")
+	c.Unlock()
+	again, _ := c.DurationInCurrentState("http://swan-1:9999")
+	assert.True(t, again >= down, "should keep the transition time")
+}
+
+func TestErrorRate(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithErrorRate(1.5, 5))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithErrorRate(0.3, 5), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: one failure in five is below the rate, whatever the order
+	for i := 0; i < 3; i++ {
+		c.markFailure("http://swan-1:9999", "timeout")
+		for j := 0; j < 4; j++ {
+			c.markSuccess("http://swan-1:9999")
+		}
+	}
+	assert.Equal(t, 2, len(c.activeMembers()), "should stay up")
+
+	// step: two failures within the window trip it
+	c.markFailure("http://swan-1:9999", "timeout")
+	assert.Equal(t, 2, len(c.activeMembers()), "should evict the oldest failure")
+	c.markFailure("http://swan-1:9999", "timeout")
+	assert.Equal(t, []string{"http://swan-1:9999"}, c.nonActiveMembers(), "should be marked down")
+	assert.Equal(t, "2 of the last 5 requests failed, last error: timeout", c.Members()[0].Reason, "should be equal")
+}
+
+func TestFailurePenalty(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithFailurePenalty(-time.Second))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithErrorRate(0.5, 10), WithFailurePenalty(time.Hour), WithHealthCheckInterval(time.Hour),
+		WithRandSource(rand.New(rand.NewSource(1))))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: the member which just failed stays up but is avoided
+	c.markFailure("http://swan-1:9999", "timeout")
+	assert.Equal(t, 2, len(c.activeMembers()), "should stay up")
+	assert.False(t, c.Members()[0].LastFailure.IsZero(), "should record the failure")
+	for i := 0; i < 20; i++ {
+		endpoint, _ := c.getMember()
+		assert.Equal(t, "http://swan-2:9999", endpoint, "should avoid the failed member")
+	}
+
+	// step: it's still selected when it's the only one up
+	c.markDown("http://swan-2:9999")
+	endpoint, err := c.getMember()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should be selected")
+
+	// step: half way through the window it's kept in about half the selections
+	assert.NoError(t, c.MarkUp("http://swan-2:9999"))
+	c.Lock()
+	c.findMember("http://swan-1:9999").lastFailure = time.Now().Add(-30 * time.Minute)
+	c.Unlock()
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		if endpoint, _ := c.getMember(); endpoint == "http://swan-1:9999" {
+			kept++
+		}
+	}
+	assert.True(t, kept > 400 && kept < 600, "failed member got %d of 1000 requests", kept)
+
+	// step: the penalty is over at the end of the window
+	c.Lock()
+	c.findMember("http://swan-1:9999").lastFailure = time.Now().Add(-time.Hour)
+	c.Unlock()
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should be the first choice again")
+}
+
+func TestProbeKeepAlivesDisabled(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithProbeKeepAlivesDisabled(true))
+	assert.NoError(t, err)
+	assert.True(t, c.probeClient != c.client, "should have a client of its own")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, c.probeNode(c.members[0]))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&conns), "should open a connection per probe")
+
+	c, err = newCluster(http.DefaultClient, server.URL)
+	assert.NoError(t, err)
+	assert.True(t, c.probeClient == c.client, "should share the client by default")
+}
+
+func TestProbeAuthFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	var refreshes int32
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(5*time.Millisecond),
+		WithProbeAuthFailure(func(endpoint string, statusCode int) {
+			if endpoint == server.URL && statusCode == http.StatusUnauthorized {
+				atomic.AddInt32(&refreshes, 1)
+			}
+		}))
+	assert.NoError(t, err)
+	defer c.Close()
+	err = c.probeNode(c.members[0])
+	assert.True(t, errors.Is(err, ErrProbeUnauthorized), "should be an auth failure")
+
+	// step: a down member shows the auth failure and is not marked up
+	c.markDownReason(server.URL, "connection reset")
+	assert.True(t, waitFor(func() bool {
+		return c.Members()[0].Reason == "response failure: health check was not authorized, status: 401"
+	}), "should show the auth failure")
+	assert.Equal(t, 0, len(c.activeMembers()), "should not be healthy")
+	assert.True(t, atomic.LoadInt32(&refreshes) > 1, "should invoke the callback")
+}
+
+func TestObserver(t *testing.T) {
+	var healthy int32 = 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999", WithObserver(5*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.True(t, waitFor(func() bool {
+		return len(c.activeMembers()) == 1 && c.Members()[1].Reason != ""
+	}), "should observe the members")
+	_, err = c.getMember()
+	assert.Equal(t, ErrObserverMode, err, "should never select")
+	_, err = c.getMemberBlocking(context.Background())
+	assert.Equal(t, ErrObserverMode, err, "should not wait")
+
+	atomic.StoreInt32(&healthy, 0)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 0 }), "should observe the failure")
+	atomic.StoreInt32(&healthy, 1)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should observe the recovery")
+}
+
+func TestProbeThresholds(t *testing.T) {
+	var healthy, probes int32 = 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	_, err := newCluster(http.DefaultClient, server.URL, WithProbeThresholds(0, 1))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999",
+		WithProbeThresholds(3, 2), WithHealthCheckInterval(5*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: a member up is marked down once it failed the checks twice in a row
+	c.RefreshMembers(context.Background(), server.URL)
+	assert.Len(t, c.activeMembers(), 2, "should stay up")
+	assert.Equal(t, 1, c.Members()[0].ConsecutiveFailures, "should count the failure")
+	c.RefreshMembers(context.Background(), server.URL)
+	assert.Equal(t, []string{server.URL}, c.nonActiveMembers(), "should be marked down")
+
+	// step: it recovers once it passed the checks three times in a row
+	atomic.StoreInt32(&probes, 0)
+	atomic.StoreInt32(&healthy, 1)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 2 }), "should recover")
+	assert.True(t, atomic.LoadInt32(&probes) >= 3, "should pass three checks first")
+}
+
+func TestExpireMember(t *testing.T) {
+	var probes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL+",http://swan-2:9999", WithHealthCheckInterval(5*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.ExpireMember("http://swan-3:9999", time.Hour)
+	assert.Len(t, c.activeMembers(), 2)
+
+	// step: the member is down straight away and isn't probed during the delay
+	c.ExpireMember(server.URL, 100*time.Millisecond)
+	assert.Equal(t, []string{server.URL}, c.nonActiveMembers(), "should be marked down")
+	info := c.Members()[0]
+	assert.Equal(t, "expired", info.Reason, "should be equal")
+	assert.False(t, info.ExpiredUntil.IsZero(), "should show the expiry")
+	c.RefreshMembers(context.Background(), server.URL)
+	assert.Equal(t, []string{server.URL}, c.nonActiveMembers(), "should stay down during the delay")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&probes), "should only be probed by the refresh")
+
+	// step: the health check recovers it once the delay is over
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 2 }), "should recover")
+}
+
+func TestHealthCheckAborted(t *testing.T) {
+	var probes int32
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	c, err := newCluster(http.DefaultClient, hung.URL+",http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	c.markDown(hung.URL)
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt32(&probes) == 1 }), "should be probing")
+
+	// step: the close aborts the health check in flight rather than waiting for an answer
+	started := time.Now()
+	c.Close()
+	assert.True(t, waitFor(func() bool { return !c.Members()[0].Probing }), "should stop the health check")
+	assert.True(t, time.Since(started) < time.Second, "should return quickly")
+}
+
+func TestRefreshNow(t *testing.T) {
+	var healthy, other int32 = 0, 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+	up := newPingServer(&other)
+	defer up.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL+","+up.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDown(server.URL)
+	assert.True(t, waitFor(func() bool { return c.Members()[0].ProbeCount == 1 }), "should be health checked")
+
+	// step: recover the down member and mark down the failing one without waiting
+	atomic.StoreInt32(&healthy, 1)
+	atomic.StoreInt32(&other, 0)
+	err = c.RefreshNow(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, []string{server.URL}, c.activeMembers(), "should be refreshed")
+	assert.Equal(t, []string{up.URL}, c.nonActiveMembers(), "should be refreshed")
+
+	// step: the pending health check is woken up and stops
+	assert.True(t, waitFor(func() bool {
+		c.RLock()
+		defer c.RUnlock()
+		return !c.members[0].checking
+	}), "should stop the health check")
+}
+
+func TestRefreshMembers(t *testing.T) {
+	var healthy, other int32 = 0, 0
+	server := newPingServer(&healthy)
+	defer server.Close()
+	up := newPingServer(&other)
+	defer up.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL+","+up.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDown(server.URL)
+
+	// step: only the named member is probed, the unknown ones are ignored
+	atomic.StoreInt32(&healthy, 1)
+	assert.NoError(t, c.RefreshMembers(context.Background(), server.URL, server.URL+"/", "http://swan-9:9999"))
+	assert.Equal(t, sortedEndpoints(server.URL, up.URL), c.activeMembers(), "should only refresh the named member")
+	assert.Equal(t, int64(0), c.Members()[1].ProbeCount, "should not probe the others")
+
+	c, err = newCluster(http.DefaultClient, server.URL, WithStrictRefresh(true))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, c.RefreshMembers(context.Background(), server.URL, "http://swan-9:9999"), ErrUnknownMember)
+	assert.Equal(t, int64(0), c.Members()[0].ProbeCount, "should not probe any member")
+}
+
+func TestTestEndpoint(t *testing.T) {
+	var healthy int32 = 1
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.NoError(t, c.TestEndpoint(context.Background(), server.URL+"?weight=2"))
+	assert.Equal(t, []string{"http://swan-1:9999"}, c.activeMembers(), "should not add the member")
+
+	atomic.StoreInt32(&healthy, 0)
+	var probeErr *ProbeError
+	assert.True(t, errors.As(c.TestEndpoint(context.Background(), server.URL), &probeErr), "should fail the health check")
+	assert.EqualError(t, c.TestEndpoint(context.Background(), "ftp://swan-2:9999"), "endpoint: ftp://swan-2:9999 protocol must be (http|https)")
+}
+
+func TestAvailabilityCallback(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithAvailabilityCallback(func(bool) {}, -time.Second))
+	assert.Error(t, err)
+
+	reported := make(chan bool, 4)
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithAvailabilityCallback(func(available bool) { reported <- available }, 20*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	setStatus := func(i int, status memberStatus) {
+		c.Lock()
+		defer c.Unlock()
+		c.setStatus(c.members[i], status, "test")
+	}
+
+	// step: losing one member isn't reported, losing both is
+	setStatus(0, memberStatusDown)
+	setStatus(1, memberStatusDown)
+	assert.Equal(t, false, <-reported, "should report the cluster down")
+
+	// step: a flap within the debounce isn't reported
+	setStatus(0, memberStatusUp)
+	setStatus(0, memberStatusDown)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, reported, 0)
+
+	setStatus(1, memberStatusUp)
+	assert.Equal(t, true, <-reported, "should report the recovery")
+}
+
+func TestMaxDownDuration(t *testing.T) {
+	var healthy int32
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(time.Hour),
+		WithMaxDownDuration(50*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDown(server.URL)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should re-admit the member")
+	assert.True(t, c.Members()[0].ProbeCount >= 2, "should have failed the health checks")
+}
+
+func TestMaxDownDurationQuarantine(t *testing.T) {
+	var healthy int32
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(10*time.Millisecond),
+		WithFlapQuarantine(2, time.Minute, 300*time.Millisecond), WithMaxDownDuration(50*time.Millisecond))
+	assert.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		c.markDownReason(server.URL, "timeout")
+		c.Lock()
+		c.setStatus(c.members[0], memberStatusUp, "")
+		c.Unlock()
+	}
+	assert.False(t, c.Members()[0].QuarantinedUntil.IsZero(), "should be quarantined")
+
+	// step: the member isn't re-admitted during the quarantine, but once it's over
+	time.Sleep(150 * time.Millisecond)
+	assert.Empty(t, c.activeMembers(), "should stay down while quarantined")
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 1 }), "should re-admit the member")
+}
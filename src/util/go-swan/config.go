@@ -0,0 +1,284 @@
+package swan
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ClusterConfig is the effective configuration of a cluster once the defaults are applied, as set
+// by the options. It's a copy, changing it has no effect but through Reconfigure. The callbacks
+// are reported by whether they're set, and the credentials aren't reported at all
+type ClusterConfig struct {
+	// the endpoints of the members in the configured order
+	Endpoints []string
+	// the selection weight of the members keyed by endpoint
+	Weights map[string]int
+	// the liveness check settings overriding the ones of the cluster keyed by endpoint
+	MemberProbes map[string]ProbeSettings
+	// the name of the strategy choosing among the members which are up
+	Selector string
+	// the path and http method of the liveness check
+	LivenessPath string
+	ProbeMethod  string
+	// the path of the secondary check recovering a member, empty when there's none
+	RecoveryPath string
+	// the interval between the health checks of a down member
+	HealthCheckInterval time.Duration
+	// how long a member stays down before it's re-admitted anyway, zero keeps it down
+	MaxDownDuration time.Duration
+	// the liveness checks in a row a down member must pass to recover, and a member up must fail
+	// to be marked down
+	RecoveryThreshold int
+	FailureThreshold  int
+	// the path, interval and failure threshold of the readiness check, empty when there's none
+	ReadinessPath      string
+	ReadinessInterval  time.Duration
+	ReadinessThreshold int
+	// the 5xx statuses marking the member down and failing the request over
+	MarkDownStatuses []int
+	// the share of failed requests over the window marking a member down, a zero window marks it
+	// down on the first failure
+	ErrorRate       float64
+	ErrorRateWindow int
+	// how long a member which just failed a request is avoided, zero when it isn't
+	FailurePenaltyWindow time.Duration
+	// the status changes within the window quarantining a member for the cooldown, zero
+	// transitions when it's disabled
+	FlapTransitions int
+	FlapWindow      time.Duration
+	FlapCooldown    time.Duration
+	// the failovers of the cluster within the window warning about its churn, zero threshold
+	// when it's disabled
+	FailoverWarningThreshold int
+	FailoverWarningWindow    time.Duration
+	// the members a failed request never marks down, zero when there's no floor
+	MinUpMembers int
+	// the maximum number of members, zero when it's unlimited
+	MaxMembers int
+	// the maximum in-flight requests per member, zero when it's unlimited
+	MaxInFlight int
+	// the members which must pass the liveness checks of Ping
+	PingQuorum int
+	// the priority tier of the members keyed by endpoint, the members not listed are in tier 0
+	Tiers map[string]int
+	// the region of the client and the penalty of the members outside of it, empty when region
+	// affinity is disabled
+	Region        string
+	RegionPenalty float64
+	// the port added to the endpoints without one keyed by protocol schema
+	DefaultPorts map[string]int
+	// the size of the largest request body retried and what happens to the larger ones
+	RetryBodyLimit      int
+	OversizedBodyPolicy OversizedBodyPolicy
+	// the path and interval of the leader poll, empty when there's none, and whether the writes
+	// are routed to the leader
+	LeaderPath     string
+	LeaderInterval time.Duration
+	LeaderWrites   bool
+	// whether the transport negotiates the compression of the responses
+	Compression bool
+	// whether the members drained by DrainAndWait are probed
+	DrainedProbing bool
+	// the interval between the probes of an observing cluster, zero when it routes requests
+	ObserveInterval time.Duration
+	// whether a token source or a request decorator is set, the token itself isn't reported
+	TokenAuth        bool
+	RequestDecorator bool
+}
+
+// Config returns the effective configuration of the cluster, i.e. to check an option took effect
+func (c *cluster) Config() ClusterConfig {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.currentConfig()
+}
+
+// currentConfig returns the effective configuration of the cluster, the caller must hold the lock
+func (c *cluster) currentConfig() ClusterConfig {
+	var endpoints []string
+	weights := make(map[string]int)
+	probes := make(map[string]ProbeSettings)
+	tiers := make(map[string]int)
+	for _, n := range c.members {
+		endpoints = append(endpoints, n.endpoint)
+		weights[n.endpoint] = n.weight
+		if n.probe != nil {
+			probes[n.endpoint] = ProbeSettings{Path: n.probe.Path, StatusCodes: append([]int(nil), n.probe.StatusCodes...)}
+		}
+		if n.tier != 0 {
+			tiers[n.endpoint] = n.tier
+		}
+	}
+	config := c.config
+	pingQuorum := config.pingQuorum
+	if pingQuorum == 0 {
+		pingQuorum = len(c.members)
+	}
+	ports := make(map[string]int)
+	for scheme, port := range config.defaultPorts {
+		ports[scheme] = port
+	}
+
+	return ClusterConfig{
+		Endpoints:                endpoints,
+		Weights:                  weights,
+		MemberProbes:             probes,
+		Selector:                 config.selector.Name(),
+		LivenessPath:             config.livenessPath,
+		ProbeMethod:              config.probeMethod,
+		RecoveryPath:             config.recoveryPath,
+		HealthCheckInterval:      config.healthCheckInterval,
+		MaxDownDuration:          config.maxDownDuration,
+		RecoveryThreshold:        config.recoveryThreshold,
+		FailureThreshold:         config.failureThreshold,
+		ReadinessPath:            config.readinessPath,
+		ReadinessInterval:        config.readinessInterval,
+		ReadinessThreshold:       config.readinessThreshold,
+		MarkDownStatuses:         append([]int(nil), config.markDownStatuses...),
+		ErrorRate:                config.errorRate,
+		ErrorRateWindow:          config.errorRateWindow,
+		FailurePenaltyWindow:     config.failurePenaltyWindow,
+		FlapTransitions:          config.flapTransitions,
+		FlapWindow:               config.flapWindow,
+		FlapCooldown:             config.flapCooldown,
+		FailoverWarningThreshold: config.failoverThreshold,
+		FailoverWarningWindow:    config.failoverWindow,
+		MinUpMembers:             config.minUpMembers,
+		MaxMembers:               config.maxMembers,
+		MaxInFlight:              config.maxInFlight,
+		PingQuorum:               pingQuorum,
+		Tiers:                    tiers,
+		Region:                   config.region,
+		RegionPenalty:            config.regionPenalty,
+		DefaultPorts:             ports,
+		RetryBodyLimit:           config.retryBodyLimit,
+		OversizedBodyPolicy:      config.oversizedBodyPolicy,
+		LeaderPath:               config.leaderPath,
+		LeaderInterval:           config.leaderInterval,
+		LeaderWrites:             config.leaderWrites,
+		Compression:              !config.compressionDisabled,
+		DrainedProbing:           config.probeDrained,
+		ObserveInterval:          config.observeInterval,
+		TokenAuth:                config.tokenSource != nil,
+		RequestDecorator:         config.requestDecorator != nil,
+	}
+}
+
+// Reconfigure applies the members, weights, tiers and member probes of the configuration at once,
+// i.e. a configuration returned by Config once changed. It's all or nothing: the whole
+// configuration is validated first and nothing is applied when it fails. The members already in
+// the cluster keep their state, and their annotations when listed without any as Config leaves
+// them out. The ones not listed in the weights or the tiers keep their weight and tier, and the new
+// ones get the weight and tier of their annotations or the defaults. The members not listed in the
+// member probes use the settings of the cluster. The other settings are fixed once the cluster is
+// created, changing them fails
+func (c *cluster) Reconfigure(config ClusterConfig) error {
+	if len(config.Endpoints) == 0 {
+		return errors.New("no endpoints specified")
+	}
+	c.Lock()
+	defer c.Unlock()
+	if err := checkFixedConfig(c.currentConfig(), config); err != nil {
+		return err
+	}
+	list, annotations, _, err := parseEndpoints(c.config, config.Endpoints, c.defaultProto)
+	if err != nil {
+		return err
+	}
+	members := make(map[string]bool)
+	for _, endpoint := range list {
+		members[endpoint] = true
+	}
+	weights := make(map[string]int)
+	for endpoint, weight := range config.Weights {
+		u, err := normalizeEndpoint(endpoint, c.defaultProto, c.config.defaultPorts)
+		if err != nil || !members[u.String()] {
+			return errors.New(fmt.Sprintf("weight: %s is not one of the endpoints", endpoint))
+		}
+		if weight < 0 {
+			return errors.New(fmt.Sprintf("weight: %d can not be negative", weight))
+		}
+		weights[u.String()] = weight
+	}
+	tiers := make(map[string]int)
+	for endpoint, tier := range config.Tiers {
+		u, err := normalizeEndpoint(endpoint, c.defaultProto, c.config.defaultPorts)
+		if err != nil || !members[u.String()] {
+			return errors.New(fmt.Sprintf("tier: %s is not one of the endpoints", endpoint))
+		}
+		if tier < 0 {
+			return errors.New(fmt.Sprintf("tier: %d can not be negative", tier))
+		}
+		tiers[u.String()] = tier
+	}
+	probes := make(map[string]ProbeSettings)
+	for endpoint, settings := range config.MemberProbes {
+		u, err := normalizeEndpoint(endpoint, c.defaultProto, c.config.defaultPorts)
+		if err != nil || !members[u.String()] {
+			return errors.New(fmt.Sprintf("member probe: %s is not one of the endpoints", endpoint))
+		}
+		settings.Path = strings.TrimLeft(settings.Path, "/")
+		probes[u.String()] = settings
+	}
+
+	// step: everything is valid, apply it under the same lock
+	for endpoint, weight := range weights {
+		c.weights[endpoint] = weight
+	}
+	for endpoint, tier := range tiers {
+		c.tiers[endpoint] = tier
+	}
+	c.probes = probes
+	for _, endpoint := range list {
+		if previous, found := c.annotations[endpoint]; found {
+			if _, found := annotations[endpoint]; !found {
+				annotations[endpoint] = previous
+			}
+		}
+	}
+	c.replaceMembers(list, annotations)
+	for _, n := range c.members {
+		if weight, found := weights[n.endpoint]; found {
+			n.weight = weight
+		}
+		if tier, found := tiers[n.endpoint]; found {
+			n.tier = tier
+		}
+		n.probe = nil
+		if settings, found := probes[n.endpoint]; found {
+			n.probe = &settings
+		}
+	}
+
+	return nil
+}
+
+// checkFixedConfig checks the configuration only changes the settings Reconfigure applies, an
+// empty slice or map being the same as nil, i.e. once the configuration went through json
+func checkFixedConfig(current, config ClusterConfig) error {
+	for _, fixed := range []*ClusterConfig{&current, &config} {
+		fixed.Endpoints, fixed.Weights, fixed.MemberProbes, fixed.Tiers = nil, nil, nil, nil
+	}
+	was, is := reflect.ValueOf(current), reflect.ValueOf(config)
+	for i := 0; i < is.NumField(); i++ {
+		if !reflect.DeepEqual(fixedValue(was.Field(i)), fixedValue(is.Field(i))) {
+			return errors.New(fmt.Sprintf("reconfigure: %s can not be changed once the cluster is created",
+				is.Type().Field(i).Name))
+		}
+	}
+
+	return nil
+}
+
+// fixedValue returns the value of a fixed setting to compare, nil for an empty slice or map
+func fixedValue(v reflect.Value) interface{} {
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+		return nil
+	}
+
+	return v.Interface()
+}
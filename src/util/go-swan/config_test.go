@@ -0,0 +1,128 @@
+package swan
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999")
+	assert.NoError(t, err)
+	defer c.Close()
+	config := c.Config()
+	assert.Equal(t, c.config.selector.Name(), config.Selector, "should be equal")
+	assert.Equal(t, "ping", config.LivenessPath, "should be the default")
+	assert.Equal(t, defaultHealthCheckInterval, config.HealthCheckInterval, "should be the default")
+	assert.Equal(t, []int{502, 503, 504}, config.MarkDownStatuses, "should be the default")
+	assert.Equal(t, defaultRetryBodyLimit, config.RetryBodyLimit, "should be the default")
+	assert.Equal(t, 2, config.PingQuorum, "should require all the members")
+	assert.Empty(t, config.Tiers)
+	assert.False(t, config.TokenAuth, "should have no token source")
+
+	source := func(ctx context.Context) (string, error) { return "secret", nil }
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999?tier=1",
+		WithSelector(SelectWeighted()), WithHealthCheckInterval(time.Minute), WithPingQuorum(1),
+		WithTokenSource(source, time.Minute))
+	assert.NoError(t, err)
+	defer c.Close()
+	config = c.Config()
+	assert.Equal(t, SelectWeighted().Name(), config.Selector, "should be equal")
+	assert.Equal(t, time.Minute, config.HealthCheckInterval, "should take effect")
+	assert.Equal(t, 1, config.PingQuorum, "should take effect")
+	assert.Equal(t, map[string]int{"http://swan-2:9999": 1}, config.Tiers, "should be equal")
+	assert.True(t, config.TokenAuth, "should report the token source")
+
+	// step: the configuration is a copy
+	config.MarkDownStatuses[0] = 500
+	assert.Equal(t, 502, c.Config().MarkDownStatuses[0], "should not change")
+}
+
+func TestReconfigure(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.markDown("http://swan-2:9999")
+	before := c.Config()
+
+	// step: a failed validation leaves the old configuration intact
+	invalid := []func(config *ClusterConfig){
+		func(config *ClusterConfig) { config.HealthCheckInterval = time.Minute },
+		func(config *ClusterConfig) { config.Endpoints = append(config.Endpoints, "ftp://swan-3:9999") },
+		func(config *ClusterConfig) {
+			config.Endpoints = []string{"http://swan-3:9999"}
+			config.Weights = map[string]int{"http://swan-4:9999": 2}
+		},
+		func(config *ClusterConfig) {
+			config.Endpoints = []string{"http://swan-3:9999"}
+			config.Weights = map[string]int{"http://swan-3:9999": -1}
+		},
+		func(config *ClusterConfig) {
+			config.Endpoints = []string{"http://swan-3:9999"}
+			config.Tiers = map[string]int{"http://swan-4:9999": 1}
+		},
+		func(config *ClusterConfig) { config.Tiers = map[string]int{"http://swan-1:9999": -1} },
+		func(config *ClusterConfig) {
+			config.Endpoints = []string{"http://swan-3:9999"}
+			config.MemberProbes = map[string]ProbeSettings{"http://swan-4:9999": {Path: "/v1/ping"}}
+		},
+	}
+	for _, change := range invalid {
+		config := c.Config()
+		change(&config)
+		assert.Error(t, c.Reconfigure(config))
+		assert.Equal(t, before, c.Config(), "should leave the configuration intact")
+	}
+	assert.EqualError(t, c.Reconfigure(func() ClusterConfig {
+		config := c.Config()
+		config.MaxInFlight = 3
+		return config
+	}()), "reconfigure: MaxInFlight can not be changed once the cluster is created")
+
+	// step: the members, weights and probes are applied at once
+	config := c.Config()
+	config.Endpoints = []string{"http://swan-2:9999", "http://swan-3:9999?tier=1"}
+	config.Weights = map[string]int{"http://swan-2:9999": 4}
+	config.MemberProbes = map[string]ProbeSettings{"http://swan-3:9999": {Path: "/v1/ping", StatusCodes: []int{204}}}
+	assert.NoError(t, c.Reconfigure(config))
+	after := c.Config()
+	assert.Equal(t, []string{"http://swan-2:9999", "http://swan-3:9999"}, after.Endpoints, "should be equal")
+	assert.Equal(t, map[string]int{"http://swan-2:9999": 4, "http://swan-3:9999": 1}, after.Weights, "should be equal")
+	assert.Equal(t, map[string]ProbeSettings{"http://swan-3:9999": {Path: "v1/ping", StatusCodes: []int{204}}}, after.MemberProbes, "should be equal")
+	assert.Equal(t, map[string]int{"http://swan-3:9999": 1}, after.Tiers, "should follow the annotations")
+	assert.Equal(t, 2, after.PingQuorum, "should follow the members")
+	assert.Equal(t, []string{"http://swan-2:9999"}, c.nonActiveMembers(), "should keep the state of the members")
+
+	// step: the tiers listed are applied, the others are kept
+	config = c.Config()
+	config.Tiers = map[string]int{"swan-2:9999": 2}
+	assert.NoError(t, c.Reconfigure(config))
+	assert.Equal(t, map[string]int{"http://swan-2:9999": 2, "http://swan-3:9999": 1}, c.Config().Tiers, "should apply the tiers")
+	assert.Equal(t, 2, c.Members()[0].Tier, "should be equal")
+}
+
+func TestReconfigureRoundTrip(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999?tier=1", WithMarkDownStatuses(),
+		WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: the configuration is unchanged once it went through json
+	data, err := json.Marshal(c.Config())
+	assert.NoError(t, err)
+	var config ClusterConfig
+	assert.NoError(t, json.Unmarshal(data, &config))
+	assert.NoError(t, c.Reconfigure(config))
+	assert.Equal(t, map[string]int{"http://swan-2:9999": 1}, c.Config().Tiers, "should keep the annotations")
+
+	// step: an empty slice is no change from none
+	config = c.Config()
+	config.MarkDownStatuses = []int{}
+	assert.NoError(t, c.Reconfigure(config))
+	config.MarkDownStatuses = []int{503}
+	assert.EqualError(t, c.Reconfigure(config), "reconfigure: MarkDownStatuses can not be changed once the cluster is created")
+}
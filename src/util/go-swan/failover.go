@@ -0,0 +1,68 @@
+package swan
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultFailoverWindow is the window the failover rate is computed over when no failover warning
+// is configured
+const defaultFailoverWindow = time.Minute
+
+// WithFailoverWarning invokes the callback with the number of failovers when the requests of the
+// cluster failed over more than threshold times within the window, whichever members they failed
+// on, i.e. to flag an unstable cluster before it becomes an outage. Unlike WithFlapQuarantine it
+// watches the churn of the cluster as a whole rather than a member. The callback is invoked at
+// most once per window, outside of the locks of the cluster, a nil callback logs a warning instead
+func WithFailoverWarning(threshold int, window time.Duration, callback func(failovers int, window time.Duration)) ClusterOption {
+	return func(config *clusterConfig) {
+		config.failoverThreshold = threshold
+		config.failoverWindow = window
+		config.failoverWarning = callback
+	}
+}
+
+// failoverWindow returns the window the failovers are counted over
+func (c *cluster) failoverWindow() time.Duration {
+	if c.config.failoverThreshold > 0 {
+		return c.config.failoverWindow
+	}
+
+	return defaultFailoverWindow
+}
+
+// recentFailovers drops the failovers which fell out of the window, the lock of the failovers
+// must be held
+func (c *cluster) recentFailovers(now time.Time) int {
+	window := c.failoverWindow()
+	i := 0
+	for i < len(c.failoverTimes) && now.Sub(c.failoverTimes[i]) >= window {
+		i++
+	}
+	c.failoverTimes = append(c.failoverTimes[:0], c.failoverTimes[i:]...)
+
+	return len(c.failoverTimes)
+}
+
+// recordFailover counts a request failing over to another member, warning when the failovers of
+// the window went over the threshold and no warning was given within the window
+func (c *cluster) recordFailover(now time.Time) {
+	atomic.AddInt64(&c.failovers, 1)
+	c.failoverMu.Lock()
+	c.failoverTimes = append(c.failoverTimes, now)
+	count := c.recentFailovers(now)
+	threshold, window := c.config.failoverThreshold, c.config.failoverWindow
+	warn := threshold > 0 && count > threshold && now.Sub(c.failoverWarned) >= window
+	if warn {
+		c.failoverWarned = now
+	}
+	c.failoverMu.Unlock()
+	if !warn {
+		return
+	}
+	if c.config.failoverWarning == nil {
+		c.config.logger.Printf("cluster: warning, %d requests failed over within %s\n", count, window)
+		return
+	}
+	c.config.failoverWarning(count, window)
+}
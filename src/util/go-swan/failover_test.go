@@ -0,0 +1,54 @@
+package swan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverWarning(t *testing.T) {
+	_, err := newCluster(http.DefaultClient, "http://swan-1:9999", WithFailoverWarning(3, 0, nil))
+	assert.Error(t, err, "should need a window")
+
+	var warnings []int
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithFailoverWarning(2, time.Minute, func(failovers int, window time.Duration) {
+			warnings = append(warnings, failovers)
+		}))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// step: a stable cluster never warns
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		c.recordFailover(now.Add(time.Duration(i) * 30 * time.Second))
+	}
+	assert.Empty(t, warnings, "should not warn")
+
+	// step: the churn warns once per window
+	now = now.Add(5 * time.Minute)
+	for i := 0; i < 5; i++ {
+		c.recordFailover(now.Add(time.Duration(i) * time.Second))
+	}
+	assert.Equal(t, []int{3}, warnings, "should warn once")
+	for i := 0; i < 3; i++ {
+		c.recordFailover(now.Add(time.Minute + time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, []int{3, 5}, warnings, "should warn again in the next window")
+	assert.Equal(t, int64(12), c.failovers, "should count every failover")
+}
+
+func TestFailoverRate(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999")
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, float64(0), c.FailoverRate(), "should be equal")
+
+	c.recordFailover(time.Now().Add(-2 * time.Minute))
+	c.recordFailover(time.Now())
+	c.recordFailover(time.Now())
+	assert.Equal(t, float64(2), c.FailoverRate(), "should count the last minute")
+	assert.Equal(t, 0, c.Config().FailoverWarningThreshold, "should be disabled")
+}
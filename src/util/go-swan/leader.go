@@ -0,0 +1,208 @@
+package swan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// leaderAnswer is the answer of a master to the leader poll
+type leaderAnswer struct {
+	// the address of the leader as seen by the master
+	Leader string `json:"leader"`
+}
+
+// WithLeaderPoll asks every member which is up for the leader on the path every interval, the
+// answer being a json object with the address in its leader field. When the members disagree
+// the cluster is partitioned: the write requests fail with ErrClusterPartitioned while the reads
+// carry on, until they agree again. See Partitioned
+func WithLeaderPoll(path string, interval time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.leaderPath = strings.TrimLeft(path, "/")
+		config.leaderInterval = interval
+	}
+}
+
+// WithLeaderWrites routes the write requests to the leader agreed on by the leader poll, which
+// has a health of its own: every member is asked for the leader whatever its status, and the
+// leader answering is healthy for the writes even when it's down for the reads, i.e. too slow to
+// serve them. A write failing on the leader makes it unhealthy for the writes but not the reads,
+// the writes going to the members up until the next poll. It needs WithLeaderPoll
+func WithLeaderWrites(enabled bool) ClusterOption {
+	return func(config *clusterConfig) {
+		config.leaderWrites = enabled
+	}
+}
+
+// Partitioned checks if the members disagreed about the leader on the latest poll, along with
+// the leader reported by each of them
+func (c *cluster) Partitioned() (bool, map[string]string) {
+	c.RLock()
+	defer c.RUnlock()
+	leaders := make(map[string]string, len(c.leaders))
+	for endpoint, leader := range c.leaders {
+		leaders[endpoint] = leader
+	}
+
+	return c.partitioned, leaders
+}
+
+// isPartitioned checks if the members disagreed about the leader on the latest poll
+func (c *cluster) isPartitioned() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.partitioned
+}
+
+// leaderLoop polls the members for the leader straight away and then periodically until the
+// cluster is closed
+func (c *cluster) leaderLoop() {
+	for {
+		c.pollLeaders()
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.config.leaderInterval):
+		}
+	}
+}
+
+// pollLeaders asks the members which are up for the leader and records whether they disagree,
+// the members which don't answer are left out
+func (c *cluster) pollLeaders() {
+	c.RLock()
+	var members []*member
+	for _, n := range c.members {
+		if n.status == memberStatusUp || c.config.leaderWrites {
+			members = append(members, n)
+		}
+	}
+	c.RUnlock()
+
+	leaders := make(map[string]string)
+	distinct := make(map[string]bool)
+	for _, n := range members {
+		leader, err := c.askLeader(n)
+		if err != nil {
+			c.config.logger.Printf("pollLeaders(): host: %s didn't report the leader, error: %s\n", n.endpoint, err)
+			continue
+		}
+		leaders[n.endpoint] = leader
+		// step: the members may report the same leader as a url or a bare address
+		distinct[leaderHost(leader)] = true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	partitioned := len(distinct) > 1
+	if partitioned != c.partitioned {
+		c.logf("cluster: partitioned: %t, leaders: %v\n", partitioned, leaders)
+	}
+	c.leaders = leaders
+	c.partitioned = partitioned
+	// step: the leader is healthy for the writes when the members agree on it and it answered
+	var leader string
+	for address := range distinct {
+		leader = address
+	}
+	for _, n := range c.members {
+		_, answered := leaders[n.endpoint]
+		n.leader = !partitioned && leader != "" && memberHost(n.endpoint) == leader
+		n.leaderHealthy = n.leader && answered
+	}
+}
+
+// acquireLeader counts a write request in flight to the leader when it's healthy for the writes,
+// false when there's none to route the writes to
+func (c *cluster) acquireLeader() (string, bool) {
+	if !c.config.leaderWrites {
+		return "", false
+	}
+	c.RLock()
+	var leader *member
+	for _, n := range c.members {
+		if n.leaderHealthy && !n.drained {
+			leader = n
+			break
+		}
+	}
+	shuttingDown := c.shuttingDown
+	c.RUnlock()
+	if leader == nil || shuttingDown || !c.acquire(leader) {
+		return "", false
+	}
+	atomic.AddInt64(&leader.selections, 1)
+
+	return leader.endpoint, true
+}
+
+// markLeaderFailure makes the leader unhealthy for the writes until the next poll, leaving its
+// status for the reads alone
+func (c *cluster) markLeaderFailure(endpoint, reason string) {
+	c.Lock()
+	defer c.Unlock()
+	if n := c.findMember(endpoint); n != nil && n.leaderHealthy {
+		n.leaderHealthy = false
+		c.logf("cluster: leader %s is unhealthy for the writes, reason: %s\n", endpoint, reason)
+	}
+}
+
+// leaderHost returns the host and port of the leader address, which may come with a schema
+func leaderHost(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return strings.ToLower(u.Host)
+	}
+
+	return strings.ToLower(address)
+}
+
+// memberHost returns the host and port of the endpoint of a member
+func memberHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// askLeader returns the leader reported by the node
+func (c *cluster) askLeader(node *member) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.leaderInterval)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", joinURL(node.endpoint, c.config.leaderPath), nil)
+	if err != nil {
+		return "", err
+	}
+	if err := c.decorate(request); err != nil {
+		return "", err
+	}
+	res, err := c.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", errors.New(fmt.Sprintf("leader poll returned status: %d", res.StatusCode))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	var answer leaderAnswer
+	if err := json.Unmarshal(body, &answer); err != nil {
+		return "", err
+	}
+	if answer.Leader == "" {
+		return "", errors.New("leader poll returned no leader")
+	}
+
+	return answer.Leader, nil
+}
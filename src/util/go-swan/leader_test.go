@@ -0,0 +1,105 @@
+package swan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderPoll(t *testing.T) {
+	one, first := newJSONServer(t, "/v1/leader")
+	two, second := newJSONServer(t, "/v1/leader")
+	first.Store(`{"leader":"swan-1:9999"}`)
+	second.Store(`{"leader":"swan-1:9999"}`)
+
+	_, err := newCluster(http.DefaultClient, one.URL, WithLeaderPoll("/v1/leader", 0))
+	assert.Error(t, err)
+
+	client, err := NewClient(one.URL+","+two.URL, WithLeaderPoll("/v1/leader", time.Hour))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+	assert.True(t, waitFor(func() bool {
+		_, leaders := swan.hosts.Partitioned()
+		return len(leaders) == 2
+	}), "should poll straight away")
+	partitioned, _ := swan.hosts.Partitioned()
+	assert.False(t, partitioned, "should agree")
+
+	// step: a disagreement refuses the writes but not the reads
+	second.Store(`{"leader":"swan-2:9999"}`)
+	swan.hosts.pollLeaders()
+	partitioned, leaders := swan.hosts.Partitioned()
+	assert.True(t, partitioned, "should be partitioned")
+	assert.Equal(t, "swan-2:9999", leaders[two.URL], "should be equal")
+	assert.Equal(t, ErrClusterPartitioned, swan.apiPost("v_beta/apps", nil, nil), "should refuse the writes")
+	_, err = client.Applications(nil)
+	assert.NoError(t, err, "should carry on with the reads")
+
+	second.Store(`{"leader":"swan-1:9999"}`)
+	swan.hosts.pollLeaders()
+	assert.NoError(t, swan.apiPost("v_beta/apps", nil, nil), "should accept the writes again")
+
+	// step: the same leader reported as a url and as an address is an agreement
+	second.Store(`{"leader":"HTTP://swan-1:9999"}`)
+	swan.hosts.pollLeaders()
+	partitioned, _ = swan.hosts.Partitioned()
+	assert.False(t, partitioned, "should agree on the leader")
+	assert.NoError(t, swan.apiPost("v_beta/apps", nil, nil), "should accept the writes")
+}
+
+func TestLeaderWrites(t *testing.T) {
+	var leader atomic.Value
+	var leaderWrites, followerWrites int32
+	newServer := func(writes *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v1/leader":
+				w.Write([]byte(`{"leader":"` + leader.Load().(string) + `"}`))
+			case r.URL.Path == "/ping" && writes == &leaderWrites:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case r.Method == "POST":
+				atomic.AddInt32(writes, 1)
+				w.Write([]byte(`{}`))
+			default:
+				w.Write([]byte(`[]`))
+			}
+		}))
+	}
+	one := newServer(&leaderWrites)
+	defer one.Close()
+	two := newServer(&followerWrites)
+	defer two.Close()
+	leader.Store(strings.TrimPrefix(one.URL, "http://"))
+
+	_, err := newCluster(http.DefaultClient, one.URL, WithLeaderWrites(true))
+	assert.Error(t, err, "should need the leader poll")
+
+	client, err := NewClient(two.URL+","+one.URL, WithLeaderPoll("/v1/leader", time.Hour),
+		WithLeaderWrites(true), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+
+	// step: the leader down for the reads still takes the writes
+	swan.hosts.markDown(one.URL)
+	swan.hosts.pollLeaders()
+	info := swan.hosts.Members()[1]
+	assert.Equal(t, "DOWN", info.Status, "should be down for the reads")
+	assert.True(t, info.Leader && info.LeaderHealthy, "should be healthy for the writes")
+	assert.NoError(t, swan.apiPost("v_beta/apps", nil, nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&leaderWrites), "should write to the leader")
+	_, err = client.Applications(nil)
+	assert.NoError(t, err, "should read from the follower")
+
+	// step: without a healthy leader the writes go to the members up
+	swan.hosts.markLeaderFailure(one.URL, "failed")
+	assert.False(t, swan.hosts.Members()[1].LeaderHealthy, "should be unhealthy for the writes")
+	assert.NoError(t, swan.apiPost("v_beta/apps", nil, nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&followerWrites), "should write to the follower")
+}
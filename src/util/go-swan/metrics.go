@@ -0,0 +1,116 @@
+package swan
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// the valid names of the metrics and of their labels in the exposition format
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// escapes the label values of the exposition format
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// WithMetricsPrefix sets the prefix of the names of the metrics written by WriteMetrics, by
+// default swan, and the name of the label carrying the endpoint of a member, by default endpoint
+func WithMetricsPrefix(prefix, endpointLabel string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.metricsPrefix = prefix
+		config.metricsEndpointLabel = endpointLabel
+	}
+}
+
+// memberMetric is a metric with a sample per member
+type memberMetric struct {
+	// the name of the metric after the prefix
+	name string
+	// the type of the metric, gauge or counter
+	kind string
+	// the help text of the metric
+	help string
+	// the value of the sample of the member
+	value func(m *member) float64
+}
+
+// memberMetrics are the metrics written for every member
+var memberMetrics = []memberMetric{
+	{"member_up", "gauge", "Whether the member is up.", func(m *member) float64 {
+		if m.status == memberStatusUp {
+			return 1
+		}
+		return 0
+	}},
+	{"member_probes", "counter", "The health checks performed on the member.", func(m *member) float64 {
+		return float64(atomic.LoadInt64(&m.probes))
+	}},
+	{"member_probe_failures", "counter", "The failed health checks of the member.", func(m *member) float64 {
+		return float64(m.connectionFailures + m.responseFailures)
+	}},
+	{"member_probe_latency_seconds", "gauge", "How long the latest health check of the member took.", func(m *member) float64 {
+		if m.lastProbe == nil {
+			return 0
+		}
+		return m.lastProbe.Latency.Seconds()
+	}},
+	{"member_selections", "counter", "The times the member was selected.", func(m *member) float64 {
+		return float64(atomic.LoadInt64(&m.selections))
+	}},
+	{"member_in_flight", "gauge", "The requests in flight to the member.", func(m *member) float64 {
+		return float64(atomic.LoadInt64(&m.inFlight))
+	}},
+}
+
+// WriteMetrics writes the metrics of the cluster and of each member in the OpenMetrics text
+// format, i.e. for a /metrics endpoint, without depending on a metrics library. The members are
+// labelled with their endpoint and sorted by it, see WithMetricsPrefix for the names
+func (c *cluster) WriteMetrics(w io.Writer) error {
+	c.RLock()
+	members := append([]*member(nil), c.members...)
+	up := 0
+	for _, m := range members {
+		if m.status == memberStatusUp {
+			up++
+		}
+	}
+	// step: render under the lock and write once it's released, a slow scraper doesn't hold it
+	buf := new(bytes.Buffer)
+	prefix := c.config.metricsPrefix + "_"
+
+	writeFamily(buf, prefix+"members", "gauge", "The members of the cluster.")
+	fmt.Fprintf(buf, "%smembers %d\n", prefix, len(members))
+	writeFamily(buf, prefix+"members_up", "gauge", "The members of the cluster which are up.")
+	fmt.Fprintf(buf, "%smembers_up %d\n", prefix, up)
+	writeFamily(buf, prefix+"failovers", "counter", "The requests retried on another member after failing on one.")
+	fmt.Fprintf(buf, "%sfailovers_total %d\n", prefix, atomic.LoadInt64(&c.failovers))
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].endpoint < members[j].endpoint
+	})
+	for _, metric := range memberMetrics {
+		name := prefix + metric.name
+		writeFamily(buf, name, metric.kind, metric.help)
+		if metric.kind == "counter" {
+			name += "_total"
+		}
+		for _, m := range members {
+			fmt.Fprintf(buf, "%s{%s=\"%s\"} %v\n", name, c.config.metricsEndpointLabel,
+				labelValueEscaper.Replace(m.endpoint), metric.value(m))
+		}
+	}
+	c.RUnlock()
+	buf.WriteString("# EOF\n")
+	_, err := io.Copy(w, buf)
+
+	return err
+}
+
+// writeFamily writes the metadata of a metric family
+func writeFamily(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", name, kind, name, help)
+}
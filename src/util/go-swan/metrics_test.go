@@ -0,0 +1,110 @@
+package swan
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	metadataLine = regexp.MustCompile(`^# (TYPE [a-zA-Z_:][a-zA-Z0-9_:]* (gauge|counter)|HELP [a-zA-Z_:][a-zA-Z0-9_:]* .+)$`)
+	sampleLine   = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*"\})? [-+0-9.eE]+$`)
+)
+
+// assertExposition checks the lines of an OpenMetrics text exposition
+func assertExposition(t *testing.T, text string) {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	assert.Equal(t, "# EOF", lines[len(lines)-1], "should end with EOF")
+	families := map[string]string{}
+	for _, line := range lines[:len(lines)-1] {
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			families[fields[2]] = fields[3]
+		}
+		if strings.HasPrefix(line, "#") {
+			assert.True(t, metadataLine.MatchString(line), "should be metadata: "+line)
+			continue
+		}
+		match := sampleLine.FindStringSubmatch(line)
+		if !assert.True(t, match != nil, "should be a sample: "+line) {
+			continue
+		}
+		name := match[1]
+		if _, ok := families[name]; !ok {
+			name = strings.TrimSuffix(name, "_total")
+			assert.Equal(t, "counter", families[name], "should be a counter: "+line)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-2:9999,http://swan-1:9999")
+	assert.NoError(t, err)
+	c.members[0].status = memberStatusDown
+	c.members[1].lastProbe = &ProbeResult{Latency: 250 * time.Millisecond}
+	c.failovers = 2
+
+	var buf bytes.Buffer
+	assert.NoError(t, c.WriteMetrics(&buf))
+	text := buf.String()
+	assertExposition(t, text)
+	assert.Contains(t, text, "swan_members 2\n")
+	assert.Contains(t, text, "swan_members_up 1\n")
+	assert.Contains(t, text, "swan_failovers_total 2\n")
+	assert.Contains(t, text, "swan_member_up{endpoint=\"http://swan-1:9999\"} 1\nswan_member_up{endpoint=\"http://swan-2:9999\"} 0\n")
+	assert.Contains(t, text, "swan_member_probe_latency_seconds{endpoint=\"http://swan-1:9999\"} 0.25\n")
+
+	// step: the names follow the prefix and the label
+	_, err = newCluster(http.DefaultClient, "http://swan-1:9999", WithMetricsPrefix("swan-client", "endpoint"))
+	assert.Error(t, err, "should refuse an invalid prefix")
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999", WithMetricsPrefix("search_swan", "member"))
+	assert.NoError(t, err)
+	buf.Reset()
+	assert.NoError(t, c.WriteMetrics(&buf))
+	assertExposition(t, buf.String())
+	assert.Contains(t, buf.String(), "search_swan_member_in_flight{member=\"http://swan-1:9999\"} 0\n")
+}
+
+// stalledWriter blocks the writes until it's released, i.e. a scraper which stopped reading
+type stalledWriter struct {
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+
+	return len(p), nil
+}
+
+func TestWriteMetricsStalledWriter(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	w := &stalledWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- c.WriteMetrics(w) }()
+	<-w.writing
+
+	// step: the cluster carries on while the output is stuck
+	marked := make(chan struct{})
+	go func() {
+		c.markDown("http://swan-1:9999")
+		close(marked)
+	}()
+	select {
+	case <-marked:
+	case <-time.After(time.Second):
+		t.Fatal("should not hold the lock while writing")
+	}
+	close(w.release)
+	assert.NoError(t, <-done)
+}
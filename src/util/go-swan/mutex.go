@@ -0,0 +1,71 @@
+package swan
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockStats are the wait times sampled on the cluster lock
+type LockStats struct {
+	// the number of times the lock was acquired
+	Acquisitions int64
+	// the total time spent waiting for the lock
+	TotalWait time.Duration
+	// the longest time spent waiting for the lock
+	MaxWait time.Duration
+}
+
+// sampledRWMutex is a sync.RWMutex which optionally records how long callers wait to acquire it
+type sampledRWMutex struct {
+	sync.RWMutex
+	// set when the waits are recorded, must not change once the lock is in use
+	sampled bool
+	// the number of acquisitions, total and longest wait in nanoseconds
+	acquisitions int64
+	waitTotal    int64
+	waitMax      int64
+}
+
+// Lock acquires the write lock
+func (m *sampledRWMutex) Lock() {
+	if !m.sampled {
+		m.RWMutex.Lock()
+		return
+	}
+	start := time.Now()
+	m.RWMutex.Lock()
+	m.record(time.Since(start))
+}
+
+// RLock acquires the read lock
+func (m *sampledRWMutex) RLock() {
+	if !m.sampled {
+		m.RWMutex.RLock()
+		return
+	}
+	start := time.Now()
+	m.RWMutex.RLock()
+	m.record(time.Since(start))
+}
+
+// record adds a wait to the stats
+func (m *sampledRWMutex) record(wait time.Duration) {
+	atomic.AddInt64(&m.acquisitions, 1)
+	atomic.AddInt64(&m.waitTotal, int64(wait))
+	for {
+		max := atomic.LoadInt64(&m.waitMax)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&m.waitMax, max, int64(wait)) {
+			return
+		}
+	}
+}
+
+// lockStats returns the sampled waits, all zero when sampling is disabled
+func (m *sampledRWMutex) lockStats() LockStats {
+	return LockStats{
+		Acquisitions: atomic.LoadInt64(&m.acquisitions),
+		TotalWait:    time.Duration(atomic.LoadInt64(&m.waitTotal)),
+		MaxWait:      time.Duration(atomic.LoadInt64(&m.waitMax)),
+	}
+}
@@ -0,0 +1,125 @@
+package swan
+
+import (
+	"time"
+)
+
+// subscriptionBuffer is the number of events a subscriber can fall behind by before the oldest
+// ones are dropped
+const subscriptionBuffer = 64
+
+// ClusterEventType is the kind of a change of the cluster
+type ClusterEventType string
+
+const (
+	// ClusterEventMemberUp is a member coming up
+	ClusterEventMemberUp ClusterEventType = "member_up"
+	// ClusterEventMemberDown is a member going down
+	ClusterEventMemberDown ClusterEventType = "member_down"
+	// ClusterEventMemberDraining is a member draining, i.e. in maintenance
+	ClusterEventMemberDraining ClusterEventType = "member_draining"
+	// ClusterEventMemberNotReady is a member failing the readiness check
+	ClusterEventMemberNotReady ClusterEventType = "member_not_ready"
+	// ClusterEventMemberIncompatible is a member failing the version check
+	ClusterEventMemberIncompatible ClusterEventType = "member_incompatible"
+	// ClusterEventMemberQuarantined is a member going down after flapping, see WithFlapQuarantine
+	ClusterEventMemberQuarantined ClusterEventType = "member_quarantined"
+	// ClusterEventClusterDown is the last member up going down
+	ClusterEventClusterDown ClusterEventType = "cluster_down"
+	// ClusterEventClusterRecovered is a member coming up while none was
+	ClusterEventClusterRecovered ClusterEventType = "cluster_recovered"
+)
+
+// ClusterEvent is a change of the status of a member or of the cluster as a whole
+type ClusterEvent struct {
+	// the kind of change
+	Type ClusterEventType
+	// the endpoint of the member, empty for the changes of the cluster
+	Endpoint string
+	// the tags of the member, see SetMemberTags
+	Tags map[string]string
+	// why the member isn't up, empty when it is or the reason is unknown
+	Reason string
+	// when the change happened
+	Time time.Time
+}
+
+// Subscribe returns a channel receiving the changes of the cluster, along with a function
+// unsubscribing which closes it. Every subscriber gets each event, in order. The events are
+// never waited on: a subscriber which falls behind by more than 64 of them loses the oldest ones.
+// The channel is closed as well once the cluster is closed
+func (c *cluster) Subscribe() (<-chan ClusterEvent, func()) {
+	events := make(chan ClusterEvent, subscriptionBuffer)
+	c.subscribersMu.Lock()
+	select {
+	case <-c.done:
+		close(events)
+		c.subscribersMu.Unlock()
+		return events, func() {}
+	default:
+	}
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan ClusterEvent]bool)
+	}
+	c.subscribers[events] = true
+	c.subscribersMu.Unlock()
+
+	return events, func() {
+		c.subscribersMu.Lock()
+		defer c.subscribersMu.Unlock()
+		if c.subscribers[events] {
+			delete(c.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// publish hands the event to every subscriber, dropping the oldest event of the ones which fell
+// behind rather than waiting on them
+func (c *cluster) publish(event ClusterEvent) {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+	for events := range c.subscribers {
+		select {
+		case events <- event:
+			continue
+		default:
+		}
+		select {
+		case <-events:
+		default:
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// closeSubscriptions closes the channels of all the subscribers
+func (c *cluster) closeSubscriptions() {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+	for events := range c.subscribers {
+		close(events)
+	}
+	c.subscribers = nil
+}
+
+// statusEvent returns the type of the event of a member changing to the status
+func statusEvent(status memberStatus, quarantined bool) ClusterEventType {
+	switch {
+	case quarantined:
+		return ClusterEventMemberQuarantined
+	case status == memberStatusDown:
+		return ClusterEventMemberDown
+	case status == memberStatusDraining:
+		return ClusterEventMemberDraining
+	case status == memberStatusNotReady:
+		return ClusterEventMemberNotReady
+	case status == memberStatusIncompatible:
+		return ClusterEventMemberIncompatible
+	}
+
+	return ClusterEventMemberUp
+}
@@ -0,0 +1,68 @@
+package swan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999")
+	assert.NoError(t, err)
+	setStatus := func(i int, status memberStatus) {
+		c.Lock()
+		defer c.Unlock()
+		c.setStatus(c.members[i], status, "test")
+	}
+	types := func(events <-chan ClusterEvent, count int) []ClusterEventType {
+		var list []ClusterEventType
+		for i := 0; i < count; i++ {
+			select {
+			case event := <-events:
+				list = append(list, event.Type)
+			case <-time.After(time.Second):
+				return list
+			}
+		}
+		return list
+	}
+
+	// step: every subscriber gets its own copy of the events
+	first, unsubscribe := c.Subscribe()
+	second, _ := c.Subscribe()
+	setStatus(0, memberStatusDraining)
+	setStatus(1, memberStatusDown)
+	setStatus(1, memberStatusUp)
+	expected := []ClusterEventType{ClusterEventMemberDraining, ClusterEventMemberDown, ClusterEventClusterDown,
+		ClusterEventMemberUp, ClusterEventClusterRecovered}
+	assert.Equal(t, expected, types(first, 5), "should be equal")
+	assert.Equal(t, expected, types(second, 5), "should be equal")
+
+	// step: unsubscribing closes the channel and stops the delivery
+	unsubscribe()
+	unsubscribe()
+	_, open := <-first
+	assert.False(t, open, "should be closed")
+	setStatus(0, memberStatusUp)
+	assert.Equal(t, []ClusterEventType{ClusterEventMemberUp}, types(second, 1), "should be equal")
+
+	// step: a subscriber falling behind loses the oldest events
+	for i := 0; i < subscriptionBuffer; i++ {
+		setStatus(0, memberStatusDown)
+		setStatus(0, memberStatusUp)
+	}
+	assert.Len(t, second, subscriptionBuffer)
+	event := <-second
+	assert.Equal(t, ClusterEventMemberDown, event.Type, "should be equal")
+	assert.Equal(t, "http://swan-1:9999", event.Endpoint, "should be equal")
+
+	// step: closing the cluster closes the subscriptions
+	c.Close()
+	for range second {
+	}
+	closed, _ := c.Subscribe()
+	_, open = <-closed
+	assert.False(t, open, "should be closed")
+}
@@ -0,0 +1,487 @@
+package swan
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Selector is a strategy choosing the member a request is sent to
+type Selector interface {
+	// Name returns the name of the strategy
+	Name() string
+	// Select returns the chosen member among the candidates which are up. The candidates are
+	// never empty, in the configured order and the cluster lock is held for reading
+	Select(candidates []*member) *member
+}
+
+// StatefulSelector is a Selector whose choice depends on the previous selections, i.e. the
+// position of the weighted one
+type StatefulSelector interface {
+	Selector
+	// State returns the number of selections the strategy made so far
+	State() uint64
+	// Reset sets the number of selections made, safe while selecting concurrently
+	Reset(state uint64)
+}
+
+// Narrower is a Selector which can also narrow the candidates down to the equally good ones rather
+// than choose one, so it composes with the next strategy of a chain, see SelectChain
+type Narrower interface {
+	Selector
+	// Narrow returns the candidates the strategy doesn't tell apart, never empty and in the
+	// configured order. The cluster lock is held for reading
+	Narrow(candidates []*member) []*member
+}
+
+// chain narrows the candidates down with each strategy in turn
+type chain struct {
+	steps []Selector
+}
+
+// SelectChain returns a strategy composing the given ones, each of them narrowing the candidates
+// down for the next one until a single member remains, i.e. the members in the region, then the
+// least loaded of them, then a rotation among the ties:
+//
+//	swan.SelectChain(swan.SelectRegion("north"), swan.SelectLeastLoaded(), swan.SelectSmoothWeighted())
+//
+// A Narrower keeps the candidates it doesn't tell apart, the other strategies their choice. The
+// first of the candidates left once the chain ends is chosen
+func SelectChain(steps ...Selector) Selector {
+	return &chain{steps: steps}
+}
+
+func (s *chain) Name() string {
+	var names []string
+	for _, step := range s.steps {
+		names = append(names, step.Name())
+	}
+
+	return "chain(" + strings.Join(names, ", ") + ")"
+}
+
+func (s *chain) Select(candidates []*member) *member {
+	for _, step := range s.steps {
+		if len(candidates) == 1 {
+			break
+		}
+		if narrower, ok := step.(Narrower); ok {
+			candidates = narrower.Narrow(candidates)
+		} else {
+			candidates = []*member{step.Select(candidates)}
+		}
+	}
+
+	return candidates[0]
+}
+
+// region keeps the members in a region
+type region struct {
+	name string
+}
+
+// SelectRegion returns a strategy keeping the members in the region, along with the ones without
+// a region, in the configured order. Without any member in the region all the candidates are
+// kept. It's meant to start a chain, on its own the first one is chosen
+func SelectRegion(name string) Narrower {
+	return region{name: name}
+}
+
+func (region) Name() string {
+	return "region"
+}
+
+func (s region) Select(candidates []*member) *member {
+	return s.Narrow(candidates)[0]
+}
+
+func (s region) Narrow(candidates []*member) []*member {
+	var local []*member
+	for _, n := range candidates {
+		if n.region == "" || n.region == s.name {
+			local = append(local, n)
+		}
+	}
+	if len(local) == 0 {
+		return candidates
+	}
+
+	return local
+}
+
+// firstAvailable chooses the first member which is up
+type firstAvailable struct{}
+
+// SelectFirstAvailable returns the default strategy, choosing the first member which is up
+// in the configured order
+func SelectFirstAvailable() Selector {
+	return firstAvailable{}
+}
+
+func (firstAvailable) Name() string {
+	return "first-available"
+}
+
+func (firstAvailable) Select(candidates []*member) *member {
+	return candidates[0]
+}
+
+// mostRecentSuccess chooses the member which answered successfully most recently
+type mostRecentSuccess struct{}
+
+// SelectMostRecentSuccess returns a strategy choosing the member which most recently answered a
+// request or health check successfully, on the basis it's the most reliably up right now. Ties,
+// i.e. members which never answered yet, go to the first one in the configured order
+func SelectMostRecentSuccess() Selector {
+	return mostRecentSuccess{}
+}
+
+func (mostRecentSuccess) Name() string {
+	return "most-recent-success"
+}
+
+func (s mostRecentSuccess) Select(candidates []*member) *member {
+	return s.Narrow(candidates)[0]
+}
+
+func (mostRecentSuccess) Narrow(candidates []*member) []*member {
+	latest := candidates[0].lastSuccess
+	for _, n := range candidates[1:] {
+		if n.lastSuccess.After(latest) {
+			latest = n.lastSuccess
+		}
+	}
+	var narrowed []*member
+	for _, n := range candidates {
+		if n.lastSuccess.Equal(latest) {
+			narrowed = append(narrowed, n)
+		}
+	}
+
+	return narrowed
+}
+
+// lowLatency chooses the first member which isn't slow compared to the others
+type lowLatency struct {
+	sensitivity float64
+}
+
+// SelectLowLatency returns a strategy deprioritizing the members whose moving average latency
+// is above the median of the candidates by more than the sensitivity, i.e. 0.5 skips the ones
+// 50% slower than the median. The first of the remaining members in the configured order is
+// chosen, members without a latency yet are never considered slow
+func SelectLowLatency(sensitivity float64) Selector {
+	if sensitivity < 0 {
+		sensitivity = 0
+	}
+	return lowLatency{sensitivity: sensitivity}
+}
+
+func (lowLatency) Name() string {
+	return "low-latency"
+}
+
+func (s lowLatency) Select(candidates []*member) *member {
+	return s.Narrow(candidates)[0]
+}
+
+func (s lowLatency) Narrow(candidates []*member) []*member {
+	var latencies []time.Duration
+	for _, n := range candidates {
+		if n.latency > 0 {
+			latencies = append(latencies, n.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return candidates
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	limit := time.Duration(float64(latencies[(len(latencies)-1)/2]) * (1 + s.sensitivity))
+	var narrowed []*member
+	for _, n := range candidates {
+		if n.latency <= limit {
+			narrowed = append(narrowed, n)
+		}
+	}
+	if len(narrowed) == 0 {
+		return candidates
+	}
+
+	return narrowed
+}
+
+// the fractional part of the golden ratio, stepping the positions of the hinted weighted selection
+const goldenRatio = 0.6180339887498949
+
+// weighted spreads the requests over the members in proportion to their weights
+type weighted struct {
+	// the number of selections so far
+	next uint64
+}
+
+// SelectWeighted returns a strategy spreading the requests over the members in proportion to
+// their weight, see WithMemberWeights and SetMemberWeight. A member with a zero weight is only
+// chosen when all the candidates have one. The weights are adjusted by the loads the members
+// report, see WithCapacityPoll
+func SelectWeighted() Selector {
+	return &weighted{}
+}
+
+func (*weighted) Name() string {
+	return "weighted"
+}
+
+func (s *weighted) Select(candidates []*member) *member {
+	for _, n := range candidates {
+		if n.loadReported {
+			return s.selectHinted(candidates)
+		}
+	}
+	total := 0
+	for _, n := range candidates {
+		total += n.weight
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+	position := int((atomic.AddUint64(&s.next, 1) - 1) % uint64(total))
+	for _, n := range candidates {
+		if position < n.weight {
+			return n
+		}
+		position -= n.weight
+	}
+
+	return candidates[0]
+}
+
+func (s *weighted) State() uint64 {
+	return atomic.LoadUint64(&s.next)
+}
+
+func (s *weighted) Reset(state uint64) {
+	atomic.StoreUint64(&s.next, state)
+}
+
+// selectHinted spreads the requests in proportion to the weights adjusted by the loads. As the
+// weights aren't whole the positions follow the golden ratio sequence, which interleaves the
+// members rather than sending them runs of requests
+func (s *weighted) selectHinted(candidates []*member) *member {
+	total := 0.0
+	for _, n := range candidates {
+		total += n.hintedWeight()
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+	_, fraction := math.Modf(float64(atomic.AddUint64(&s.next, 1)-1) * goldenRatio)
+	position := fraction * total
+	for _, n := range candidates {
+		if position < n.hintedWeight() {
+			return n
+		}
+		position -= n.hintedWeight()
+	}
+
+	return candidates[0]
+}
+
+// smoothWeighted interleaves the members in proportion to their weights
+type smoothWeighted struct {
+	sync.Mutex
+	// the current weight of each member
+	current map[*member]int
+}
+
+// SelectSmoothWeighted returns a strategy spreading the requests over the members in proportion
+// to their weight with the smooth weighted round-robin of nginx: on each selection every
+// candidate gains its weight, the one with the highest current weight is chosen and loses the
+// total. The requests to a member are interleaved with the others rather than sent in runs, i.e.
+// with the weights 5, 1 and 1 the sequence is a a b a c a a. The weights changing and the members
+// going up or down are taken into account on the next selection, a member coming back starting
+// from scratch. Ties go to the first one in the configured order
+func SelectSmoothWeighted() Selector {
+	return &smoothWeighted{current: make(map[*member]int)}
+}
+
+func (*smoothWeighted) Name() string {
+	return "smooth-weighted"
+}
+
+func (s *smoothWeighted) Select(candidates []*member) *member {
+	s.Lock()
+	defer s.Unlock()
+	// step: forget the members which aren't candidates anymore, i.e. down or removed
+	if len(s.current) > len(candidates) {
+		for n := range s.current {
+			if !containsMember(candidates, n) {
+				delete(s.current, n)
+			}
+		}
+	}
+	var chosen *member
+	total := 0
+	for _, n := range candidates {
+		s.current[n] += n.weight
+		total += n.weight
+		if chosen == nil || s.current[n] > s.current[chosen] {
+			chosen = n
+		}
+	}
+	s.current[chosen] -= total
+
+	return chosen
+}
+
+// containsMember checks if the member is one of the list
+func containsMember(members []*member, n *member) bool {
+	for _, m := range members {
+		if m == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leastLoaded chooses the member with the fewest requests in flight
+type leastLoaded struct{}
+
+// SelectLeastLoaded returns a strategy choosing the member with the fewest requests in flight,
+// ties go to the first one in the configured order. See WithMaxInFlight to also cap them
+func SelectLeastLoaded() Selector {
+	return leastLoaded{}
+}
+
+func (leastLoaded) Name() string {
+	return "least-loaded"
+}
+
+func (s leastLoaded) Select(candidates []*member) *member {
+	return s.Narrow(candidates)[0]
+}
+
+func (leastLoaded) Narrow(candidates []*member) []*member {
+	var narrowed []*member
+	var fewest int64
+	for _, n := range candidates {
+		inFlight := atomic.LoadInt64(&n.inFlight)
+		switch {
+		case len(narrowed) == 0 || inFlight < fewest:
+			narrowed, fewest = []*member{n}, inFlight
+		case inFlight == fewest:
+			narrowed = append(narrowed, n)
+		}
+	}
+
+	return narrowed
+}
+
+// leastRecentlySelected chooses the member selected the longest ago
+type leastRecentlySelected struct{}
+
+// SelectLeastRecentlySelected returns a strategy choosing the member whose latest selection is
+// the oldest, spreading the requests evenly by recency. Unlike a rotation it adapts to members
+// being added or removed, a new member being selected first. Ties, i.e. members never selected,
+// go to the first one in the configured order
+func SelectLeastRecentlySelected() Selector {
+	return leastRecentlySelected{}
+}
+
+func (leastRecentlySelected) Name() string {
+	return "least-recently-selected"
+}
+
+func (s leastRecentlySelected) Select(candidates []*member) *member {
+	return s.Narrow(candidates)[0]
+}
+
+func (leastRecentlySelected) Narrow(candidates []*member) []*member {
+	var narrowed []*member
+	var oldest uint64
+	for _, n := range candidates {
+		selection := atomic.LoadUint64(&n.lastSelection)
+		switch {
+		case len(narrowed) == 0 || selection < oldest:
+			narrowed, oldest = []*member{n}, selection
+		case selection == oldest:
+			narrowed = append(narrowed, n)
+		}
+	}
+
+	return narrowed
+}
+
+// lockedRand guards a random source which is shared by the concurrent selections
+type lockedRand struct {
+	sync.Mutex
+	random *rand.Rand
+}
+
+// newLockedRand guards the random source, or a new one seeded with the time when nil
+func newLockedRand(random *rand.Rand) *lockedRand {
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &lockedRand{random: random}
+}
+
+// Float64 returns a number in [0.0,1.0)
+func (r *lockedRand) Float64() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.random.Float64()
+}
+
+// Intn returns a number in [0,n)
+func (r *lockedRand) Intn(n int) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.random.Intn(n)
+}
+
+// Shuffle randomizes the order of n elements with the swap function
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.Lock()
+	defer r.Unlock()
+	r.random.Shuffle(n, swap)
+}
+
+// weightedRandom chooses a member at random in proportion to their weights
+type weightedRandom struct {
+	random *lockedRand
+}
+
+// SelectWeightedRandom returns a strategy choosing a member at random in proportion to their
+// weight, see WithMemberWeights. The random source is seeded with the time when nil, a seeded
+// one makes the selections reproducible in tests. It's guarded, so it must not be used elsewhere
+func SelectWeightedRandom(random *rand.Rand) Selector {
+	return weightedRandom{random: newLockedRand(random)}
+}
+
+func (weightedRandom) Name() string {
+	return "weighted-random"
+}
+
+func (s weightedRandom) Select(candidates []*member) *member {
+	total := 0
+	for _, n := range candidates {
+		total += n.weight
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+	position := s.random.Intn(total)
+	for _, n := range candidates {
+		if position < n.weight {
+			return n
+		}
+		position -= n.weight
+	}
+
+	return candidates[0]
+}
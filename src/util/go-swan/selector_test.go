@@ -0,0 +1,296 @@
+package swan
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectFirstAvailable(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999")
+	assert.NoError(t, err)
+	assert.Equal(t, "first-available", c.config.selector.Name(), "should be the default")
+	endpoint, err := c.getMember()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should be equal")
+}
+
+func TestSelectMostRecentSuccess(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithSelector(SelectMostRecentSuccess()))
+	assert.NoError(t, err)
+	endpoint, _ := c.getMember()
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should fall back to the configured order")
+
+	c.members[1].lastSuccess = time.Now().Add(-time.Minute)
+	c.markSuccess("http://swan-3:9999")
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-3:9999", endpoint, "should be the most recent success")
+
+	c.members[2].status = memberStatusDown
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-2:9999", endpoint, "should skip the down members")
+}
+
+func TestSelectLowLatency(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithSelector(SelectLowLatency(0.5)))
+	assert.NoError(t, err)
+	assert.Equal(t, "low-latency", c.config.selector.Name(), "should be equal")
+	endpoint, _ := c.getMember()
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should fall back to the configured order")
+
+	c.observeLatency("http://swan-1:9999", 100*time.Millisecond)
+	c.observeLatency("http://swan-2:9999", 10*time.Millisecond)
+	c.observeLatency("http://swan-3:9999", 12*time.Millisecond)
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-2:9999", endpoint, "should skip the slow member")
+
+	// step: the average moves towards the recent samples
+	for i := 0; i < 20; i++ {
+		c.observeLatency("http://swan-1:9999", 10*time.Millisecond)
+	}
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should no longer be slow")
+}
+
+func TestSelectWeighted(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithSelector(SelectWeighted()), WithMemberWeights(map[string]int{"http://swan-2:9999/": 3}))
+	assert.NoError(t, err)
+	assert.Equal(t, "weighted", c.config.selector.Name(), "should be equal")
+	counts := func() map[string]int {
+		selected := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			endpoint, _ := c.getMember()
+			selected[endpoint]++
+		}
+		return selected
+	}
+	assert.Equal(t, map[string]int{"http://swan-1:9999": 2, "http://swan-2:9999": 6}, counts(), "should be weighted")
+
+	assert.NoError(t, c.SetMemberWeight("http://swan-1:9999", 0))
+	assert.Equal(t, map[string]int{"http://swan-2:9999": 8}, counts(), "should skip the zero weight")
+
+	assert.NoError(t, c.SetMemberWeight("http://swan-1:9999", 1))
+	assert.NoError(t, c.SetMemberWeight("http://swan-2:9999", 1))
+	assert.Equal(t, map[string]int{"http://swan-1:9999": 4, "http://swan-2:9999": 4}, counts(), "should be equal")
+
+	assert.EqualError(t, c.SetMemberWeight("http://swan-3:9999", 2), "endpoint: http://swan-3:9999 is not a member")
+	assert.Error(t, c.SetMemberWeight("http://swan-1:9999", -1))
+}
+
+func TestResetSelection(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999", WithSelector(SelectWeighted()))
+	assert.NoError(t, err)
+	c.getMember()
+	c.getMember()
+	state, ok := c.SelectionState()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), state, "should be equal")
+	endpoint, _ := c.getMember()
+	assert.Equal(t, "http://swan-3:9999", endpoint, "should be equal")
+
+	assert.NoError(t, c.ResetSelection(0))
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should start over")
+	assert.NoError(t, c.ResetSelection(1))
+	endpoint, _ = c.getMember()
+	assert.Equal(t, "http://swan-2:9999", endpoint, "should be equal")
+
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999")
+	assert.NoError(t, err)
+	_, ok = c.SelectionState()
+	assert.False(t, ok, "should keep no state")
+	assert.EqualError(t, c.ResetSelection(0), "selector: first-available keeps no state")
+}
+
+func TestSelectionTracing(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithLogger(log.New(buf, "", 0)), WithSelectionTracing(true))
+	assert.NoError(t, err)
+	c.getMember()
+	assert.Equal(t, "cluster: selected member http://swan-1:9999, strategy: first-available\n", buf.String(), "should be equal")
+
+	buf.Reset()
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999", WithLogger(log.New(buf, "", 0)))
+	assert.NoError(t, err)
+	c.getMember()
+	assert.Equal(t, "", buf.String(), "should be off by default")
+}
+
+func TestSelectLeastLoaded(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithSelector(SelectLeastLoaded()), WithMaxInFlight(2, false))
+	assert.NoError(t, err)
+	assert.Equal(t, "least-loaded", c.config.selector.Name(), "should be equal")
+	var acquired []string
+	for i := 0; i < 4; i++ {
+		endpoint, err := c.acquireMember(context.Background(), "")
+		assert.NoError(t, err)
+		acquired = append(acquired, endpoint)
+	}
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999", "http://swan-1:9999", "http://swan-2:9999"}, acquired, "should spread the load")
+	_, err = c.acquireMember(context.Background(), "")
+	assert.Equal(t, ErrSaturated, err, "should be saturated")
+
+	c.release("http://swan-2:9999")
+	endpoint, err := c.acquireMember(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://swan-2:9999", endpoint, "should have room again")
+}
+
+func TestSelectLeastRecentlySelected(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithSelector(SelectLeastRecentlySelected()))
+	assert.NoError(t, err)
+	assert.Equal(t, "least-recently-selected", c.config.selector.Name(), "should be equal")
+	selected := func(count int) []string {
+		var endpoints []string
+		for i := 0; i < count; i++ {
+			endpoint, err := c.getMember()
+			assert.NoError(t, err)
+			endpoints = append(endpoints, endpoint)
+		}
+		return endpoints
+	}
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999", "http://swan-3:9999", "http://swan-1:9999"}, selected(4), "should be equal")
+
+	// step: the members down are skipped, and a new member is selected first
+	c.members[1].status = memberStatusDown
+	assert.Equal(t, []string{"http://swan-3:9999", "http://swan-1:9999"}, selected(2), "should be equal")
+	assert.NoError(t, c.SetMembers([]string{"http://swan-1:9999", "http://swan-3:9999", "http://swan-4:9999"}))
+	assert.Equal(t, []string{"http://swan-4:9999", "http://swan-3:9999", "http://swan-1:9999"}, selected(3), "should be equal")
+}
+
+func TestSelectSmoothWeighted(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://a:9999,http://b:9999,http://c:9999",
+		WithSelector(SelectSmoothWeighted()), WithMemberWeights(map[string]int{"http://a:9999": 5}))
+	assert.NoError(t, err)
+	assert.Equal(t, "smooth-weighted", c.config.selector.Name(), "should be equal")
+	sequence := func(count int) string {
+		var hosts []string
+		for i := 0; i < count; i++ {
+			endpoint, err := c.getMember()
+			assert.NoError(t, err)
+			hosts = append(hosts, strings.TrimSuffix(strings.TrimPrefix(endpoint, "http://"), ":9999"))
+		}
+		return strings.Join(hosts, " ")
+	}
+	assert.Equal(t, "a a b a c a a a a b a c a a", sequence(14), "should interleave the members")
+
+	// step: the weight changes and the members going down are followed
+	assert.NoError(t, c.SetMemberWeight("http://a:9999", 1))
+	assert.Equal(t, "a b c a b c", sequence(6), "should follow the weights")
+	c.members[1].status = memberStatusDown
+	assert.Equal(t, "a c a c", sequence(4), "should skip the member down")
+	c.members[1].status = memberStatusUp
+	assert.NoError(t, c.SetMemberWeight("http://b:9999", 2))
+	assert.Equal(t, "b a c b", sequence(4), "should start the member back from scratch")
+}
+
+func TestSelectChain(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://a:9999?region=north,http://b:9999?region=north,"+
+		"http://c:9999?region=south,http://d:9999?region=north",
+		WithSelector(SelectChain(SelectRegion("north"), SelectLeastLoaded(), SelectSmoothWeighted())))
+	assert.NoError(t, err)
+	assert.Equal(t, "chain(region, least-loaded, smooth-weighted)", c.config.selector.Name(), "should be equal")
+	sequence := func(count int) string {
+		var hosts []string
+		for i := 0; i < count; i++ {
+			endpoint, err := c.getMember()
+			assert.NoError(t, err)
+			hosts = append(hosts, strings.TrimSuffix(strings.TrimPrefix(endpoint, "http://"), ":9999"))
+		}
+		return strings.Join(hosts, " ")
+	}
+	assert.Equal(t, "a b d a b d", sequence(6), "should rotate among the region")
+
+	// step: each strategy narrows the candidates down for the next one
+	busy, err := c.acquireMember(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "b d b d", sequence(4), "should rotate among the least loaded")
+	c.release(busy)
+
+	// step: without a member up in the region the others are kept
+	for _, n := range c.members {
+		if n.region == "north" {
+			n.status = memberStatusDown
+		}
+	}
+	assert.Equal(t, "c c", sequence(2), "should fall back to the other region")
+}
+
+func TestPinEndpoint(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, ErrUnknownMember, c.PinEndpoint("http://swan-4:9999"), "should be equal")
+
+	// step: every selection goes to the pinned member whatever its health
+	assert.NoError(t, c.PinEndpoint("http://swan-2:9999"))
+	assert.True(t, c.Members()[1].Pinned, "should report the pinned member")
+	c.markDraining("http://swan-2:9999")
+	for i := 0; i < 3; i++ {
+		endpoint, err := c.getMember()
+		assert.NoError(t, err)
+		assert.Equal(t, "http://swan-2:9999", endpoint, "should be pinned")
+	}
+
+	// step: only a member down fails the requests
+	c.Lock()
+	c.setStatus(c.members[1], memberStatusDown, "manual")
+	c.Unlock()
+	_, err = c.getMember()
+	assert.Equal(t, ErrSwanDown, err, "should be equal")
+
+	c.Unpin()
+	endpoint, err := c.getMember()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://swan-1:9999", endpoint, "should select as usual")
+}
+
+func TestSelectWeightedRandom(t *testing.T) {
+	selections := func(seed int64) []string {
+		c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+			WithSelector(SelectWeightedRandom(rand.New(rand.NewSource(seed)))),
+			WithMemberWeights(map[string]int{"http://swan-1:9999": 0}))
+		assert.NoError(t, err)
+		var selected []string
+		for i := 0; i < 10; i++ {
+			endpoint, _ := c.getMember()
+			selected = append(selected, endpoint)
+		}
+		return selected
+	}
+	assert.Equal(t, selections(1), selections(1), "should be reproducible")
+	for _, endpoint := range selections(2) {
+		assert.Equal(t, "http://swan-2:9999", endpoint, "should skip the zero weight")
+	}
+
+	// step: the shared source is safe to use concurrently
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithSelector(SelectWeightedRandom(nil)))
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.getMember()
+			}
+		}()
+	}
+	wg.Wait()
+}
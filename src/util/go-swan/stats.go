@@ -0,0 +1,550 @@
+package swan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ProbeFailure is the kind of failure of a health check
+type ProbeFailure string
+
+const (
+	// ProbeConnectionFailure is a health check which never got an answer, i.e. the host is
+	// unreachable or a firewall drops the connection
+	ProbeConnectionFailure ProbeFailure = "connection"
+	// ProbeResponseFailure is a health check the member answered but not as healthy, i.e. with
+	// a bad status
+	ProbeResponseFailure ProbeFailure = "response"
+)
+
+// ProbeResult is the outcome of a health check
+type ProbeResult struct {
+	// when the health check completed
+	Time time.Time
+	// the status code the member answered with, zero when it didn't answer
+	StatusCode int
+	// how long the health check took
+	Latency time.Duration
+	// why the member failed the health check, empty when it passed
+	Error string
+	// the kind of the failure, empty when it passed
+	Failure ProbeFailure
+}
+
+// MemberInfo is a snapshot of the state of a member
+type MemberInfo struct {
+	// the endpoint of the member
+	Endpoint string
+	// the status of the member, i.e. UP or DOWN
+	Status string
+	// the region of the member
+	Region string
+	// whether the member is only selected when none of the others is up
+	Fallback bool
+	// the priority tier of the member, the lowest tier with a member up is selected from
+	Tier int
+	// whether the members agreed on the member as the leader on the latest leader poll
+	Leader bool
+	// whether the leader is healthy for the writes, independently of its status for the reads,
+	// see WithLeaderWrites
+	LeaderHealthy bool
+	// whether every request is sent to the member for debugging, see PinEndpoint
+	Pinned bool
+	// the tags of the member, nil when it has none, see SetMemberTags
+	Tags map[string]string
+	// why the member isn't up, empty when it is or the reason is unknown
+	Reason string
+	// the health checks performed on the member
+	ProbeCount int64
+	// the times the member was selected since the counters were reset, see ResetSelections
+	Selections int64
+	// the outcome of the latest health check, nil until one was performed
+	LastProbe *ProbeResult
+	// the health checks which never got an answer
+	ConnectionFailures int64
+	// the health checks which were answered but not as healthy
+	ResponseFailures int64
+	// the liveness checks in a row the member passed or failed since its status changed, see
+	// WithProbeThresholds
+	ConsecutivePasses   int
+	ConsecutiveFailures int
+	// whether a health check is running to recover the member, a member which is down without
+	// one is not recovering
+	Probing bool
+	// why the health checks leave the member alone, i.e. "drained", empty when it's probed as usual
+	NotProbed string
+	// the end of the quarantine of a flapping member, zero when it's not quarantined
+	QuarantinedUntil time.Time
+	// the end of the expiry of a member going away, zero when it's not expired, see ExpireMember
+	ExpiredUntil time.Time
+	// when the latest request to the member failed, only tracked with WithFailurePenalty
+	LastFailure time.Time
+	// the requests which opened a new connection, only counted when tracing connections
+	NewConnections int64
+	// the requests which reused a pooled connection, only counted when tracing connections
+	ReusedConnections int64
+	// the reused connections which were idle in the pool
+	IdleConnections int64
+}
+
+// Members returns a snapshot of the members in the configured order
+func (c *cluster) Members() []MemberInfo {
+	c.RLock()
+	defer c.RUnlock()
+	var list []MemberInfo
+	for _, m := range c.members {
+		var notProbed string
+		if c.skipsProbes(m) {
+			notProbed = "drained"
+		}
+		list = append(list, MemberInfo{
+			Endpoint:            m.endpoint,
+			Status:              m.status.String(),
+			Region:              m.region,
+			Fallback:            m.fallback,
+			Tier:                m.tier,
+			Leader:              m.leader,
+			LeaderHealthy:       m.leaderHealthy,
+			Pinned:              m == c.pinned,
+			Tags:                copyTags(m.tags),
+			Reason:              m.reason,
+			ProbeCount:          atomic.LoadInt64(&m.probes),
+			Selections:          atomic.LoadInt64(&m.selections),
+			LastProbe:           copyProbeResult(m.lastProbe),
+			ConnectionFailures:  m.connectionFailures,
+			ResponseFailures:    m.responseFailures,
+			ConsecutivePasses:   m.probePasses,
+			ConsecutiveFailures: m.probeFailures,
+			Probing:             m.checking,
+			NotProbed:           notProbed,
+			QuarantinedUntil:    m.quarantinedUntil,
+			ExpiredUntil:        m.expiredUntil,
+			LastFailure:         m.lastFailure,
+			NewConnections:      atomic.LoadInt64(&m.newConns),
+			ReusedConnections:   atomic.LoadInt64(&m.reusedConns),
+			IdleConnections:     atomic.LoadInt64(&m.idleConns),
+		})
+	}
+
+	return list
+}
+
+// AvailabilityRatio returns the fraction of the members which are up, between 0 and 1, i.e. for
+// a gauge alerting when it drops below a threshold. An empty cluster has a ratio of 0
+func (c *cluster) AvailabilityRatio() float64 {
+	return c.availabilityRatio(false)
+}
+
+// WeightedAvailabilityRatio returns the share of the weight of the members which is up, between 0
+// and 1, so a heavy member being down counts for more than a light one. An empty cluster has a
+// ratio of 0, and one whose members all have a zero weight the ratio of AvailabilityRatio
+func (c *cluster) WeightedAvailabilityRatio() float64 {
+	return c.availabilityRatio(true)
+}
+
+// availabilityRatio returns the share of the members which are up, by weight when weighted
+func (c *cluster) availabilityRatio(weighted bool) float64 {
+	c.RLock()
+	defer c.RUnlock()
+	var up, total, upWeight, totalWeight int
+	for _, m := range c.members {
+		total++
+		totalWeight += m.weight
+		if m.status == memberStatusUp {
+			up++
+			upWeight += m.weight
+		}
+	}
+	switch {
+	case total == 0:
+		return 0
+	case weighted && totalWeight > 0:
+		return float64(upWeight) / float64(totalWeight)
+	}
+
+	return float64(up) / float64(total)
+}
+
+// FailoverRate returns the requests per minute which failed over to another member, over the window
+// of the failover warning or the last minute when there's none, see WithFailoverWarning
+func (c *cluster) FailoverRate() float64 {
+	c.failoverMu.Lock()
+	count := c.recentFailovers(time.Now())
+	c.failoverMu.Unlock()
+
+	return float64(count) / c.failoverWindow().Minutes()
+}
+
+// the most changes between up and out of rotation kept per member, the older ones are dropped
+const uptimeHistory = 1024
+
+// statusSpan is a change of a member between up and out of rotation
+type statusSpan struct {
+	// when the member changed
+	since time.Time
+	// whether the member went up
+	up bool
+}
+
+// recordUptime records the status change of the node when it went up or out of rotation, the
+// changes between the statuses out of rotation are coalesced. The caller must hold the write lock
+func recordUptime(n *member, up bool, now time.Time) {
+	if len(n.uptime) > 0 && n.uptime[len(n.uptime)-1].up == up {
+		return
+	}
+	if len(n.uptime) >= uptimeHistory {
+		copy(n.uptime, n.uptime[1:])
+		n.uptime = n.uptime[:len(n.uptime)-1]
+	}
+	n.uptime = append(n.uptime, statusSpan{since: now, up: up})
+}
+
+// UptimePercent returns the share of the window the member was up, between 0 and 100, i.e. over
+// the last 24 hours for a reliability report. Any status other than up counts as down. The window
+// is cut short to the history of the member: the time since it was added and at most the latest
+// 1024 changes, so a member flapping faster than that over the window is only measured over the
+// part still recorded. It fails with ErrUnknownMember when the endpoint isn't one
+func (c *cluster) UptimePercent(endpoint string, window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, errors.New(fmt.Sprintf("window: %s must be positive", window))
+	}
+	c.RLock()
+	defer c.RUnlock()
+	n := c.findMember(endpoint)
+	if n == nil {
+		return 0, ErrUnknownMember
+	}
+	now := time.Now()
+	start := now.Add(-window)
+	if first := n.uptime[0].since; first.After(start) {
+		start = first
+	}
+	if !now.After(start) {
+		if n.status == memberStatusUp {
+			return 100, nil
+		}
+		return 0, nil
+	}
+	var up time.Duration
+	for i, span := range n.uptime {
+		end := now
+		if i+1 < len(n.uptime) {
+			end = n.uptime[i+1].since
+		}
+		if !span.up || !end.After(start) {
+			continue
+		}
+		from := span.since
+		if from.Before(start) {
+			from = start
+		}
+		up += end.Sub(from)
+	}
+
+	return 100 * float64(up) / float64(now.Sub(start)), nil
+}
+
+// ResetSelections sets the selection counters of the members back to zero, i.e. to measure the
+// distribution over a period
+func (c *cluster) ResetSelections() {
+	c.RLock()
+	defer c.RUnlock()
+	for _, m := range c.members {
+		atomic.StoreInt64(&m.selections, 0)
+	}
+}
+
+// HealthReportHeader is the header of the columns of the rows of HealthReport, tab separated
+// for a text/tabwriter
+const HealthReportHeader = "ENDPOINT\tSTATUS\tIN STATE\tLAST ERROR\tPROBES\tWEIGHT\tTAGS"
+
+// HealthRow is the health of a member as a row of a status table
+type HealthRow struct {
+	// the endpoint of the member
+	Endpoint string
+	// the status of the member, i.e. UP or DOWN
+	Status string
+	// how long the member has been in its status
+	InState time.Duration
+	// why the member isn't up, or else the error of the latest health check, empty when none
+	LastError string
+	// the health checks performed on the member
+	ProbeCount int64
+	// the selection weight of the member
+	Weight int
+	// the tags of the member, nil when it has none
+	Tags map[string]string
+}
+
+// String renders the row as tab separated columns matching HealthReportHeader
+func (r HealthRow) String() string {
+	lastError := r.LastError
+	if lastError == "" {
+		lastError = "-"
+	}
+	// step: render the tags sorted by key, i.e. az=us-east-1a,rack=r1
+	var tags []string
+	for key, value := range r.Tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	if len(tags) == 0 {
+		tags = []string{"-"}
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d\t%s", r.Endpoint, r.Status, r.InState.Truncate(time.Second),
+		lastError, r.ProbeCount, r.Weight, strings.Join(tags, ","))
+}
+
+// HealthReport returns the health of every member sorted by endpoint, taken under a single lock
+// so the rows are consistent with each other
+func (c *cluster) HealthReport() []HealthRow {
+	c.RLock()
+	defer c.RUnlock()
+	var rows []HealthRow
+	for _, m := range c.members {
+		row := HealthRow{
+			Endpoint:   m.endpoint,
+			Status:     m.status.String(),
+			InState:    time.Since(m.since),
+			LastError:  m.reason,
+			ProbeCount: atomic.LoadInt64(&m.probes),
+			Weight:     m.weight,
+			Tags:       copyTags(m.tags),
+		}
+		if row.LastError == "" && m.lastProbe != nil {
+			row.LastError = m.lastProbe.Error
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Endpoint < rows[j].Endpoint
+	})
+
+	return rows
+}
+
+// savedStats is the persisted form of the member statistics
+type savedStats struct {
+	// when the statistics were saved
+	SavedAt time.Time `json:"saved_at"`
+	// the statistics of each member
+	Members []savedMember `json:"members"`
+}
+
+// savedMember is the persisted form of the statistics of a member, the outcomes of the error rate
+// window are saved oldest first
+type savedMember struct {
+	Endpoint           string        `json:"endpoint"`
+	Status             string        `json:"status"`
+	Reason             string        `json:"reason,omitempty"`
+	Drained            bool          `json:"drained,omitempty"`
+	Latency            time.Duration `json:"latency"`
+	ReadinessFailures  int           `json:"readiness_failures"`
+	ConnectionFailures int64         `json:"connection_failures"`
+	ResponseFailures   int64         `json:"response_failures"`
+	Outcomes           []bool        `json:"outcomes,omitempty"`
+	LastSuccess        time.Time     `json:"last_success"`
+}
+
+// SaveStats writes the learned statistics of the members to the writer, so they can be reloaded
+// with LoadStats after a restart rather than starting cold
+func (c *cluster) SaveStats(w io.Writer) error {
+	c.RLock()
+	saved := savedStats{SavedAt: time.Now()}
+	for _, m := range c.members {
+		// step: unroll the ring of the outcomes, oldest first
+		outcomes := append([]bool(nil), m.outcomes[m.nextOutcome:]...)
+		outcomes = append(outcomes, m.outcomes[:m.nextOutcome]...)
+		saved.Members = append(saved.Members, savedMember{
+			Endpoint:           m.endpoint,
+			Status:             m.status.String(),
+			Reason:             m.reason,
+			Drained:            m.drained,
+			Latency:            m.latency,
+			ReadinessFailures:  m.readinessFailures,
+			ConnectionFailures: m.connectionFailures,
+			ResponseFailures:   m.responseFailures,
+			Outcomes:           outcomes,
+			LastSuccess:        m.lastSuccess,
+		})
+	}
+	c.RUnlock()
+
+	return json.NewEncoder(w).Encode(saved)
+}
+
+// LoadStats restores the statistics written by SaveStats. Statistics older than the max age, or
+// of endpoints which are no longer members, are discarded. A member saved as down is marked down
+// and health checked, i.e. it's only used again once it answers. A member saved as draining stays
+// out until the health check brings it back, or until Undrain when it was drained by DrainAndWait,
+// and one saved as not ready until it passes the readiness check, when there's one
+func (c *cluster) LoadStats(r io.Reader, maxAge time.Duration) error {
+	var saved savedStats
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return err
+	}
+	if time.Since(saved.SavedAt) > maxAge {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, s := range saved.Members {
+		n := c.findMember(s.Endpoint)
+		if n == nil {
+			continue
+		}
+		n.latency = s.Latency
+		n.readinessFailures = s.ReadinessFailures
+		n.connectionFailures = s.ConnectionFailures
+		n.responseFailures = s.ResponseFailures
+		n.lastSuccess = s.LastSuccess
+		c.restoreOutcomes(n, s.Outcomes)
+		if n.status != memberStatusUp {
+			continue
+		}
+		switch s.Status {
+		case memberStatus(memberStatusDown).String():
+			if !c.keepUp(n, s.Reason) {
+				c.setStatus(n, memberStatusDown, s.Reason)
+				c.startHealthCheck(n)
+			}
+		case memberStatus(memberStatusDraining).String():
+			if !c.keepUp(n, s.Reason) {
+				n.drained = s.Drained
+				c.setStatus(n, memberStatusDraining, s.Reason)
+				c.startHealthCheck(n)
+			}
+		case memberStatus(memberStatusNotReady).String():
+			// step: without a readiness check nothing would bring the member back
+			if c.config.readinessPath != "" {
+				c.setStatus(n, memberStatusNotReady, s.Reason)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreOutcomes refills the error rate window of the member with the saved outcomes, oldest
+// first, keeping the most recent ones which fit the window. The caller must hold the write lock
+func (c *cluster) restoreOutcomes(n *member, outcomes []bool) {
+	if c.config.errorRateWindow == 0 {
+		return
+	}
+	if len(outcomes) > c.config.errorRateWindow {
+		outcomes = outcomes[len(outcomes)-c.config.errorRateWindow:]
+	}
+	n.outcomes = append([]bool(nil), outcomes...)
+	n.nextOutcome = 0
+	n.failures = 0
+	for _, failed := range outcomes {
+		if failed {
+			n.failures++
+		}
+	}
+}
+
+// copyProbeResult returns a copy of the result for a snapshot, nil when there is none
+func copyProbeResult(result *ProbeResult) *ProbeResult {
+	if result == nil {
+		return nil
+	}
+	copied := *result
+
+	return &copied
+}
+
+// traceConnections attaches a trace to the request counting the connection it gets against the
+// member, it returns the request unchanged when connection tracing is disabled
+func (c *cluster) traceConnections(endpoint string, request *http.Request) *http.Request {
+	if !c.config.traceConnections {
+		return request
+	}
+	c.RLock()
+	m := c.findMember(endpoint)
+	c.RUnlock()
+	if m == nil {
+		return request
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				atomic.AddInt64(&m.newConns, 1)
+				return
+			}
+			atomic.AddInt64(&m.reusedConns, 1)
+			if info.WasIdle {
+				atomic.AddInt64(&m.idleConns, 1)
+			}
+		},
+	}
+
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
+
+// Dump renders the state of the cluster in a compact block for debugging, i.e. on a /debug/swan
+// endpoint. The members are sorted by endpoint so dumps taken over time can be diffed. The state
+// of the selector, the selections of each member and the number of its latest selection tell why
+// a member was picked
+func (c *cluster) Dump() string {
+	c.RLock()
+	defer c.RUnlock()
+	members := append([]*member(nil), c.members...)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].endpoint < members[j].endpoint
+	})
+	up := 0
+	for _, m := range members {
+		if m.status == memberStatusUp {
+			up++
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "cluster: members=%d up=%d selector=%s", len(members), up, c.config.selector.Name())
+	// step: the position of the selector and the number of the latest selection explain a choice
+	if state, ok := c.SelectionState(); ok {
+		fmt.Fprintf(buf, " selector-state=%d", state)
+	}
+	fmt.Fprintf(buf, " selections=%d", atomic.LoadUint64(&c.selectionSequence))
+	if c.config.region != "" {
+		fmt.Fprintf(buf, " region=%s penalty=%v", c.config.region, c.config.regionPenalty)
+	}
+	buf.WriteString("\n")
+	for _, m := range members {
+		fmt.Fprintf(buf, "  %s status=%s", m.endpoint, m.status)
+		if m.reason != "" {
+			fmt.Fprintf(buf, " reason=%q", m.reason)
+		}
+		if m.region != "" {
+			fmt.Fprintf(buf, " region=%s", m.region)
+		}
+		fmt.Fprintf(buf, " since=%s selections=%d last-selection=%d", formatTime(m.since),
+			atomic.LoadInt64(&m.selections), atomic.LoadUint64(&m.lastSelection))
+		fmt.Fprintf(buf, " last-success=%s probes=%d readiness-failures=%d conns=%d/%d/%d\n",
+			formatTime(m.lastSuccess), atomic.LoadInt64(&m.probes), m.readinessFailures,
+			atomic.LoadInt64(&m.newConns), atomic.LoadInt64(&m.reusedConns), atomic.LoadInt64(&m.idleConns))
+	}
+
+	return buf.String()
+}
+
+// formatTime renders a timestamp for the dump, never for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,378 @@
+package swan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembers(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithRegionAffinity("north", map[string]string{"http://swan-2:9999": "south"}))
+	assert.NoError(t, err)
+	c.members[0].status = memberStatusDown
+
+	members := c.Members()
+	assert.Len(t, members, 2)
+	assert.Equal(t, MemberInfo{Endpoint: "http://swan-1:9999", Status: "DOWN"}, members[0], "should be equal")
+	assert.Equal(t, MemberInfo{Endpoint: "http://swan-2:9999", Status: "UP", Region: "south"}, members[1], "should be equal")
+}
+
+func TestMembersLastProbe(t *testing.T) {
+	var healthy int32
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL)
+	assert.NoError(t, err)
+	assert.Nil(t, c.Members()[0].LastProbe, "should be empty until probed")
+	assert.Error(t, c.probeNode(c.members[0]))
+	info := c.Members()[0]
+	assert.Equal(t, int64(1), info.ProbeCount, "should be equal")
+	assert.Equal(t, http.StatusServiceUnavailable, info.LastProbe.StatusCode, "should be equal")
+	assert.Equal(t, "health check returned status: 503", info.LastProbe.Error, "should be equal")
+	assert.Equal(t, ProbeResponseFailure, info.LastProbe.Failure, "should be equal")
+	assert.Equal(t, int64(1), info.ResponseFailures, "should be equal")
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.NoError(t, c.probeNode(c.members[0]))
+	info = c.Members()[0]
+	assert.Equal(t, int64(2), info.ProbeCount, "should be equal")
+	assert.Equal(t, ProbeResult{Time: info.LastProbe.Time, StatusCode: http.StatusOK, Latency: info.LastProbe.Latency}, *info.LastProbe, "should pass")
+	assert.False(t, info.LastProbe.Time.IsZero(), "should be set")
+}
+
+func TestMembersProbeFailures(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	c, err := newCluster(http.DefaultClient, closed.URL, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	err = c.probeNode(c.members[0])
+	var probeErr *ProbeError
+	assert.True(t, errors.As(err, &probeErr), "should be a probe error")
+	assert.Equal(t, ProbeConnectionFailure, probeErr.Failure, "should be equal")
+	info := c.Members()[0]
+	assert.Equal(t, ProbeConnectionFailure, info.LastProbe.Failure, "should be equal")
+	assert.Equal(t, int64(1), info.ConnectionFailures, "should be equal")
+	assert.Equal(t, int64(0), info.ResponseFailures, "should be equal")
+
+	assert.Error(t, c.RefreshNow(context.Background()))
+	assert.True(t, strings.HasPrefix(c.Members()[0].Reason, "connection failure: "), "should record the kind in the reason")
+}
+
+func TestMembersSelections(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999",
+		WithSelector(SelectWeighted()), WithMemberWeights(map[string]int{"http://swan-2:9999": 3}))
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.getMember()
+			}
+		}()
+	}
+	wg.Wait()
+	members := c.Members()
+	assert.Equal(t, int64(100), members[0].Selections, "should be equal")
+	assert.Equal(t, int64(300), members[1].Selections, "should be equal")
+
+	c.ResetSelections()
+	assert.Equal(t, int64(0), c.Members()[0].Selections, "should be reset")
+}
+
+func TestAvailabilityRatio(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999,http://swan-4:9999",
+		WithMemberWeights(map[string]int{"http://swan-1:9999": 5}), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, 1.0, c.AvailabilityRatio(), "should be fully available")
+
+	c.markDown("http://swan-1:9999")
+	assert.Equal(t, 0.75, c.AvailabilityRatio(), "should be equal")
+	assert.Equal(t, 3.0/8, c.WeightedAvailabilityRatio(), "should weigh the members")
+
+	// step: with no weight the members count the same
+	for _, endpoint := range []string{"http://swan-1:9999", "http://swan-2:9999", "http://swan-3:9999", "http://swan-4:9999"} {
+		assert.NoError(t, c.SetMemberWeight(endpoint, 0))
+	}
+	assert.Equal(t, 0.75, c.WeightedAvailabilityRatio(), "should be equal")
+	assert.Equal(t, 0.0, (&cluster{}).AvailabilityRatio(), "should be zero when empty")
+}
+
+func TestUptimePercent(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	_, err = c.UptimePercent("http://swan-3:9999", time.Hour)
+	assert.Equal(t, ErrUnknownMember, err, "should be equal")
+	_, err = c.UptimePercent("http://swan-1:9999", 0)
+	assert.Error(t, err)
+	uptime, err := c.UptimePercent("http://swan-1:9999", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 100.0, uptime, "should be up since it was added")
+
+	// step: the window is cut short to the history of the member
+	now := time.Now()
+	c.Lock()
+	c.members[0].uptime = []statusSpan{{since: now.Add(-4 * time.Hour), up: true},
+		{since: now.Add(-3 * time.Hour), up: false}, {since: now.Add(-2 * time.Hour), up: true}}
+	c.Unlock()
+	for window, expected := range map[time.Duration]float64{time.Hour: 100, 3 * time.Hour: 200.0 / 3, 24 * time.Hour: 75} {
+		uptime, err := c.UptimePercent("http://swan-1:9999", window)
+		assert.NoError(t, err)
+		assert.True(t, math.Abs(uptime-expected) < 0.01, fmt.Sprintf("%v should be close to %v", uptime, expected))
+	}
+
+	// step: the history stays bounded however much the member flaps
+	c.Lock()
+	for i := 0; i < 2*uptimeHistory; i++ {
+		c.setStatus(c.members[1], memberStatusDown, "flapping")
+		c.setStatus(c.members[1], memberStatusDraining, "maintenance")
+		c.setStatus(c.members[1], memberStatusUp, "")
+	}
+	c.Unlock()
+	assert.Len(t, c.members[1].uptime, uptimeHistory)
+}
+
+func TestMembersProbing(t *testing.T) {
+	var healthy int32
+	server := newPingServer(&healthy)
+	defer server.Close()
+
+	c, err := newCluster(http.DefaultClient, server.URL, WithHealthCheckInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	assert.False(t, c.Members()[0].Probing, "should not probe an up member")
+	c.markDown(server.URL)
+	assert.True(t, c.Members()[0].Probing, "should probe a down member")
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.True(t, waitFor(func() bool { return c.Members()[0].Status == "UP" }), "should recover")
+	assert.False(t, c.Members()[0].Probing, "should stop probing once up")
+
+	atomic.StoreInt32(&healthy, 0)
+	c.markDown(server.URL)
+	c.Close()
+	assert.True(t, waitFor(func() bool { return !c.Members()[0].Probing }), "should stop probing once closed")
+}
+
+func TestHealthReport(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-2:9999,http://swan-1:9999",
+		WithMemberWeights(map[string]int{"http://swan-1:9999": 3}))
+	assert.NoError(t, err)
+	c.members[0].status = memberStatusDown
+	c.members[0].reason = "connection refused"
+	c.members[0].since = time.Now().Add(-90 * time.Second)
+	c.members[1].lastProbe = &ProbeResult{Error: "health check returned status: 503"}
+
+	rows := c.HealthReport()
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "http://swan-1:9999", rows[0].Endpoint, "should be sorted by endpoint")
+	assert.Equal(t, "health check returned status: 503", rows[0].LastError, "should fall back to the probe")
+	assert.Equal(t, 3, rows[0].Weight, "should be equal")
+	assert.Equal(t, "DOWN", rows[1].Status, "should be equal")
+	assert.True(t, rows[1].InState >= 90*time.Second, "should be in the state since it changed")
+
+	rows[1].InState = 90 * time.Second
+	assert.Equal(t, "http://swan-2:9999\tDOWN\t1m30s\tconnection refused\t0\t1\t-", rows[1].String(), "should be equal")
+	assert.Equal(t, strings.Count(rows[1].String(), "\t"), strings.Count(HealthReportHeader, "\t"), "should match the header")
+}
+
+func TestMemberTags(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999?tag.rack=r1&tag.az=us-east-1a&region=us-east,http://swan-2:9999",
+		WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, []string{"http://swan-1:9999", "http://swan-2:9999"}, c.activeMembers(), "should strip the tags")
+	members := c.Members()
+	assert.Equal(t, map[string]string{"rack": "r1", "az": "us-east-1a"}, members[0].Tags, "should be equal")
+	assert.Equal(t, "us-east", members[0].Region, "should keep the region")
+	assert.Nil(t, members[1].Tags)
+
+	// step: the tags are set by the api and carried by the events and the report
+	assert.Equal(t, ErrUnknownMember, c.SetMemberTags("http://swan-3:9999", nil), "should be equal")
+	assert.NoError(t, c.SetMemberTags("http://swan-2:9999", map[string]string{"build": "1.2.0"}))
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	c.markDown("http://swan-2:9999")
+	event := <-events
+	assert.Equal(t, "http://swan-2:9999", event.Endpoint, "should be equal")
+	assert.Equal(t, map[string]string{"build": "1.2.0"}, event.Tags, "should carry the tags")
+	rows := c.HealthReport()
+	assert.Equal(t, map[string]string{"rack": "r1", "az": "us-east-1a"}, rows[0].Tags, "should be equal")
+	assert.True(t, strings.HasSuffix(rows[0].String(), "\taz=us-east-1a,rack=r1"), "should render the tags sorted")
+
+	// step: the annotations replace the tags, the members without any keep theirs
+	assert.NoError(t, c.SetMembers([]string{"http://swan-1:9999?tag.rack=r2", "http://swan-2:9999"}))
+	assert.Equal(t, map[string]string{"rack": "r2"}, c.Members()[0].Tags, "should follow the annotations")
+	assert.Equal(t, map[string]string{"build": "1.2.0"}, c.Members()[1].Tags, "should be kept")
+	assert.NoError(t, c.SetMemberTags("http://swan-2:9999", nil))
+	assert.Nil(t, c.Members()[1].Tags)
+
+	_, err = newCluster(http.DefaultClient, "http://swan-1:9999?tag.=r1")
+	assert.Error(t, err, "should need a tag name")
+}
+
+func TestConnectionTracing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithConnectionTracing(true))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = client.Applications(nil)
+		assert.NoError(t, err)
+	}
+	info := client.(*swanClient).hosts.Members()[0]
+	assert.Equal(t, int64(1), info.NewConnections, "should open a single connection")
+	assert.Equal(t, int64(2), info.ReusedConnections, "should reuse the connection")
+	assert.Equal(t, int64(2), info.IdleConnections, "should be equal")
+
+	// step: nothing is counted when tracing is off
+	client, err = NewClient(server.URL)
+	assert.NoError(t, err)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), client.(*swanClient).hosts.Members()[0].NewConnections, "should be equal")
+}
+
+func TestDump(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-2:9999,http://swan-1:9999",
+		WithRegionAffinity("north", map[string]string{"http://swan-2:9999": "south"}))
+	assert.NoError(t, err)
+	c.members[1].status = memberStatusDown
+	c.members[1].probes = 3
+	c.members[0].lastSuccess = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.members[0].since = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.members[1].since = time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		_, err = c.getMember()
+		assert.NoError(t, err)
+	}
+
+	expected := "cluster: members=2 up=1 selector=first-available selections=2 region=north penalty=1\n" +
+		"  http://swan-1:9999 status=DOWN since=2017-01-02T00:00:00Z selections=0 last-selection=0 last-success=never probes=3 readiness-failures=0 conns=0/0/0\n" +
+		"  http://swan-2:9999 status=UP region=south since=2017-01-01T00:00:00Z selections=2 last-selection=2 last-success=2017-01-02T03:04:05Z probes=0 readiness-failures=0 conns=0/0/0\n"
+	assert.Equal(t, expected, c.Dump(), "should be equal")
+
+	// step: a selector keeping a position reports it
+	c, err = newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithSelector(SelectWeighted()))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = c.getMember()
+		assert.NoError(t, err)
+	}
+	assert.Contains(t, c.Dump(), "selector=weighted selector-state=3 selections=3\n")
+}
+
+func TestSaveLoadStats(t *testing.T) {
+	c, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999", WithHealthCheckInterval(time.Hour),
+		WithErrorRate(0.9, 3))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.observeLatency("http://swan-2:9999", 20*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		c.markFailure("http://swan-2:9999", "timeout")
+		c.markSuccess("http://swan-2:9999")
+	}
+	c.Lock()
+	c.members[0].connectionFailures, c.members[0].responseFailures = 3, 2
+	c.Unlock()
+	c.markDownReason("http://swan-1:9999", "dial timeout")
+	buf := &bytes.Buffer{}
+	assert.NoError(t, c.SaveStats(buf))
+	saved := buf.String()
+
+	// step: the error rate window keeps the most recent outcomes which fit
+	restored, err := newCluster(http.DefaultClient, "http://swan-1:9999,http://swan-2:9999,http://swan-3:9999",
+		WithHealthCheckInterval(time.Hour), WithErrorRate(0.9, 2))
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.NoError(t, restored.LoadStats(strings.NewReader(saved), time.Minute))
+	restored.RLock()
+	assert.Equal(t, 20*time.Millisecond, restored.members[1].latency, "should be restored")
+	assert.Equal(t, []bool{true, false}, restored.members[1].outcomes, "should be restored")
+	assert.Equal(t, 1, restored.members[1].failures, "should be restored")
+	assert.Equal(t, int64(3), restored.members[0].connectionFailures, "should be restored")
+	assert.Equal(t, int64(2), restored.members[0].responseFailures, "should be restored")
+	restored.RUnlock()
+	assert.Equal(t, []string{"http://swan-1:9999"}, restored.nonActiveMembers(), "should be restored")
+	assert.Equal(t, "dial timeout", restored.Members()[0].Reason, "should be restored")
+
+	// step: stale statistics are discarded
+	fresh, err := newCluster(http.DefaultClient, "http://swan-1:9999")
+	assert.NoError(t, err)
+	assert.NoError(t, fresh.LoadStats(strings.NewReader(saved), 0))
+	assert.Equal(t, 1, len(fresh.activeMembers()), "should be discarded")
+
+	assert.Error(t, fresh.LoadStats(strings.NewReader("{"), time.Minute))
+}
+
+func TestLoadStatsStatuses(t *testing.T) {
+	var servers []string
+	for i := 0; i < 3; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ready" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		servers = append(servers, server.URL)
+	}
+	sort.Strings(servers)
+	endpoints := strings.Join(servers, ",")
+	c, err := newCluster(http.DefaultClient, endpoints, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	c.Lock()
+	c.members[0].drained = true
+	c.setStatus(c.members[0], memberStatusDraining, "drained")
+	c.setStatus(c.members[1], memberStatusDraining, "maintenance")
+	c.setStatus(c.members[2], memberStatusNotReady, "503 from gateway")
+	c.Unlock()
+	buf := &bytes.Buffer{}
+	assert.NoError(t, c.SaveStats(buf))
+	saved := buf.String()
+
+	restored, err := newCluster(http.DefaultClient, endpoints, WithHealthCheckInterval(10*time.Millisecond),
+		WithReadinessProbe("/ready", time.Hour, 100))
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.NoError(t, restored.LoadStats(strings.NewReader(saved), time.Minute))
+	members := restored.Members()
+	assert.Equal(t, "DRAINING", members[0].Status, "should stay drained")
+	assert.Equal(t, "NOT READY", members[2].Status, "should be restored")
+	assert.Equal(t, "503 from gateway", members[2].Reason, "should be restored")
+
+	// step: the member in maintenance is brought back by its health check, the drained one isn't
+	assert.True(t, waitFor(func() bool { return len(restored.activeMembers()) == 1 }), "should recover")
+	assert.Equal(t, []string{servers[1]}, restored.activeMembers(), "should be equal")
+	assert.Equal(t, "DRAINING", restored.Members()[0].Status, "should stay drained until undrained")
+
+	// step: without a readiness check the member would never be ready again
+	unchecked, err := newCluster(http.DefaultClient, endpoints, WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer unchecked.Close()
+	assert.NoError(t, unchecked.LoadStats(strings.NewReader(saved), time.Minute))
+	assert.Equal(t, "UP", unchecked.Members()[2].Status, "should stay up")
+}
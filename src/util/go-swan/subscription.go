@@ -30,10 +30,13 @@ func (r *swanClient) registerSSESubscription(channel EventsChannel) error {
 		return err
 	}
 
-	request, err := r.apiRequest("GET", fmt.Sprintf("%s/%s", url, defaultEventsURL), nil)
+	request, err := r.apiRequest(r.context(), "GET", joinURL(url, defaultEventsURL), nil)
 	if err != nil {
 		return err
 	}
+	if err := r.hosts.decorate(request); err != nil {
+		return err
+	}
 
 	// Try to connect to stream, reusing the http client settings
 	stream, err := eventsource.SubscribeWith("", r.httpClient, request)
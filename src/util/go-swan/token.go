@@ -0,0 +1,58 @@
+package swan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TokenSource obtains a new auth token, i.e. a short-lived bearer token from an identity provider
+type TokenSource func(ctx context.Context) (string, error)
+
+// WithTokenSource sends the token obtained from the source as a bearer token in the Authorization
+// header of every request and health check. The token is cached for the ttl and only refreshed
+// when a request is about to be sent with a stale one, a failure to refresh it failing the request
+// with ErrTokenRefresh rather than the member: the requests don't fail over and the health checks
+// report an auth failure, see ErrProbeUnauthorized
+func WithTokenSource(source TokenSource, ttl time.Duration) ClusterOption {
+	return func(config *clusterConfig) {
+		config.tokenSource = source
+		config.tokenTTL = ttl
+	}
+}
+
+// authorize sets the cached token on the request, refreshing it first when it's stale
+func (c *cluster) authorize(request *http.Request) error {
+	if c.config.tokenSource == nil {
+		return nil
+	}
+	token, err := c.authToken(request.Context())
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
+
+// authToken returns the cached token, refreshing it when it's stale. The concurrent requests wait
+// for the same refresh rather than refreshing it each
+func (c *cluster) authToken(ctx context.Context) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpires) {
+		return c.token, nil
+	}
+	token, err := c.config.tokenSource(ctx)
+	if err == nil && token == "" {
+		err = errors.New("empty token")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrTokenRefresh, err)
+	}
+	c.token, c.tokenExpires = token, time.Now().Add(c.config.tokenTTL)
+
+	return token, nil
+}
@@ -0,0 +1,104 @@
+package swan
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenSource(t *testing.T) {
+	var refreshes int32
+	var failing atomic.Value
+	failing.Store(false)
+	source := func(ctx context.Context) (string, error) {
+		if failing.Load().(bool) {
+			return "", errors.New("identity provider down")
+		}
+		atomic.AddInt32(&refreshes, 1)
+		return "secret", nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	_, err := newCluster(http.DefaultClient, server.URL, WithTokenSource(source, 0))
+	assert.Error(t, err, "should need a ttl")
+
+	client, err := NewClient(server.URL, WithTokenSource(source, time.Hour), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	swan := client.(*swanClient)
+	defer swan.hosts.Close()
+
+	// step: the token is cached across the requests and health checks
+	for i := 0; i < 3; i++ {
+		_, err = client.Applications(nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, swan.hosts.PingMember(context.Background(), server.URL))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes), "should refresh once")
+
+	// step: a stale token is refreshed, a failure to do so is an auth error
+	swan.hosts.tokenMu.Lock()
+	swan.hosts.tokenExpires = time.Now()
+	swan.hosts.tokenMu.Unlock()
+	failing.Store(true)
+	_, err = client.Applications(nil)
+	assert.ErrorIs(t, err, ErrTokenRefresh)
+	err = swan.hosts.PingMember(context.Background(), server.URL)
+	assert.ErrorIs(t, err, ErrProbeUnauthorized)
+	assert.Equal(t, []string{server.URL}, swan.hosts.activeMembers(), "should stay up")
+
+	failing.Store(false)
+	_, err = client.Applications(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&refreshes), "should refresh the stale token")
+}
+
+func TestTokenSourceFailureKeepsMembersUp(t *testing.T) {
+	source := func(ctx context.Context) (string, error) {
+		return "", errors.New("identity provider down")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// step: a refresh probing the members up
+	c, err := newCluster(http.DefaultClient, server.URL, WithTokenSource(source, time.Hour), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.ErrorIs(t, c.RefreshNow(context.Background()), ErrTokenRefresh)
+	assert.Equal(t, []string{server.URL}, c.activeMembers(), "should stay up after the refresh")
+
+	// step: an observing cluster
+	observer, err := newCluster(http.DefaultClient, server.URL, WithTokenSource(source, time.Hour), WithObserver(time.Hour))
+	assert.NoError(t, err)
+	defer observer.Close()
+	assert.ErrorIs(t, observer.RefreshNow(context.Background()), ErrTokenRefresh)
+	assert.Equal(t, []string{server.URL}, observer.activeMembers(), "should stay up while observing")
+	assert.Equal(t, 0, observer.Members()[0].ConsecutiveFailures, "should not count a failure")
+
+	// step: a readiness check
+	ready, err := newCluster(http.DefaultClient, server.URL, WithTokenSource(source, time.Hour),
+		WithReadinessProbe("/v1/leader", time.Hour, 1), WithHealthCheckInterval(time.Hour))
+	assert.NoError(t, err)
+	defer ready.Close()
+	for i := 0; i < 2; i++ {
+		ready.checkReadiness(ready.members[0])
+	}
+	assert.Equal(t, []string{server.URL}, ready.activeMembers(), "should stay ready")
+	ready.RLock()
+	assert.Equal(t, 0, ready.members[0].readinessFailures, "should not count a failure")
+	ready.RUnlock()
+}
@@ -0,0 +1,193 @@
+package swan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionAnswer is the answer of a master to the version check
+type versionAnswer struct {
+	// the version of the master, i.e. 0.1.3
+	Version string `json:"version"`
+}
+
+// version is a parsed major.minor.patch version
+type version [3]int
+
+// versionComparison is a single comparison of a version constraint, i.e. >=0.1.0
+type versionComparison struct {
+	// the operator, one of = != > >= < <=
+	operator string
+	// the version compared with
+	version version
+}
+
+// versionConstraint is a list of comparisons all of which a version must satisfy
+type versionConstraint []versionComparison
+
+// WithVersionCheck asks the members for their version on the path, the answer being a json
+// object with the version in its version field, and only uses those whose version satisfies the
+// constraint. The constraint is a comma separated list of comparisons which must all hold, i.e.
+// ">=0.1.0, <0.2.0", with the operators = != > >= < <= and = when there is none. The members are
+// checked in the background when the cluster is created and again before a down member is
+// marked up, the incompatible ones are INCOMPATIBLE and health checked until they satisfy it
+func WithVersionCheck(path, constraint string) ClusterOption {
+	return func(config *clusterConfig) {
+		config.versionPath = strings.TrimLeft(path, "/")
+		config.versionConstraint = constraint
+	}
+}
+
+// parseVersion parses a major.minor.patch version with an optional leading v, the missing
+// parts are zero and a pre-release or build suffix is ignored
+func parseVersion(value string) (version, error) {
+	var parsed version
+	trimmed := strings.TrimPrefix(strings.TrimSpace(value), "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+	parts := strings.Split(trimmed, ".")
+	if trimmed == "" || len(parts) > 3 {
+		return parsed, errors.New(fmt.Sprintf("version: %q is invalid", value))
+	}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return parsed, errors.New(fmt.Sprintf("version: %q is invalid", value))
+		}
+		parsed[i] = number
+	}
+
+	return parsed, nil
+}
+
+// compare returns -1, 0 or 1 as the version is older, the same or newer than the other
+func (v version) compare(other version) int {
+	for i := range v {
+		switch {
+		case v[i] < other[i]:
+			return -1
+		case v[i] > other[i]:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// parseVersionConstraint parses the comma separated comparisons of a constraint
+func parseVersionConstraint(constraint string) (versionConstraint, error) {
+	var parsed versionConstraint
+	for _, item := range strings.Split(constraint, ",") {
+		item = strings.TrimSpace(item)
+		operator := "="
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(item, candidate) {
+				operator = candidate
+				item = item[len(candidate):]
+				break
+			}
+		}
+		v, err := parseVersion(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("version constraint: %q is invalid reason: %s", constraint, err))
+		}
+		parsed = append(parsed, versionComparison{operator: operator, version: v})
+	}
+
+	return parsed, nil
+}
+
+// allows checks if the version satisfies all the comparisons of the constraint
+func (vc versionConstraint) allows(v version) bool {
+	for _, comparison := range vc {
+		result := v.compare(comparison.version)
+		var satisfied bool
+		switch comparison.operator {
+		case "=":
+			satisfied = result == 0
+		case "!=":
+			satisfied = result != 0
+		case ">":
+			satisfied = result > 0
+		case ">=":
+			satisfied = result >= 0
+		case "<":
+			satisfied = result < 0
+		case "<=":
+			satisfied = result <= 0
+		}
+		if !satisfied {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkVersions checks the versions of the members once, marking the incompatible ones
+func (c *cluster) checkVersions() {
+	c.RLock()
+	members := append([]*member(nil), c.members...)
+	c.RUnlock()
+	for _, n := range members {
+		err := c.checkVersion(n)
+		if !errors.Is(err, ErrIncompatibleVersion) {
+			continue
+		}
+		c.Lock()
+		if n.status == memberStatusUp || n.status == memberStatusNotReady {
+			c.setStatus(n, memberStatusIncompatible, err.Error())
+			c.startHealthCheck(n)
+		}
+		c.Unlock()
+	}
+}
+
+// checkVersion asks the node for its version, returning ErrIncompatibleVersion when it doesn't
+// satisfy the constraint. Nothing is checked when the version check is off
+func (c *cluster) checkVersion(node *member) error {
+	if c.versions == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.healthCheckInterval)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", joinURL(node.endpoint, c.config.versionPath), nil)
+	if err != nil {
+		return err
+	}
+	if err := c.decorate(request); err != nil {
+		return err
+	}
+	res, err := c.probeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("version check returned status: %d", res.StatusCode))
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var answer versionAnswer
+	if err := json.Unmarshal(body, &answer); err != nil {
+		return err
+	}
+	v, err := parseVersion(answer.Version)
+	if err != nil {
+		return err
+	}
+	if !c.versions.allows(v) {
+		return fmt.Errorf("%w: %s doesn't satisfy %s", ErrIncompatibleVersion, answer.Version, c.config.versionConstraint)
+	}
+
+	return nil
+}
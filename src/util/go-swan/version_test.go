@@ -0,0 +1,59 @@
+package swan
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	constraint, err := parseVersionConstraint(">=0.1.0, <0.2.0, !=0.1.4")
+	assert.NoError(t, err)
+	for value, expected := range map[string]bool{
+		"0.1.0":      true,
+		"v0.1.9":     true,
+		"0.1.3-rc.1": true,
+		"0.1":        true,
+		"0.1.4":      false,
+		"0.0.9":      false,
+		"0.2.0":      false,
+		"1.0.0":      false,
+	} {
+		v, err := parseVersion(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, constraint.allows(v), value)
+	}
+
+	constraint, err = parseVersionConstraint("1.2")
+	assert.NoError(t, err)
+	assert.Equal(t, versionConstraint{{operator: "=", version: version{1, 2, 0}}}, constraint, "should be equal")
+	for _, invalid := range []string{"", ">=", "~1.2.0", "1.2.3.4", ">=0.1.0,"} {
+		_, err := parseVersionConstraint(invalid)
+		assert.Error(t, err, "constraint %q should be invalid", invalid)
+	}
+}
+
+func TestVersionCheck(t *testing.T) {
+	one, first := newJSONServer(t, "/v1/version")
+	two, second := newJSONServer(t, "/v1/version")
+	first.Store(`{"version":"0.1.5"}`)
+	second.Store(`{"version":"0.2.0"}`)
+
+	_, err := newCluster(http.DefaultClient, one.URL, WithVersionCheck("/v1/version", ">=x"))
+	assert.Error(t, err)
+
+	c, err := newCluster(http.DefaultClient, one.URL+","+two.URL, WithHealthCheckInterval(10*time.Millisecond),
+		WithVersionCheck("/v1/version", ">=0.1.0, <0.2.0"))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.True(t, waitFor(func() bool {
+		return len(c.MembersByStatus()["INCOMPATIBLE"]) == 1
+	}), "should check the versions at startup")
+	assert.Equal(t, []string{one.URL}, c.activeMembers(), "should be equal")
+	assert.Equal(t, "the version of the Swan host is incompatible: 0.2.0 doesn't satisfy >=0.1.0, <0.2.0", c.Members()[1].Reason, "should be equal")
+
+	second.Store(`{"version":"0.1.9"}`)
+	assert.True(t, waitFor(func() bool { return len(c.activeMembers()) == 2 }), "should be up once compatible")
+}